@@ -1,20 +1,25 @@
 package main
 
 import (
-	"crypto/sha256"
-	"fmt"
+	"crypto/tls"
+	"flag"
 	"io"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 
-	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/accesslog"
+	"github.com/ar3ty/httpfromtcp/internal/compress"
+	"github.com/ar3ty/httpfromtcp/internal/debug"
+	"github.com/ar3ty/httpfromtcp/internal/fileserver"
+	"github.com/ar3ty/httpfromtcp/internal/proxy"
 	"github.com/ar3ty/httpfromtcp/internal/request"
 	"github.com/ar3ty/httpfromtcp/internal/response"
 	"github.com/ar3ty/httpfromtcp/internal/server"
+	"github.com/ar3ty/httpfromtcp/internal/websocket"
 )
 
 const port = 42069
@@ -49,80 +54,35 @@ func handler200(w *response.Writer, _ *request.Request) {
 	w.WriteBody(message)
 }
 
-func handlerVideo(w *response.Writer, req *request.Request) {
-	message, err := os.ReadFile("assets/vim.mp4")
-	if err != nil {
-		handler500(w, req)
-		return
-	}
+var handlerAssets = fileserver.Handler(fileserver.Config{
+	Root:        "assets",
+	StripPrefix: "/assets",
+	Listing:     true,
+})
 
-	w.WriteStatusLine(response.OK)
-	h := response.GetDefaultHeaders(len(message))
-	h.Replace("Content-Type", "video/mp4")
-	w.WriteHeaders(h)
-	w.WriteBody(message)
+var videoPath = "assets/vim.mp4"
+
+func handlerVideo(w *response.Writer, req *request.Request) {
+	fileserver.ServeFile(w, req, videoPath)
 }
 
-func handlerProxy(w *response.Writer, req *request.Request) {
-	target := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin")
-	url := "https://httpbin.org" + target
-	fmt.Println("Proxying to", url)
+var handlerProxy server.Handler
 
-	resp, err := http.Get(url)
+func handlerEcho(w *response.Writer, req *request.Request) {
+	conn, err := websocket.Upgrade(w, req, websocket.Config{})
 	if err != nil {
-		handler500(w, req)
 		return
 	}
-	defer resp.Body.Close()
-
-	w.WriteStatusLine(response.OK)
-
-	h := response.GetDefaultHeaders(0)
-	h.Delete("Content-Length")
-	h.Replace("Transfer-Encoding", "chunked")
-	h.Set("Trailer", "X-Content-SHA256")
-	h.Set("Trailer", "X-Content-Length")
-	w.WriteHeaders(h)
-
-	buf := make([]byte, 1024)
-	fullBody := []byte{}
-
+	defer conn.Close()
 	for {
-		n, err := resp.Body.Read(buf)
-		fmt.Println("Read", n, "bytes")
-		if n > 0 {
-			_, err := w.WriteChunkedBody(buf[:n])
-			if err != nil {
-				fmt.Println("Error writing chunk body:", err)
-			}
-			fullBody = append(fullBody, buf[:n]...)
-
-		}
-		if err == io.EOF {
-			break
-		}
+		messageType, message, err := conn.ReadMessage()
 		if err != nil {
-			fmt.Println("Error reading response body:", err)
-			break
+			return
+		}
+		if err := conn.WriteMessage(messageType, message); err != nil {
+			return
 		}
-
-	}
-	hash := sha256.Sum256(fullBody)
-
-	_, err = w.WriteChunkedBodyDone()
-	if err != nil {
-		fmt.Println("Error writing chunk body done:", err)
-	}
-
-	trailers := headers.NewHeaders()
-	trailers.Set("X-Content-SHA256", fmt.Sprintf("%x", hash))
-	trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
-
-	err = w.WriteTrailers(trailers)
-	if err != nil {
-		fmt.Println("Error writing trailers:", err)
 	}
-	fmt.Println("Wrote trailers")
 }
 
 func handler(w *response.Writer, req *request.Request) {
@@ -139,16 +99,105 @@ func handler(w *response.Writer, req *request.Request) {
 		handlerProxy(w, req)
 		return
 	}
+	if target == "/ws/echo" {
+		handlerEcho(w, req)
+		return
+	}
 	if target == "/video" {
 		handlerVideo(w, req)
 		return
 	}
+	if strings.HasPrefix(target, "/assets/") {
+		handlerAssets(w, req)
+		return
+	}
 
 	handler200(w, req)
 }
 
+// route names the handler a request went to, for the request metrics.
+func route(req *request.Request) string {
+	target := req.RequestLine.RequestTarget
+	switch {
+	case target == "/yourproblem", target == "/myproblem", target == "/ws/echo", target == "/video":
+		return target
+	case strings.HasPrefix(target, "/httpbin"):
+		return "/httpbin"
+	case strings.HasPrefix(target, "/assets/"):
+		return "/assets/"
+	default:
+		return "/"
+	}
+}
+
 func main() {
-	server, err := server.Serve(port, handler)
+	certFile := flag.String("cert", "", "TLS certificate file, serves HTTPS together with -key")
+	keyFile := flag.String("key", "", "TLS private key file")
+	accessLog := flag.String("access-log", "", `access log file, "-" for stdout`)
+	accessLogFormat := flag.String("access-log-format", "combined", "access log format: combined or json")
+	accessLogMaxSize := flag.Int64("access-log-max-size", 100, "size in MiB at which the access log file is rotated")
+	accessLogBackups := flag.Int("access-log-backups", 5, "number of rotated access log files to keep")
+	metricsPath := flag.String("metrics-path", "", "path serving Prometheus metrics, off if empty")
+	debugEndpoints := flag.Bool("debug", false, "serve profiles, open connections and config under /debug to loopback clients")
+	maxConns := flag.Int("max-conns", 0, "connections served at once, 0 for no limit")
+	queueConns := flag.Bool("queue-conns", false, "queue connections past -max-conns instead of rejecting them")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 0, "connections served at once for one client IP, 0 for no limit")
+	debugToken := flag.String("debug-token", "", "bearer token required by the debug endpoints, which are then served to any client")
+	forwardHosts := flag.String("forward-hosts", "", `comma-separated hosts to act as a forward proxy for, "*.example.com" for subdomains; off if empty`)
+	flag.Parse()
+
+	config := server.Config{
+		ServerName:    "httpfromtcp",
+		DecodeBodies:  true,
+		EnableH2C:     true,
+		MetricsPath:   *metricsPath,
+		Route:         route,
+		MaxConns:      *maxConns,
+		QueueConns:    *queueConns,
+		MaxConnsPerIP: *maxConnsPerIP,
+	}
+	if *certFile != "" && *keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			log.Fatalf("Error loading certificate: %v", err)
+		}
+		config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if *debugEndpoints || *debugToken != "" {
+		config.Debug = &debug.Config{Token: *debugToken}
+	}
+	if *accessLog != "" {
+		format, err := accesslog.ParseFormat(*accessLogFormat)
+		if err != nil {
+			log.Fatalf("Error configuring access log: %v", err)
+		}
+		var out io.Writer = os.Stdout
+		if *accessLog != "-" {
+			file, err := accesslog.OpenRotatingFile(*accessLog, *accessLogMaxSize<<20, *accessLogBackups)
+			if err != nil {
+				log.Fatalf("Error opening access log: %v", err)
+			}
+			defer file.Close()
+			out = file
+		}
+		config.AccessLog = accesslog.New(out, format)
+	}
+
+	var err error
+	handlerProxy, err = proxy.Handler(proxy.Config{
+		Upstream:    &url.URL{Scheme: "https", Host: "httpbin.org"},
+		StripPrefix: "/httpbin",
+		Trailers:    true,
+	})
+	if err != nil {
+		log.Fatalf("Error configuring proxy: %v", err)
+	}
+
+	h := server.Handler(handler)
+	if *forwardHosts != "" {
+		h = proxy.Forward(proxy.ForwardConfig{AllowedHosts: strings.Split(*forwardHosts, ","), Next: handler})
+	}
+	server, err := server.ServeWithConfig(port, compress.Handler(h, compress.Config{}), config)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
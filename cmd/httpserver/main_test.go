@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ar3ty/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+const videoSize = 16 << 20
+
+func setupVideo(b *testing.B) {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "vim.mp4")
+	data := make([]byte, videoSize)
+	rand.Read(data)
+	require.NoError(b, os.WriteFile(path, data, 0o644))
+
+	prev := videoPath
+	videoPath = path
+	b.Cleanup(func() { videoPath = prev })
+}
+
+func benchmarkVideo(b *testing.B, config server.Config) {
+	setupVideo(b)
+	s, err := server.ServeWithConfig(0, handler, config)
+	require.NoError(b, err)
+	defer s.Close()
+	addr := s.Addr().String()
+
+	b.SetBytes(videoSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(b, err)
+		_, err = conn.Write([]byte("GET /video HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+		require.NoError(b, err)
+		n, err := io.Copy(io.Discard, conn)
+		require.NoError(b, err)
+		conn.Close()
+		if n < videoSize {
+			b.Fatalf("short response: %d bytes", n)
+		}
+	}
+}
+
+func BenchmarkVideo(b *testing.B) {
+	b.Run("sendfile", func(b *testing.B) {
+		benchmarkVideo(b, server.Config{})
+	})
+	b.Run("buffered", func(b *testing.B) {
+		benchmarkVideo(b, server.Config{DisableSendfile: true})
+	})
+}
@@ -0,0 +1,168 @@
+package accesslog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Format int
+
+const (
+	// FormatJSON writes one JSON object per request.
+	FormatJSON Format = iota
+	// FormatCombined writes the Apache Combined Log Format, followed by
+	// the quoted request ID and the duration in milliseconds.
+	FormatCombined
+)
+
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "json":
+		return FormatJSON, nil
+	case "combined":
+		return FormatCombined, nil
+	default:
+		return 0, fmt.Errorf("unknown access log format: %q", name)
+	}
+}
+
+// Entry describes a served request.
+type Entry struct {
+	// Time is when the request started.
+	Time       time.Time
+	RemoteAddr string
+	Method     string
+	Target     string
+	Proto      string
+	Status     int
+	// Bytes is the size of the response body as sent.
+	Bytes     int64
+	Duration  time.Duration
+	UserAgent string
+	Referer   string
+	RequestID string
+}
+
+// Logger writes access log entries through log/slog.
+type Logger struct {
+	logger *slog.Logger
+}
+
+func New(w io.Writer, format Format) *Logger {
+	var handler slog.Handler
+	if format == FormatCombined {
+		handler = &combinedHandler{w: w}
+	} else {
+		handler = slog.NewJSONHandler(w, nil)
+	}
+	return &Logger{logger: slog.New(handler)}
+}
+
+func (l *Logger) Log(e Entry) {
+	l.logger.LogAttrs(context.Background(), slog.LevelInfo, "request",
+		slog.Time("start", e.Time),
+		slog.String("remote_addr", e.RemoteAddr),
+		slog.String("method", e.Method),
+		slog.String("target", e.Target),
+		slog.String("proto", e.Proto),
+		slog.Int("status", e.Status),
+		slog.Int64("bytes", e.Bytes),
+		slog.Float64("duration_ms", float64(e.Duration.Microseconds())/1000),
+		slog.String("user_agent", e.UserAgent),
+		slog.String("referer", e.Referer),
+		slog.String("request_id", e.RequestID),
+	)
+}
+
+// combinedHandler renders the attributes written by Logger.Log as a
+// Combined Log Format line.
+type combinedHandler struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (h *combinedHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *combinedHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := map[string]slog.Value{}
+	r.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value
+		return true
+	})
+	str := func(key string) string {
+		if v, ok := attrs[key]; ok {
+			return v.String()
+		}
+		return ""
+	}
+
+	host := str("remote_addr")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	bytes := "-"
+	if v, ok := attrs["bytes"]; ok && v.Int64() > 0 {
+		bytes = strconv.FormatInt(v.Int64(), 10)
+	}
+	line := fmt.Sprintf("%s - - [%s] %s %s %s %s %s %s %s\n",
+		orDash(host),
+		attrs["start"].Time().Format("02/Jan/2006:15:04:05 -0700"),
+		quote(str("method")+" "+str("target")+" "+str("proto")),
+		str("status"),
+		bytes,
+		quote(orDash(str("referer"))),
+		quote(orDash(str("user_agent"))),
+		quote(orDash(str("request_id"))),
+		str("duration_ms"),
+	)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line)
+	return err
+}
+
+func (h *combinedHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *combinedHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// quote wraps s in double quotes, escaping quotes, backslashes and
+// control characters so a client can't forge log lines.
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
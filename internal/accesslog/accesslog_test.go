@@ -0,0 +1,124 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEntry() Entry {
+	return Entry{
+		Time:       time.Date(2024, time.March, 5, 7, 8, 9, 0, time.UTC),
+		RemoteAddr: "192.0.2.1:51234",
+		Method:     "GET",
+		Target:     "/index.html?q=1",
+		Proto:      "HTTP/1.1",
+		Status:     200,
+		Bytes:      2326,
+		Duration:   1500 * time.Microsecond,
+		UserAgent:  "curl/8.0",
+		Referer:    "http://example.com/",
+		RequestID:  "abc123",
+	}
+}
+
+func TestFormats(t *testing.T) {
+	// Test: JSON entries carry every field
+	var buf bytes.Buffer
+	New(&buf, FormatJSON).Log(testEntry())
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &fields))
+	assert.Equal(t, "request", fields["msg"])
+	assert.Equal(t, "192.0.2.1:51234", fields["remote_addr"])
+	assert.Equal(t, "/index.html?q=1", fields["target"])
+	assert.Equal(t, float64(200), fields["status"])
+	assert.Equal(t, float64(2326), fields["bytes"])
+	assert.Equal(t, 1.5, fields["duration_ms"])
+	assert.Equal(t, "curl/8.0", fields["user_agent"])
+	assert.Equal(t, "abc123", fields["request_id"])
+
+	// Test: Combined Log Format
+	buf.Reset()
+	New(&buf, FormatCombined).Log(testEntry())
+	assert.Equal(t, `192.0.2.1 - - [05/Mar/2024:07:08:09 +0000] "GET /index.html?q=1 HTTP/1.1" 200 2326 `+
+		`"http://example.com/" "curl/8.0" "abc123" 1.5`+"\n", buf.String())
+
+	// Test: Empty fields become dashes and quotes are escaped
+	buf.Reset()
+	e := testEntry()
+	e.Bytes, e.Referer, e.UserAgent = 0, "", "evil\" \n\"agent"
+	New(&buf, FormatCombined).Log(e)
+	assert.Contains(t, buf.String(), ` 200 - "-" "evil\" \x0a\"agent" `)
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+
+	// Test: Format names
+	format, err := ParseFormat("Combined")
+	require.NoError(t, err)
+	assert.Equal(t, FormatCombined, format)
+	_, err = ParseFormat("xml")
+	assert.Error(t, err)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Test: Writes stay in one file until it would pass the limit
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	read := func(name string) string {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+	assert.Equal(t, "four\nfive\n", read(path))
+	assert.Equal(t, "three\n", read(path+".1"))
+	assert.Equal(t, "one\ntwo\n", read(path+".2"))
+
+	// Test: Only MaxBackups old files are kept
+	_, err = f.Write([]byte("six, too long\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "six, too long\n", read(path))
+	assert.Equal(t, "four\nfive\n", read(path+".1"))
+	assert.Equal(t, "three\n", read(path+".2"))
+	assert.NoFileExists(t, path+".3")
+
+	// Test: Reopening appends to the current file
+	require.NoError(t, f.Close())
+	f, err = OpenRotatingFile(path, 100, 2)
+	require.NoError(t, err)
+	f.Write([]byte("seven\n"))
+	assert.Equal(t, "six, too long\nseven\n", read(path))
+	require.NoError(t, f.Close())
+
+	// Test: A failed rotation keeps writing to the current file
+	f, err = OpenRotatingFile(path, 10, 1)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, os.Remove(path+".1"))
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocked"), 0o755))
+	n, err := f.Write([]byte("eight\n"))
+	assert.Error(t, err)
+	assert.Equal(t, 6, n)
+	assert.Equal(t, "six, too long\nseven\neight\n", read(path))
+
+	// Test: Rotation is retried on the next write
+	require.NoError(t, os.RemoveAll(path+".1"))
+	_, err = f.Write([]byte("nine\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "nine\n", read(path))
+	assert.Equal(t, "six, too long\nseven\neight\n", read(path+".1"))
+}
@@ -0,0 +1,101 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile appends to a file and rotates it once a write would make
+// it grow past maxSize. The previous file becomes path.1, path.1 becomes
+// path.2 and so on; only maxBackups old files are kept.
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	file, size, err := f.open(os.O_APPEND)
+	if err != nil {
+		return nil, err
+	}
+	f.file, f.size = file, size
+	return f, nil
+}
+
+func (f *RotatingFile) open(mode int) (*os.File, int64, error) {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|mode, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// Write writes p in full to one file, so entries are never split. If the
+// file can't be rotated, p still goes to the current file along with the
+// error, and rotating is tried again on the next write.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	var rotateErr error
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		rotateErr = f.rotate()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, rotateErr
+}
+
+// rotate moves the backups along and opens a new file. The current file
+// stays open until then, so that a failure leaves f writing to it.
+func (f *RotatingFile) rotate() error {
+	if f.maxBackups == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for i := f.maxBackups; i > 0; i-- {
+		from := f.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", f.path, i-1)
+		}
+		err := os.Rename(from, fmt.Sprintf("%s.%d", f.path, i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	file, size, err := f.open(os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	old := f.file
+	f.file, f.size = file, size
+	return old.Close()
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
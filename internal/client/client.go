@@ -0,0 +1,295 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+)
+
+const (
+	defaultDialTimeout    = 10 * time.Second
+	defaultIdleTimeout    = 90 * time.Second
+	defaultMaxIdlePerHost = 2
+	defaultMaxRedirects   = 10
+)
+
+var ErrTooManyRedirects = errors.New("stopped after too many redirects")
+
+type Response struct {
+	*response.Response
+	// Request is the request that produced the response, the last one
+	// when redirects were followed.
+	Request *Request
+}
+
+type Request struct {
+	Method  string
+	URL     *url.URL
+	Headers headers.Headers
+	Body    []byte
+}
+
+func NewRequest(method, rawURL string, body []byte) (*Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in %q", rawURL)
+	}
+	return &Request{
+		Method:  method,
+		URL:     u,
+		Headers: headers.NewHeaders(),
+		Body:    body,
+	}, nil
+}
+
+// write serializes the request in origin-form.
+func (r *Request) write(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", r.Method, r.URL.RequestURI())
+	if _, ok := r.Headers.Get("Host"); !ok {
+		fmt.Fprintf(&b, "host: %s\r\n", r.URL.Host)
+	}
+	for key, value := range r.Headers {
+		if key == "content-length" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+	}
+	if len(r.Body) > 0 || r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH" {
+		fmt.Fprintf(&b, "content-length: %d\r\n", len(r.Body))
+	}
+	b.WriteString("\r\n")
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return err
+	}
+	if len(r.Body) > 0 {
+		_, err := w.Write(r.Body)
+		return err
+	}
+	return nil
+}
+
+type Client struct {
+	// Timeout limits a whole exchange, redirects included. No limit if zero.
+	Timeout time.Duration
+	// DialTimeout limits opening a connection, 10s if zero.
+	DialTimeout time.Duration
+	// IdleTimeout is how long an unused connection stays in the pool,
+	// 90s if zero.
+	IdleTimeout time.Duration
+	// MaxIdlePerHost caps pooled connections per host, 2 if zero.
+	MaxIdlePerHost int
+	// MaxRedirects is how many redirects are followed, 10 if zero.
+	// Redirect responses are returned as is if negative.
+	MaxRedirects int
+	// TLSConfig is used for https URLs.
+	TLSConfig *tls.Config
+
+	pool pool
+}
+
+func (c *Client) Get(rawURL string) (*Response, error) {
+	req, err := NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+func (c *Client) Post(rawURL, contentType string, body []byte) (*Response, error) {
+	req, err := NewRequest("POST", rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Headers.Set("Content-Type", contentType)
+	return c.Do(req)
+}
+
+// Do sends req and follows redirects according to the config.
+func (c *Client) Do(req *Request) (*Response, error) {
+	var deadline time.Time
+	if c.Timeout > 0 {
+		deadline = time.Now().Add(c.Timeout)
+	}
+	maxRedirects := c.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = defaultMaxRedirects
+	}
+
+	for redirects := 0; ; redirects++ {
+		resp, err := c.roundTrip(req, deadline)
+		if err != nil {
+			return nil, err
+		}
+		next, ok := redirect(req, resp.Response)
+		if !ok || maxRedirects < 0 {
+			return resp, nil
+		}
+		if redirects >= maxRedirects {
+			return nil, ErrTooManyRedirects
+		}
+		req = next
+	}
+}
+
+// redirect builds the request that follows a 3xx response.
+func redirect(req *Request, resp *response.Response) (*Request, bool) {
+	switch resp.StatusCode {
+	case response.MovedPermanently, response.Found, response.SeeOther,
+		response.TemporaryRedirect, response.PermanentRedirect:
+	default:
+		return nil, false
+	}
+	location, ok := resp.Headers.Get("Location")
+	if !ok {
+		return nil, false
+	}
+	target, err := req.URL.Parse(location)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+		return nil, false
+	}
+
+	next := &Request{Method: req.Method, URL: target, Headers: headers.NewHeaders(), Body: req.Body}
+	for key, value := range req.Headers {
+		next.Headers.Set(key, value)
+	}
+	next.Headers.Delete("Host")
+	if target.Host != req.URL.Host {
+		next.Headers.Delete("Authorization")
+		next.Headers.Delete("Cookie")
+	}
+
+	// 307 and 308 repeat the request as is; the others turn it into a
+	// GET without body, as browsers do.
+	if resp.StatusCode != response.TemporaryRedirect && resp.StatusCode != response.PermanentRedirect {
+		if next.Method != "HEAD" {
+			next.Method = "GET"
+		}
+		next.Body = nil
+		next.Headers.Delete("Content-Type")
+	}
+	return next, true
+}
+
+func (c *Client) roundTrip(req *Request, deadline time.Time) (*Response, error) {
+	key := req.URL.Scheme + "://" + hostPort(req.URL)
+	for {
+		pc, reused, err := c.conn(key, req.URL, deadline)
+		if err != nil {
+			return nil, err
+		}
+		pc.conn.SetDeadline(deadline)
+
+		resp, retry, err := pc.exchange(req)
+		if err != nil {
+			pc.conn.Close()
+			// A pooled connection the server closed in the meantime fails
+			// before any response byte; try again on a fresh one if that
+			// can't run the request twice.
+			if reused && retry {
+				continue
+			}
+			return nil, err
+		}
+
+		if keepAlive(req, resp.Response) {
+			pc.conn.SetDeadline(time.Time{})
+			c.pool.put(key, pc, c.maxIdlePerHost())
+		} else {
+			pc.conn.Close()
+		}
+		return resp, nil
+	}
+}
+
+func (c *Client) conn(key string, u *url.URL, deadline time.Time) (*persistConn, bool, error) {
+	if pc := c.pool.get(key, c.idleTimeout()); pc != nil {
+		return pc, true, nil
+	}
+
+	dialTimeout := c.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout, Deadline: deadline}
+	var conn net.Conn
+	var err error
+	if u.Scheme == "https" {
+		config := c.TLSConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostPort(u), config)
+	} else {
+		conn, err = dialer.Dial("tcp", hostPort(u))
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return newPersistConn(conn), false, nil
+}
+
+// CloseIdleConnections closes the pooled connections.
+func (c *Client) CloseIdleConnections() {
+	c.pool.closeAll()
+}
+
+func (c *Client) idleTimeout() time.Duration {
+	if c.IdleTimeout == 0 {
+		return defaultIdleTimeout
+	}
+	return c.IdleTimeout
+}
+
+func (c *Client) maxIdlePerHost() int {
+	if c.MaxIdlePerHost == 0 {
+		return defaultMaxIdlePerHost
+	}
+	return c.MaxIdlePerHost
+}
+
+// keepAlive reports whether the connection can carry another request.
+func keepAlive(req *Request, resp *response.Response) bool {
+	if resp.StatusCode == response.SwitchingProtocols {
+		return false
+	}
+	if resp.CloseDelimited {
+		return false
+	}
+	for _, h := range []headers.Headers{req.Headers, resp.Headers} {
+		if connection, ok := h.Get("Connection"); ok && headers.HasToken(connection, "close") {
+			return false
+		}
+	}
+	if resp.HttpVersion == "1.0" {
+		connection, _ := resp.Headers.Get("Connection")
+		return headers.HasToken(connection, "keep-alive")
+	}
+	return true
+}
+
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), strconv.Itoa(80))
+}
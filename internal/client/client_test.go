@@ -0,0 +1,223 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/ar3ty/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startRaw serves every connection with handle, which answers requests
+// read from the connection until it returns false. It reports how many
+// connections were accepted.
+func startRaw(t *testing.T, handle func(conn net.Conn, req *request.Request) bool) (string, *atomic.Int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	accepted := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				reader := request.NewReader(conn)
+				for {
+					req, err := reader.ReadRequest()
+					if err != nil || !handle(conn, req) {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return "http://" + listener.Addr().String(), accepted
+}
+
+func TestClient(t *testing.T) {
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		message := []byte(fmt.Sprintf("%s %s body=%s", req.RequestLine.Method, req.RequestLine.RequestTarget, req.Body))
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(message)))
+		w.WriteBody(message)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	base := "http://" + s.Addr().String()
+	c := &Client{}
+
+	// Test: GET against the server
+	resp, err := c.Get(base + "/hello?x=1")
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, resp.StatusCode)
+	assert.Equal(t, "GET /hello?x=1 body=", string(resp.Body))
+
+	// Test: POST sends the body with its length
+	resp, err = c.Post(base+"/submit", "text/plain", []byte("payload"))
+	require.NoError(t, err)
+	assert.Equal(t, "POST /submit body=payload", string(resp.Body))
+
+	// Test: Unsupported schemes
+	_, err = c.Get("ftp://example.com/")
+	assert.Error(t, err)
+}
+
+func TestKeepAlive(t *testing.T) {
+	addr, accepted := startRaw(t, func(conn net.Conn, req *request.Request) bool {
+		if req.RequestLine.RequestTarget == "/close" {
+			fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 2\r\n\r\nok")
+			return false
+		}
+		fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n")
+		return true
+	})
+	c := &Client{}
+
+	// Test: Sequential requests share one connection
+	for i := 0; i < 3; i++ {
+		resp, err := c.Get(addr + "/")
+		require.NoError(t, err)
+		assert.Equal(t, "ok", string(resp.Body))
+	}
+	assert.Equal(t, int32(1), accepted.Load())
+
+	// Test: Connection: close is honored
+	_, err := c.Get(addr + "/close")
+	require.NoError(t, err)
+	_, err = c.Get(addr + "/")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), accepted.Load())
+
+	// Test: Idle connections past the timeout are not reused
+	c = &Client{IdleTimeout: 10 * time.Millisecond}
+	_, err = c.Get(addr + "/")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	_, err = c.Get(addr + "/")
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), accepted.Load())
+	c.CloseIdleConnections()
+}
+
+func TestStaleConnection(t *testing.T) {
+	// The server keeps the connection open in its response but closes it
+	// right after, as servers do when their idle timeout hits.
+	addr, accepted := startRaw(t, func(conn net.Conn, req *request.Request) bool {
+		fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+		return false
+	})
+	c := &Client{}
+
+	// Test: A pooled connection closed by the server is retried on a new one
+	_, err := c.Get(addr + "/")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	resp, err := c.Get(addr + "/")
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(resp.Body))
+	assert.Equal(t, int32(2), accepted.Load())
+}
+
+func TestUnansweredRequest(t *testing.T) {
+	// The server acts on requests other than GET, then drops the
+	// connection without answering.
+	var posts atomic.Int32
+	addr, accepted := startRaw(t, func(conn net.Conn, req *request.Request) bool {
+		if req.RequestLine.Method == "GET" {
+			fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			return true
+		}
+		posts.Add(1)
+		return false
+	})
+	c := &Client{}
+
+	// Test: A POST that reached the server on a pooled connection isn't sent again
+	_, err := c.Get(addr + "/")
+	require.NoError(t, err)
+	_, err = c.Post(addr+"/submit", "text/plain", []byte("once"))
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), posts.Load())
+	assert.Equal(t, int32(1), accepted.Load())
+}
+
+func TestTimeout(t *testing.T) {
+	addr, _ := startRaw(t, func(conn net.Conn, req *request.Request) bool {
+		time.Sleep(200 * time.Millisecond)
+		return false
+	})
+
+	// Test: Timeout bounds a request the server doesn't answer
+	c := &Client{Timeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, err := c.Get(addr + "/")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestRedirects(t *testing.T) {
+	var seen []string
+	addr, _ := startRaw(t, func(conn net.Conn, req *request.Request) bool {
+		line := req.RequestLine
+		seen = append(seen, fmt.Sprintf("%s %s %s", line.Method, line.RequestTarget, req.Body))
+		switch {
+		case line.RequestTarget == "/found":
+			fmt.Fprint(conn, "HTTP/1.1 302 Found\r\nLocation: /done\r\nContent-Length: 0\r\n\r\n")
+		case line.RequestTarget == "/temporary":
+			fmt.Fprint(conn, "HTTP/1.1 307 Temporary Redirect\r\nLocation: done\r\nContent-Length: 0\r\n\r\n")
+		case line.RequestTarget == "/loop":
+			fmt.Fprint(conn, "HTTP/1.1 301 Moved Permanently\r\nLocation: /loop\r\nContent-Length: 0\r\n\r\n")
+		default:
+			fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\ndone")
+		}
+		return true
+	})
+	c := &Client{}
+
+	// Test: 302 turns a POST into a GET without body
+	resp, err := c.Post(addr+"/found", "text/plain", []byte("data"))
+	require.NoError(t, err)
+	assert.Equal(t, "done", string(resp.Body))
+	assert.Equal(t, "/done", resp.Request.URL.Path)
+	assert.Equal(t, []string{"POST /found data", "GET /done "}, seen)
+
+	// Test: 307 repeats the method and body
+	seen = nil
+	_, err = c.Post(addr+"/temporary", "text/plain", []byte("data"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"POST /temporary data", "POST /done data"}, seen)
+
+	// Test: Redirect loops stop at the limit
+	seen = nil
+	_, err = (&Client{MaxRedirects: 3}).Get(addr + "/loop")
+	assert.ErrorIs(t, err, ErrTooManyRedirects)
+	assert.Len(t, seen, 4)
+
+	// Test: Negative MaxRedirects returns the redirect itself
+	resp, err = (&Client{MaxRedirects: -1}).Get(addr + "/found")
+	require.NoError(t, err)
+	assert.Equal(t, response.Found, resp.StatusCode)
+
+	// Test: Credentials are dropped when the host changes
+	req, err := NewRequest("GET", "http://a.example/found", nil)
+	require.NoError(t, err)
+	req.Headers.Set("Authorization", "secret")
+	h := headers.NewHeaders()
+	h.Set("Location", "http://b.example/")
+	next, ok := redirect(req, &response.Response{StatusCode: response.Found, Headers: h})
+	require.True(t, ok)
+	_, has := next.Headers.Get("Authorization")
+	assert.False(t, has)
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/response"
+)
+
+type persistConn struct {
+	conn     net.Conn
+	reader   *response.Reader
+	read     int
+	idleFrom time.Time
+}
+
+func newPersistConn(conn net.Conn) *persistConn {
+	pc := &persistConn{conn: conn}
+	pc.reader = response.NewReader(readCounter{pc})
+	return pc
+}
+
+// exchange sends req and reads its response. When it fails, the returned
+// flag reports whether req can be sent again: no byte of the response
+// arrived, and the request either wasn't written in full or is idempotent.
+// A server may have acted on a request it never answered.
+func (pc *persistConn) exchange(req *Request) (*Response, bool, error) {
+	pc.read = len(pc.reader.Buffered())
+	if err := req.write(pc.conn); err != nil {
+		return nil, true, err
+	}
+	resp, err := pc.reader.ReadResponse(req.Method)
+	if err != nil {
+		return nil, pc.read == 0 && idempotent(req.Method), err
+	}
+	return &Response{Response: resp, Request: req}, false, nil
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+type readCounter struct {
+	pc *persistConn
+}
+
+func (r readCounter) Read(p []byte) (int, error) {
+	n, err := r.pc.conn.Read(p)
+	r.pc.read += n
+	return n, err
+}
+
+// pool keeps idle connections per scheme and host, most recent last.
+type pool struct {
+	mu   sync.Mutex
+	idle map[string][]*persistConn
+}
+
+func (p *pool) get(key string, idleTimeout time.Duration) *persistConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[key]
+	for len(conns) > 0 {
+		pc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(pc.idleFrom) < idleTimeout {
+			p.idle[key] = conns
+			return pc
+		}
+		pc.conn.Close()
+	}
+	delete(p.idle, key)
+	return nil
+}
+
+func (p *pool) put(key string, pc *persistConn, maxIdle int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[key]) >= maxIdle {
+		pc.conn.Close()
+		return
+	}
+	if p.idle == nil {
+		p.idle = make(map[string][]*persistConn)
+	}
+	pc.idleFrom = time.Now()
+	p.idle[key] = append(p.idle[key], pc)
+}
+
+func (p *pool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conns := range p.idle {
+		for _, pc := range conns {
+			pc.conn.Close()
+		}
+	}
+	p.idle = nil
+}
@@ -0,0 +1,194 @@
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/ar3ty/httpfromtcp/internal/server"
+)
+
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+)
+
+const defaultMinSize = 1024
+
+var defaultContentTypes = []string{
+	"text/html",
+	"text/plain",
+	"text/css",
+	"text/csv",
+	"text/xml",
+	"text/javascript",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+type Config struct {
+	// MinSize is the smallest Content-Length worth compressing. Bodies of
+	// unknown length are always compressed. Defaults to 1024.
+	MinSize int
+	// Level is passed to the gzip and zlib writers, gzip.DefaultCompression if zero.
+	Level int
+	// ContentTypes lists the media types eligible for compression.
+	ContentTypes []string
+}
+
+// Handler compresses responses of next with the best coding the client
+// accepts. Media types not listed in the config, like video/mp4, and
+// responses with Cache-Control: no-transform are sent as is. Compressed
+// responses have their ETag weakened. Responses to HEAD get the headers of
+// the compressed GET response.
+func Handler(next server.Handler, config Config) server.Handler {
+	if config.MinSize == 0 {
+		config.MinSize = defaultMinSize
+	}
+	if config.Level == 0 {
+		config.Level = gzip.DefaultCompression
+	}
+	if config.ContentTypes == nil {
+		config.ContentTypes = defaultContentTypes
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		accept, _ := req.Headers.Get("Accept-Encoding")
+		head := req.RequestLine.Method == "HEAD"
+		w.AddBodyFilter(func(code response.StatusCode, h headers.Headers, body io.Writer) io.Writer {
+			return config.filter(accept, head, code, h, body)
+		})
+		next(w, req)
+	}
+}
+
+func (c Config) filter(accept string, head bool, code response.StatusCode, h headers.Headers, body io.Writer) io.Writer {
+	if code < 200 || code == 204 || code == 206 || code == 304 {
+		return body
+	}
+	if _, ok := h.Get("Content-Encoding"); ok {
+		return body
+	}
+	if _, ok := h.Get("Content-Range"); ok {
+		return body
+	}
+	if cacheControl, ok := h.Get("Cache-Control"); ok && headers.HasToken(cacheControl, "no-transform") {
+		return body
+	}
+	contentType, _ := h.Get("Content-Type")
+	if !c.eligible(contentType) {
+		return body
+	}
+	h.Set("Vary", "Accept-Encoding")
+
+	if val, ok := h.Get("Content-Length"); ok {
+		length, err := strconv.Atoi(val)
+		if err == nil && length < c.MinSize {
+			return body
+		}
+	}
+
+	encoding := Negotiate(accept)
+	if encoding == "" {
+		return body
+	}
+
+	var zw io.Writer = body
+	switch {
+	case head:
+		// No body is sent, but the headers must be those a GET would get.
+	case encoding == encodingGzip:
+		gw, err := gzip.NewWriterLevel(body, c.Level)
+		if err != nil {
+			return body
+		}
+		zw = gw
+	case encoding == encodingDeflate:
+		// The "deflate" content coding is the zlib format (RFC 9110, 8.4.1.2).
+		fw, err := zlib.NewWriterLevel(body, c.Level)
+		if err != nil {
+			return body
+		}
+		zw = fw
+	}
+
+	h.Delete("Content-Length")
+	h.Replace("Content-Encoding", encoding)
+	if etag, ok := h.Get("ETag"); ok && strings.HasPrefix(etag, `"`) {
+		// The compressed bytes differ from the ones the tag was made for,
+		// but they still represent the same content.
+		h.Replace("ETag", "W/"+etag)
+	}
+	if te, ok := h.Get("Transfer-Encoding"); !ok || !strings.Contains(strings.ToLower(te), "chunked") {
+		h.Set("Transfer-Encoding", "chunked")
+	}
+	return zw
+}
+
+func (c Config) eligible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	for _, t := range c.ContentTypes {
+		if strings.EqualFold(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate picks the supported content coding with the highest q-value in
+// an Accept-Encoding header, preferring gzip on ties. It returns an empty
+// string when the identity coding should be used.
+func Negotiate(accept string) string {
+	weights := map[string]float64{}
+	wildcard := -1.0
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, val, ok := strings.Cut(param, "=")
+			if !ok || strings.ToLower(strings.TrimSpace(key)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				parsed = 0
+			}
+			q = parsed
+		}
+		if coding == "*" {
+			wildcard = q
+			continue
+		}
+		weights[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range []string{encodingGzip, encodingDeflate} {
+		q, ok := weights[coding]
+		if !ok {
+			if wildcard < 0 {
+				continue
+			}
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
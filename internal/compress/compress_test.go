@@ -0,0 +1,183 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serve(t *testing.T, handler func(w *response.Writer, req *request.Request), method, acceptEncoding string) *http.Response {
+	t.Helper()
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: "/", HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	}
+	if acceptEncoding != "" {
+		req.Headers.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetRequestMethod(method)
+	Handler(handler, Config{})(w, req)
+	require.NoError(t, w.Finish())
+
+	resp, err := http.ReadResponse(bufio.NewReader(buf), &http.Request{Method: method})
+	require.NoError(t, err)
+	return resp
+}
+
+func fixed(contentType string, body []byte) func(w *response.Writer, req *request.Request) {
+	return func(w *response.Writer, _ *request.Request) {
+		w.WriteStatusLine(response.OK)
+		h := response.GetDefaultHeaders(len(body))
+		h.Replace("Content-Type", contentType)
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	// Test: Single coding
+	assert.Equal(t, "gzip", Negotiate("gzip"))
+
+	// Test: Gzip preferred on ties
+	assert.Equal(t, "gzip", Negotiate("deflate, gzip"))
+
+	// Test: Highest q-value wins
+	assert.Equal(t, "deflate", Negotiate("gzip;q=0.5, deflate;q=0.8"))
+
+	// Test: q=0 disables a coding
+	assert.Equal(t, "deflate", Negotiate("gzip;q=0, deflate"))
+
+	// Test: Wildcard covers unlisted codings
+	assert.Equal(t, "deflate", Negotiate("gzip;q=0, *;q=0.1"))
+
+	// Test: Unsupported and empty headers
+	assert.Equal(t, "", Negotiate("br, identity"))
+	assert.Equal(t, "", Negotiate(""))
+	assert.Equal(t, "", Negotiate("*;q=0"))
+
+	// Test: Case and whitespace are ignored
+	assert.Equal(t, "gzip", Negotiate("  GZIP ; Q=0.9 "))
+}
+
+func TestHandler(t *testing.T) {
+	page := []byte("<html><body>" + strings.Repeat("<p>Your request was an absolute banger.</p>", 100) + "</body></html>")
+
+	// Test: Gzip compressed HTML
+	resp := serve(t, fixed("text/html", page), "GET", "gzip, deflate")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Empty(t, resp.Header.Get("Content-Length"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	gr, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gr)
+	require.NoError(t, err)
+	assert.Equal(t, page, body)
+
+	// Test: Deflate compressed JSON
+	json := []byte(`{"items":[` + strings.Repeat(`{"name":"coffee"},`, 100) + `{}]}`)
+	resp = serve(t, fixed("application/json; charset=utf-8", json), "GET", "deflate")
+	assert.Equal(t, "deflate", resp.Header.Get("Content-Encoding"))
+	zr, err := zlib.NewReader(resp.Body)
+	require.NoError(t, err)
+	body, err = io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, json, body)
+
+	// Test: Small bodies are not compressed
+	resp = serve(t, fixed("text/html", []byte("<p>hi</p>")), "GET", "gzip")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "<p>hi</p>", string(body))
+
+	// Test: Already compressed media is skipped
+	video := bytes.Repeat([]byte{0, 0, 0, 1}, 1000)
+	resp = serve(t, fixed("video/mp4", video), "GET", "gzip")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Empty(t, resp.Header.Get("Vary"))
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, video, body)
+
+	// Test: Client without Accept-Encoding
+	resp = serve(t, fixed("text/html", page), "GET", "")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, int64(len(page)), resp.ContentLength)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, page, body)
+
+	// Test: Chunked handler output is compressed as one stream
+	resp = serve(t, func(w *response.Writer, _ *request.Request) {
+		w.WriteStatusLine(response.OK)
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Replace("Transfer-Encoding", "chunked")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("hello, "))
+		w.WriteChunkedBody([]byte("world"))
+		w.WriteChunkedBodyDone()
+		w.WriteTrailers(nil)
+	}, "GET", "gzip")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	gr, err = gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	body, err = io.ReadAll(gr)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", string(body))
+
+	// Test: Compressed responses get a weak ETag
+	tagged := func(cacheControl string) func(w *response.Writer, _ *request.Request) {
+		return func(w *response.Writer, _ *request.Request) {
+			w.WriteStatusLine(response.OK)
+			h := response.GetDefaultHeaders(len(page))
+			h.Replace("Content-Type", "text/html")
+			h.Set("ETag", `"v1"`)
+			if cacheControl != "" {
+				h.Set("Cache-Control", cacheControl)
+			}
+			w.WriteHeaders(h)
+			w.WriteBody(page)
+		}
+	}
+	resp = serve(t, tagged(""), "GET", "gzip")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, `W/"v1"`, resp.Header.Get("ETag"))
+	resp = serve(t, tagged(""), "GET", "")
+	assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+
+	// Test: HEAD gets the headers of the compressed GET response
+	get := serve(t, tagged(""), "GET", "gzip")
+	resp = serve(t, tagged(""), "HEAD", "gzip")
+	for _, key := range []string{"Content-Encoding", "Content-Length", "ETag", "Vary"} {
+		assert.Equal(t, get.Header.Get(key), resp.Header.Get(key), key)
+	}
+	assert.Equal(t, get.TransferEncoding, resp.TransferEncoding)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Empty(t, body)
+
+	// Test: Cache-Control: no-transform is respected
+	resp = serve(t, tagged("public, no-transform"), "GET", "gzip")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, page, body)
+}
@@ -0,0 +1,214 @@
+package debug
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+)
+
+const (
+	defaultPrefix         = "/debug"
+	defaultProfileSeconds = 30
+	maxProfileSeconds     = 300
+)
+
+type Config struct {
+	// Prefix is the path the endpoints are served under, "/debug" if
+	// empty.
+	Prefix string
+	// Token, when not empty, must be sent as a bearer token in the
+	// Authorization header. Without it only loopback clients are served.
+	Token string
+}
+
+func (c Config) prefix() string {
+	if c.Prefix == "" {
+		return defaultPrefix
+	}
+	return strings.TrimSuffix(c.Prefix, "/")
+}
+
+// Matches reports whether target is one of the endpoints.
+func (c Config) Matches(target string) bool {
+	path, _, _ := strings.Cut(target, "?")
+	prefix := c.prefix()
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// Conn describes an open client connection.
+type Conn struct {
+	RemoteAddr string
+	Proto      string
+	// State is what the connection is doing, like "idle", "reading" or
+	// "active".
+	State string
+	Since time.Time
+}
+
+// Source is what the endpoints inspect, usually a server.
+type Source interface {
+	Conns() []Conn
+	// Settings returns the configuration to show; it is encoded as JSON.
+	Settings() any
+}
+
+// Handler serves, under the prefix:
+//
+//	/              an index of the endpoints
+//	/conns         the open connections as JSON
+//	/config        the settings of src as JSON
+//	/pprof/profile a CPU profile over ?seconds=, 30 by default
+//	/pprof/<name>  a runtime/pprof profile like goroutine or heap, as
+//	               text with ?debug=1 or 2
+func Handler(src Source, config Config) func(w *response.Writer, req *request.Request) {
+	prefix := config.prefix()
+	return func(w *response.Writer, req *request.Request) {
+		if code, ok := authorize(config, req); !ok {
+			if code == response.Unauthorized {
+				w.SetDefaultHeader("WWW-Authenticate", "Bearer")
+			}
+			response.WriteError(w, code, nil)
+			return
+		}
+		if req.RequestLine.Method != "GET" {
+			w.SetDefaultHeader("Allow", "GET")
+			response.WriteError(w, response.MethodNotAllowed, nil)
+			return
+		}
+		path, rawQuery, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			response.WriteError(w, response.BadRequest, nil)
+			return
+		}
+
+		switch path = strings.TrimPrefix(path, prefix); {
+		case path == "" || path == "/":
+			writeIndex(w, prefix)
+		case path == "/conns":
+			writeConns(w, src.Conns())
+		case path == "/config":
+			writeJSON(w, src.Settings())
+		case path == "/pprof/profile":
+			writeCPUProfile(w, query)
+		case strings.HasPrefix(path, "/pprof/"):
+			writeProfile(w, strings.TrimPrefix(path, "/pprof/"), query)
+		default:
+			response.WriteError(w, response.NotFound, nil)
+		}
+	}
+}
+
+func authorize(config Config, req *request.Request) (response.StatusCode, bool) {
+	if config.Token != "" {
+		auth, _ := req.Headers.Get("Authorization")
+		token, ok := strings.CutPrefix(auth, "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(config.Token)) == 1 {
+			return 0, true
+		}
+		return response.Unauthorized, false
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if ip := net.ParseIP(host); err == nil && ip != nil && ip.IsLoopback() {
+		return 0, true
+	}
+	return response.Forbidden, false
+}
+
+func writeIndex(w *response.Writer, prefix string) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s/conns\n%s/config\n%s/pprof/profile?seconds=%d\n", prefix, prefix, prefix, defaultProfileSeconds)
+	for _, p := range pprof.Profiles() {
+		fmt.Fprintf(&b, "%s/pprof/%s?debug=1\n", prefix, p.Name())
+	}
+	writeBody(w, response.OK, "text/plain; charset=utf-8", b.Bytes())
+}
+
+func writeConns(w *response.Writer, conns []Conn) {
+	type conn struct {
+		RemoteAddr string    `json:"remote_addr"`
+		Proto      string    `json:"proto"`
+		State      string    `json:"state"`
+		Since      time.Time `json:"since"`
+		AgeSeconds float64   `json:"age_seconds"`
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Since.Before(conns[j].Since) })
+	now := time.Now()
+	out := make([]conn, 0, len(conns))
+	for _, c := range conns {
+		out = append(out, conn{c.RemoteAddr, c.Proto, c.State, c.Since, now.Sub(c.Since).Seconds()})
+	}
+	writeJSON(w, out)
+}
+
+func writeCPUProfile(w *response.Writer, query url.Values) {
+	seconds := defaultProfileSeconds
+	if s := query.Get("seconds"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxProfileSeconds {
+			response.WriteError(w, response.BadRequest, nil)
+			return
+		}
+		seconds = n
+	}
+	var b bytes.Buffer
+	if err := pprof.StartCPUProfile(&b); err != nil {
+		// Only one CPU profile can run at a time.
+		response.WriteError(w, response.Conflict, nil)
+		return
+	}
+	time.Sleep(time.Duration(seconds) * time.Second)
+	pprof.StopCPUProfile()
+	writeBody(w, response.OK, "application/octet-stream", b.Bytes())
+}
+
+func writeProfile(w *response.Writer, name string, query url.Values) {
+	p := pprof.Lookup(name)
+	if p == nil {
+		response.WriteError(w, response.NotFound, nil)
+		return
+	}
+	debug, _ := strconv.Atoi(query.Get("debug"))
+	if name == "heap" && query.Get("gc") != "" {
+		runtime.GC()
+	}
+	var b bytes.Buffer
+	if err := p.WriteTo(&b, debug); err != nil {
+		response.WriteError(w, response.InternalServerError, nil)
+		return
+	}
+	contentType := "application/octet-stream"
+	if debug > 0 {
+		contentType = "text/plain; charset=utf-8"
+	}
+	writeBody(w, response.OK, contentType, b.Bytes())
+}
+
+func writeJSON(w *response.Writer, v any) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		response.WriteError(w, response.InternalServerError, nil)
+		return
+	}
+	writeBody(w, response.OK, "application/json", append(body, '\n'))
+}
+
+func writeBody(w *response.Writer, code response.StatusCode, contentType string, body []byte) {
+	h := response.GetDefaultHeaders(len(body))
+	h.Replace("Content-Type", contentType)
+	w.WriteStatusLine(code)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
@@ -0,0 +1,104 @@
+package debug
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type source struct {
+	conns []Conn
+}
+
+func (s source) Conns() []Conn {
+	return s.conns
+}
+
+func (s source) Settings() any {
+	return map[string]string{"name": "test"}
+}
+
+// get runs h for a GET of target from remoteAddr and parses what it
+// wrote. The httptest package can't be used, as it imports the server.
+func get(t *testing.T, h func(*response.Writer, *request.Request), target, remoteAddr string, reqHeaders headers.Headers) *response.Response {
+	t.Helper()
+	if reqHeaders == nil {
+		reqHeaders = headers.NewHeaders()
+	}
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	h(w, &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     reqHeaders,
+		RemoteAddr:  remoteAddr,
+	})
+	resp, err := response.NewReader(&buf).ReadResponse("GET")
+	require.NoError(t, err)
+	return resp
+}
+
+func TestHandler(t *testing.T) {
+	since := time.Now().Add(-time.Minute)
+	src := source{conns: []Conn{
+		{RemoteAddr: "10.0.0.2:4000", Proto: "h2", State: "active", Since: since.Add(time.Second)},
+		{RemoteAddr: "10.0.0.1:4000", Proto: "http/1.1", State: "idle", Since: since},
+	}}
+	h := Handler(src, Config{})
+	local := "127.0.0.1:5000"
+
+	// Test: Only loopback clients are served without a token
+	assert.Equal(t, response.OK, get(t, h, "/debug/", local, nil).StatusCode)
+	assert.Equal(t, response.OK, get(t, h, "/debug", "[::1]:5000", nil).StatusCode)
+	assert.Equal(t, response.Forbidden, get(t, h, "/debug/", "10.0.0.1:5000", nil).StatusCode)
+
+	// Test: Connections are listed oldest first with their age
+	resp := get(t, h, "/debug/conns", local, nil)
+	assert.Equal(t, "application/json", resp.Headers["content-type"])
+	var conns []map[string]any
+	require.NoError(t, json.Unmarshal(resp.Body, &conns))
+	require.Len(t, conns, 2)
+	assert.Equal(t, "10.0.0.1:4000", conns[0]["remote_addr"])
+	assert.Equal(t, "idle", conns[0]["state"])
+	assert.Equal(t, "active", conns[1]["state"])
+	assert.InDelta(t, 60, conns[0]["age_seconds"], 5)
+
+	// Test: Settings
+	resp = get(t, h, "/debug/config", local, nil)
+	assert.JSONEq(t, `{"name": "test"}`, string(resp.Body))
+
+	// Test: Goroutine dumps and profiles
+	resp = get(t, h, "/debug/pprof/goroutine?debug=2", local, nil)
+	assert.Equal(t, response.OK, resp.StatusCode)
+	assert.Contains(t, string(resp.Body), "goroutine ")
+	resp = get(t, h, "/debug/pprof/heap", local, nil)
+	assert.Equal(t, "application/octet-stream", resp.Headers["content-type"])
+	assert.NotEmpty(t, resp.Body)
+	assert.Equal(t, response.NotFound, get(t, h, "/debug/pprof/missing", local, nil).StatusCode)
+	assert.Equal(t, response.BadRequest, get(t, h, "/debug/pprof/profile?seconds=0", local, nil).StatusCode)
+	assert.Equal(t, response.NotFound, get(t, h, "/debug/other", local, nil).StatusCode)
+
+	// Test: A token is required from any address once set
+	h = Handler(src, Config{Prefix: "/_debug/", Token: "secret"})
+	resp = get(t, h, "/_debug/conns", local, nil)
+	assert.Equal(t, response.Unauthorized, resp.StatusCode)
+	assert.Equal(t, "Bearer", resp.Headers["www-authenticate"])
+	auth := headers.NewHeaders()
+	auth.Set("Authorization", "Bearer wrong")
+	assert.Equal(t, response.Unauthorized, get(t, h, "/_debug/conns", local, auth).StatusCode)
+	auth.Replace("Authorization", "Bearer secret")
+	assert.Equal(t, response.OK, get(t, h, "/_debug/conns", "10.0.0.1:5000", auth).StatusCode)
+
+	// Test: Matching targets
+	config := Config{Prefix: "/_debug/"}
+	assert.True(t, config.Matches("/_debug"))
+	assert.True(t, config.Matches("/_debug/pprof/heap?debug=1"))
+	assert.False(t, config.Matches("/_debugger"))
+	assert.True(t, Config{}.Matches("/debug/conns"))
+}
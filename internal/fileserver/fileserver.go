@@ -0,0 +1,293 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/ar3ty/httpfromtcp/internal/server"
+)
+
+const indexFile = "index.html"
+
+type Config struct {
+	// Root is the directory files are served from.
+	Root string
+	// StripPrefix is removed from the request path before it is mapped onto
+	// Root. Paths not below it are not found.
+	StripPrefix string
+	// Listing renders an HTML index for directories without index.html.
+	Listing bool
+}
+
+// Handler serves files below config.Root. Paths are cleaned before use, so
+// requests can't escape the root with ".." segments, nor through symlinks
+// pointing out of it.
+func Handler(config Config) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		if !allowedMethod(w, req) {
+			return
+		}
+
+		urlPath, err := requestPath(req.RequestLine.RequestTarget)
+		if err != nil {
+			response.WriteError(w, response.BadRequest, nil)
+			return
+		}
+		// The prefix has to end at a segment boundary, so "/static" doesn't
+		// serve "/staticfoo".
+		name, ok := strings.CutPrefix(urlPath, strings.TrimSuffix(config.StripPrefix, "/"))
+		if !ok || name != "" && !strings.HasPrefix(name, "/") {
+			response.WriteError(w, response.NotFound, nil)
+			return
+		}
+		name = path.Clean("/" + name)
+		fullPath, err := resolve(config.Root, filepath.Join(config.Root, filepath.FromSlash(name)))
+		if err != nil {
+			response.WriteError(w, statusForError(err), nil)
+			return
+		}
+
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			response.WriteError(w, statusForError(err), nil)
+			return
+		}
+		if !info.IsDir() {
+			if strings.HasSuffix(urlPath, "/") {
+				response.WriteError(w, response.NotFound, nil)
+				return
+			}
+			serveFile(w, req, fullPath)
+			return
+		}
+
+		if !strings.HasSuffix(urlPath, "/") {
+			redirect(w, urlPath+"/")
+			return
+		}
+		index, err := resolve(config.Root, filepath.Join(fullPath, indexFile))
+		if err == nil {
+			serveFile(w, req, index)
+			return
+		}
+		if !config.Listing {
+			response.WriteError(w, response.Forbidden, nil)
+			return
+		}
+		serveListing(w, req, fullPath)
+	}
+}
+
+// ServeFile answers req with the contents of the file at name.
+func ServeFile(w *response.Writer, req *request.Request, name string) {
+	if !allowedMethod(w, req) {
+		return
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		response.WriteError(w, statusForError(err), nil)
+		return
+	}
+	if info.IsDir() {
+		response.WriteError(w, response.Forbidden, nil)
+		return
+	}
+	serveFile(w, req, name)
+}
+
+func serveFile(w *response.Writer, req *request.Request, name string) {
+	f, err := os.Open(name)
+	if err != nil {
+		response.WriteError(w, statusForError(err), nil)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		response.WriteError(w, response.InternalServerError, nil)
+		return
+	}
+	size := info.Size()
+	modTime := info.ModTime().UTC().Truncate(time.Second)
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), size)
+
+	h := headers.NewHeaders()
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", modTime.Format(response.TimeFormat))
+	h.Set("Accept-Ranges", "bytes")
+
+	if status, ok := checkPreconditions(req, etag, modTime); !ok {
+		w.WriteStatusLine(status)
+		if status == response.NotModified {
+			w.WriteHeaders(h)
+			return
+		}
+		h.Set("Content-Length", "0")
+		w.WriteHeaders(h)
+		return
+	}
+
+	contentType, err := detectContentType(f, name)
+	if err != nil {
+		response.WriteError(w, response.InternalServerError, nil)
+		return
+	}
+
+	ranges, err := parseRange(rangeHeader(req, etag, modTime), size)
+	if err != nil {
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		h.Set("Content-Length", "0")
+		w.WriteStatusLine(response.RangeNotSatisfiable)
+		w.WriteHeaders(h)
+		return
+	}
+	if sumLength(ranges) > size {
+		// Overlapping ranges that add up to more than the file are
+		// answered with the whole file instead.
+		ranges = nil
+	}
+
+	head := req.RequestLine.Method == "HEAD"
+	switch len(ranges) {
+	case 0:
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Length", fmt.Sprintf("%d", size))
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		if !head {
+			w.ReadFrom(f)
+		}
+	case 1:
+		ra := ranges[0]
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Range", ra.contentRange(size))
+		h.Set("Content-Length", fmt.Sprintf("%d", ra.length))
+		w.WriteStatusLine(response.PartialContent)
+		w.WriteHeaders(h)
+		if !head {
+			if _, err := f.Seek(ra.start, io.SeekStart); err == nil {
+				io.CopyN(w, f, ra.length)
+			}
+		}
+	default:
+		writeMultipart(w, f, h, ranges, contentType, size, head)
+	}
+}
+
+func allowedMethod(w *response.Writer, req *request.Request) bool {
+	method := req.RequestLine.Method
+	if method == "GET" || method == "HEAD" {
+		return true
+	}
+	w.SetDefaultHeader("Allow", "GET, HEAD")
+	response.WriteError(w, response.MethodNotAllowed, nil)
+	return false
+}
+
+func requestPath(target string) (string, error) {
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(u.Path, "\x00") {
+		return "", fmt.Errorf("invalid path: %q", u.Path)
+	}
+	return u.Path, nil
+}
+
+func detectContentType(f *os.File, name string) (string, error) {
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype, nil
+	}
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+var errOutsideRoot = errors.New("path is outside of the root")
+
+// resolve follows the symlinks in name, which must lead to a file under
+// root: a link pointing out of it is treated as missing.
+func resolve(root, name string) (string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	realName, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(realRoot, realName)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errOutsideRoot
+	}
+	return realName, nil
+}
+
+func statusForError(err error) response.StatusCode {
+	if os.IsNotExist(err) || errors.Is(err, errOutsideRoot) {
+		return response.NotFound
+	}
+	if os.IsPermission(err) {
+		return response.Forbidden
+	}
+	return response.InternalServerError
+}
+
+func redirect(w *response.Writer, location string) {
+	w.WriteStatusLine(response.MovedPermanently)
+	h := response.GetDefaultHeaders(0)
+	h.Set("Location", (&url.URL{Path: location}).EscapedPath())
+	w.WriteHeaders(h)
+}
+
+func serveListing(w *response.Writer, req *request.Request, dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		response.WriteError(w, statusForError(err), nil)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	var sb strings.Builder
+	sb.WriteString("<html><head><title>Index</title></head><body><pre>\n")
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		link := "./" + (&url.URL{Path: name}).EscapedPath()
+		fmt.Fprintf(&sb, "<a href=\"%s\">%s</a>\n", html.EscapeString(link), html.EscapeString(name))
+	}
+	sb.WriteString("</pre></body></html>\n")
+	message := []byte(sb.String())
+
+	w.WriteStatusLine(response.OK)
+	h := response.GetDefaultHeaders(len(message))
+	h.Replace("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeaders(h)
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody(message)
+	}
+}
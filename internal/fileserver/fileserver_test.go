@@ -0,0 +1,198 @@
+package fileserver
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serve(t *testing.T, handler func(w *response.Writer, req *request.Request), method, target string, hdrs map[string]string) (*http.Response, []byte) {
+	t.Helper()
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	}
+	for k, v := range hdrs {
+		req.Headers.Set(k, v)
+	}
+
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetRequestMethod(method)
+	handler(w, req)
+	require.NoError(t, w.Finish())
+
+	httpReq, _ := http.NewRequest(method, target, nil)
+	resp, err := http.ReadResponse(bufio.NewReader(buf), httpReq)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, body
+}
+
+func setupRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "hello.txt"), []byte("0123456789abcdef"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "docs"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "docs", "a <b>.bin"), []byte{0, 1, 2}, 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "site"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "site", "index.html"), []byte("<h1>home</h1>"), 0o644))
+	return root
+}
+
+func TestServeFile(t *testing.T) {
+	root := setupRoot(t)
+	handler := Handler(Config{Root: root, StripPrefix: "/static", Listing: true})
+
+	// Test: Whole file
+	resp, body := serve(t, handler, "GET", "/static/hello.txt", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "0123456789abcdef", string(body))
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, lastModified)
+
+	// Test: HEAD sends headers only
+	resp, body = serve(t, handler, "HEAD", "/static/hello.txt", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, int64(16), resp.ContentLength)
+	assert.Empty(t, body)
+
+	// Test: Single range
+	resp, body = serve(t, handler, "GET", "/static/hello.txt", map[string]string{"Range": "bytes=2-5"})
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "bytes 2-5/16", resp.Header.Get("Content-Range"))
+	assert.Equal(t, "2345", string(body))
+
+	// Test: Suffix range
+	resp, body = serve(t, handler, "GET", "/static/hello.txt", map[string]string{"Range": "bytes=-3"})
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "def", string(body))
+
+	// Test: Multiple ranges
+	resp, body = serve(t, handler, "GET", "/static/hello.txt", map[string]string{"Range": "bytes=0-1, 10-"})
+	assert.Equal(t, 206, resp.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "bytes 0-1/16", part.Header.Get("Content-Range"))
+	data, _ := io.ReadAll(part)
+	assert.Equal(t, "01", string(data))
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "bytes 10-15/16", part.Header.Get("Content-Range"))
+	data, _ = io.ReadAll(part)
+	assert.Equal(t, "abcdef", string(data))
+	_, err = mr.NextPart()
+	assert.Equal(t, io.EOF, err)
+
+	// Test: Unsatisfiable range
+	resp, _ = serve(t, handler, "GET", "/static/hello.txt", map[string]string{"Range": "bytes=100-200"})
+	assert.Equal(t, 416, resp.StatusCode)
+	assert.Equal(t, "bytes */16", resp.Header.Get("Content-Range"))
+
+	// Test: If-Range with a stale validator returns the whole file
+	resp, body = serve(t, handler, "GET", "/static/hello.txt", map[string]string{"Range": "bytes=2-5", "If-Range": `"stale"`})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "0123456789abcdef", string(body))
+
+	// Test: If-Range with the current ETag honours the range
+	resp, body = serve(t, handler, "GET", "/static/hello.txt", map[string]string{"Range": "bytes=2-5", "If-Range": etag})
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "2345", string(body))
+
+	// Test: If-None-Match
+	resp, body = serve(t, handler, "GET", "/static/hello.txt", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, 304, resp.StatusCode)
+	assert.Empty(t, body)
+
+	// Test: If-Modified-Since
+	resp, _ = serve(t, handler, "GET", "/static/hello.txt", map[string]string{"If-Modified-Since": lastModified})
+	assert.Equal(t, 304, resp.StatusCode)
+
+	// Test: If-Match failure
+	resp, _ = serve(t, handler, "GET", "/static/hello.txt", map[string]string{"If-Match": `"other"`})
+	assert.Equal(t, 412, resp.StatusCode)
+}
+
+func TestHandlerPaths(t *testing.T) {
+	root := setupRoot(t)
+	handler := Handler(Config{Root: filepath.Join(root, "docs"), StripPrefix: "/static", Listing: true})
+
+	// Test: Path traversal stays inside the root
+	resp, _ := serve(t, handler, "GET", "/static/../hello.txt", nil)
+	assert.Equal(t, 404, resp.StatusCode)
+	resp, _ = serve(t, handler, "GET", "/static/%2e%2e/hello.txt", nil)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// Test: The prefix only matches whole path segments
+	resp, _ = serve(t, handler, "GET", "/statica%20%3Cb%3E.bin", nil)
+	assert.Equal(t, 404, resp.StatusCode)
+	resp, _ = serve(t, handler, "GET", "/static", nil)
+	assert.Equal(t, 301, resp.StatusCode)
+	assert.Equal(t, "/static/", resp.Header.Get("Location"))
+
+	// Test: Symlinks pointing out of the root are not followed
+	require.NoError(t, os.Symlink(filepath.Join(root, "hello.txt"), filepath.Join(root, "docs", "link.txt")))
+	resp, _ = serve(t, handler, "GET", "/static/link.txt", nil)
+	assert.Equal(t, 404, resp.StatusCode)
+	require.NoError(t, os.Remove(filepath.Join(root, "docs", "link.txt")))
+
+	// Test: Directory listing escapes names
+	resp, body := serve(t, handler, "GET", "/static/", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, string(body), `<a href="./a%20%3Cb%3E.bin">a &lt;b&gt;.bin</a>`)
+
+	// Test: Directory without a trailing slash redirects
+	handler = Handler(Config{Root: root})
+	resp, _ = serve(t, handler, "GET", "/site", nil)
+	assert.Equal(t, 301, resp.StatusCode)
+	assert.Equal(t, "/site/", resp.Header.Get("Location"))
+
+	// Test: index.html is served for directories
+	resp, body = serve(t, handler, "GET", "/site/", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "<h1>home</h1>", string(body))
+
+	// Test: Listing disabled
+	resp, _ = serve(t, handler, "GET", "/docs/", nil)
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// Test: Missing file
+	resp, _ = serve(t, handler, "GET", "/nope.txt", nil)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// Test: A file requested with a trailing slash
+	resp, _ = serve(t, handler, "GET", "/hello.txt/", nil)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// Test: Symlinks staying inside the root are followed
+	require.NoError(t, os.Symlink(filepath.Join(root, "hello.txt"), filepath.Join(root, "site", "link.txt")))
+	resp, body = serve(t, handler, "GET", "/site/link.txt", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "0123456789abcdef", string(body))
+
+	// Test: Unsupported method
+	resp, _ = serve(t, handler, "POST", "/site/", nil)
+	assert.Equal(t, 405, resp.StatusCode)
+	assert.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+}
@@ -0,0 +1,209 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+)
+
+var errUnsatisfiable = errors.New("range not satisfiable")
+
+type httpRange struct {
+	start  int64
+	length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header value as described in RFC 9110, 14.2.
+// Unparseable headers are ignored; ranges that all start past the end
+// of the file are reported with errUnsatisfiable.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	spec, ok := strings.CutPrefix(s, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+
+	var ranges []httpRange
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r httpRange
+		if first == "" {
+			suffix, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || suffix < 0 {
+				return nil, nil
+			}
+			if suffix == 0 {
+				continue
+			}
+			if suffix > size {
+				suffix = size
+			}
+			r.start = size - suffix
+			r.length = suffix
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			if start >= size {
+				continue
+			}
+			r.start = start
+			if last == "" {
+				r.length = size - start
+			} else {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+				if end >= size {
+					end = size - 1
+				}
+				r.length = end - start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+	return ranges, nil
+}
+
+func sumLength(ranges []httpRange) int64 {
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	return total
+}
+
+// rangeHeader returns the Range header of req, or an empty string when an
+// If-Range validator doesn't match the current representation.
+func rangeHeader(req *request.Request, etag string, modTime time.Time) string {
+	rng, ok := req.Headers.Get("Range")
+	if !ok || req.RequestLine.Method != "GET" && req.RequestLine.Method != "HEAD" {
+		return ""
+	}
+	ifRange, ok := req.Headers.Get("If-Range")
+	if !ok {
+		return rng
+	}
+	ifRange = strings.TrimSpace(ifRange)
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		if ifRange == etag {
+			return rng
+		}
+		return ""
+	}
+	t, err := time.Parse(response.TimeFormat, ifRange)
+	if err == nil && t.Equal(modTime) {
+		return rng
+	}
+	return ""
+}
+
+// checkPreconditions evaluates the conditional request headers in the order
+// of RFC 9110, 13.2.2. It returns false with the status to answer when the
+// request should not be served normally.
+func checkPreconditions(req *request.Request, etag string, modTime time.Time) (response.StatusCode, bool) {
+	if val, ok := req.Headers.Get("If-Match"); ok {
+		if !matchETag(val, etag, false) {
+			return response.PreconditionFailed, false
+		}
+	} else if val, ok := req.Headers.Get("If-Unmodified-Since"); ok {
+		if t, err := time.Parse(response.TimeFormat, val); err == nil && modTime.After(t) {
+			return response.PreconditionFailed, false
+		}
+	}
+
+	if val, ok := req.Headers.Get("If-None-Match"); ok {
+		if matchETag(val, etag, true) {
+			return response.NotModified, false
+		}
+	} else if val, ok := req.Headers.Get("If-Modified-Since"); ok {
+		if t, err := time.Parse(response.TimeFormat, val); err == nil && !modTime.After(t) {
+			return response.NotModified, false
+		}
+	}
+	return 0, true
+}
+
+func matchETag(list, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func writeMultipart(w *response.Writer, f *os.File, h headers.Headers, ranges []httpRange, contentType string, size int64, head bool) {
+	boundary := newBoundary()
+	partHeaders := make([]string, len(ranges))
+	length := int64(0)
+	for i, r := range ranges {
+		partHeaders[i] = fmt.Sprintf("\r\n--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", boundary, contentType, r.contentRange(size))
+		length += int64(len(partHeaders[i])) + r.length
+	}
+	closing := fmt.Sprintf("\r\n--%s--\r\n", boundary)
+	length += int64(len(closing))
+
+	h.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	h.Set("Content-Length", fmt.Sprintf("%d", length))
+	w.WriteStatusLine(response.PartialContent)
+	w.WriteHeaders(h)
+	if head {
+		return
+	}
+
+	for i, r := range ranges {
+		if _, err := w.WriteBody([]byte(partHeaders[i])); err != nil {
+			return
+		}
+		if _, err := f.Seek(r.start, io.SeekStart); err != nil {
+			return
+		}
+		if _, err := io.CopyN(w, f, r.length); err != nil {
+			return
+		}
+	}
+	w.WriteBody([]byte(closing))
+}
+
+func newBoundary() string {
+	buf := make([]byte, 15)
+	rand.Read(buf)
+	return fmt.Sprintf("%x", buf)
+}
@@ -74,4 +74,22 @@ func TestHeadersParse(t *testing.T) {
 	require.Error(t, err)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
+
+	// Test: Missing colon
+	headers = NewHeaders()
+	data = []byte("no colon here\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.Error(t, err)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+}
+
+func TestHasToken(t *testing.T) {
+	// Test: Token among others, any case and spacing
+	assert.True(t, HasToken("keep-alive, Upgrade", "upgrade"))
+	assert.True(t, HasToken("close", "close"))
+
+	// Test: Token only as part of another
+	assert.False(t, HasToken("upgrade-insecure", "upgrade"))
+	assert.False(t, HasToken("", "close"))
 }
@@ -67,6 +67,9 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	}
 
 	parts := bytes.SplitN(data[:idx], []byte(":"), 2)
+	if len(parts) != 2 {
+		return 0, false, fmt.Errorf("invalid field line format: %s", data[:idx])
+	}
 	key := string(parts[0])
 	if key != strings.TrimRight(key, " ") {
 		return 0, false, fmt.Errorf("invalid field line format: %s", key)
@@ -82,3 +85,14 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	h.Set(key, value)
 	return idx + 2, false, nil
 }
+
+// HasToken reports whether the comma-separated list value contains token,
+// compared case-insensitively.
+func HasToken(value, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
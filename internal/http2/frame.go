@@ -0,0 +1,184 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type frameType uint8
+
+const (
+	frameData         frameType = 0x0
+	frameHeaders      frameType = 0x1
+	framePriority     frameType = 0x2
+	frameRSTStream    frameType = 0x3
+	frameSettings     frameType = 0x4
+	framePushPromise  frameType = 0x5
+	framePing         frameType = 0x6
+	frameGoAway       frameType = 0x7
+	frameWindowUpdate frameType = 0x8
+	frameContinuation frameType = 0x9
+)
+
+const (
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+type settingID uint16
+
+const (
+	settingHeaderTableSize      settingID = 0x1
+	settingEnablePush           settingID = 0x2
+	settingMaxConcurrentStreams settingID = 0x3
+	settingInitialWindowSize    settingID = 0x4
+	settingMaxFrameSize         settingID = 0x5
+	settingMaxHeaderListSize    settingID = 0x6
+)
+
+type errCode uint32
+
+const (
+	errCodeNo                 errCode = 0x0
+	errCodeProtocol           errCode = 0x1
+	errCodeInternal           errCode = 0x2
+	errCodeFlowControl        errCode = 0x3
+	errCodeSettingsTimeout    errCode = 0x4
+	errCodeStreamClosed       errCode = 0x5
+	errCodeFrameSize          errCode = 0x6
+	errCodeRefusedStream      errCode = 0x7
+	errCodeCancel             errCode = 0x8
+	errCodeCompression        errCode = 0x9
+	errCodeConnect            errCode = 0xa
+	errCodeEnhanceYourCalm    errCode = 0xb
+	errCodeInadequateSecurity errCode = 0xc
+	errCodeHTTP11Required     errCode = 0xd
+)
+
+// ClientPreface starts every HTTP/2 connection.
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	frameHeaderLen      = 9
+	defaultMaxFrameSize = 16384
+	maxAllowedFrameSize = 1<<24 - 1
+	defaultWindowSize   = 65535
+	maxWindowSize       = 1<<31 - 1
+	streamIDMask        = 1<<31 - 1
+	maxHeaderListSize   = 1 << 20
+)
+
+// connError ends the whole connection with a GOAWAY.
+type connError struct {
+	code   errCode
+	reason string
+}
+
+func (e connError) Error() string {
+	return fmt.Sprintf("http2: connection error %d: %s", e.code, e.reason)
+}
+
+// streamError resets a single stream with RST_STREAM.
+type streamError struct {
+	streamID uint32
+	code     errCode
+}
+
+func (e streamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %d", e.streamID, e.code)
+}
+
+type frame struct {
+	typ      frameType
+	flags    uint8
+	streamID uint32
+	payload  []byte
+}
+
+func (f *frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+// readFrame reads one frame no bigger than maxSize.
+func readFrame(r io.Reader, maxSize uint32) (*frame, error) {
+	var head [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	length := uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2])
+	f := &frame{
+		typ:      frameType(head[3]),
+		flags:    head[4],
+		streamID: binary.BigEndian.Uint32(head[5:]) & streamIDMask,
+	}
+	if length > maxSize {
+		return nil, connError{errCodeFrameSize, "frame too large"}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func appendFrameHeader(dst []byte, typ frameType, flags uint8, streamID uint32, length int) []byte {
+	dst = append(dst, byte(length>>16), byte(length>>8), byte(length), byte(typ), flags)
+	return binary.BigEndian.AppendUint32(dst, streamID&streamIDMask)
+}
+
+func writeFrame(w io.Writer, typ frameType, flags uint8, streamID uint32, payload []byte) error {
+	buf := make([]byte, 0, frameHeaderLen+len(payload))
+	buf = appendFrameHeader(buf, typ, flags, streamID, len(payload))
+	buf = append(buf, payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// stripPadding removes the pad length byte and padding of DATA and
+// HEADERS payloads.
+func stripPadding(f *frame) ([]byte, error) {
+	p := f.payload
+	if !f.has(flagPadded) {
+		return p, nil
+	}
+	if len(p) == 0 {
+		return nil, connError{errCodeProtocol, "missing pad length"}
+	}
+	padLen := int(p[0])
+	p = p[1:]
+	if padLen > len(p) {
+		return nil, connError{errCodeProtocol, "padding exceeds payload"}
+	}
+	return p[:len(p)-padLen], nil
+}
+
+type setting struct {
+	id    settingID
+	value uint32
+}
+
+func parseSettings(p []byte) ([]setting, error) {
+	if len(p)%6 != 0 {
+		return nil, connError{errCodeFrameSize, "bad SETTINGS length"}
+	}
+	var settings []setting
+	for ; len(p) > 0; p = p[6:] {
+		settings = append(settings, setting{
+			id:    settingID(binary.BigEndian.Uint16(p)),
+			value: binary.BigEndian.Uint32(p[2:]),
+		})
+	}
+	return settings, nil
+}
+
+func appendSettings(dst []byte, settings ...setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.id))
+		dst = binary.BigEndian.AppendUint32(dst, s.value)
+	}
+	return dst
+}
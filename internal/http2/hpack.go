@@ -0,0 +1,419 @@
+package http2
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	defaultHeaderTableSize = 4096
+	entryOverhead          = 32
+)
+
+var (
+	errHPACK       = errors.New("http2: invalid header block")
+	errHuffman     = errors.New("http2: invalid huffman string")
+	errHeaderLimit = errors.New("http2: header list too large")
+)
+
+type headerField struct {
+	name, value string
+}
+
+func (f headerField) size() int {
+	return len(f.name) + len(f.value) + entryOverhead
+}
+
+// dynamicTable holds the most recently added entry first.
+type dynamicTable struct {
+	entries []headerField
+	size    int
+	maxSize int
+}
+
+func (t *dynamicTable) add(f headerField) {
+	t.entries = append([]headerField{f}, t.entries...)
+	t.size += f.size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n int) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *dynamicTable) evict() {
+	for t.size > t.maxSize && len(t.entries) > 0 {
+		last := t.entries[len(t.entries)-1]
+		t.entries = t.entries[:len(t.entries)-1]
+		t.size -= last.size()
+	}
+}
+
+// field returns the entry at a one-based index into the static table
+// followed by the dynamic table.
+func (t *dynamicTable) field(i uint64) (headerField, bool) {
+	if i == 0 {
+		return headerField{}, false
+	}
+	if i <= uint64(len(staticTable)) {
+		return staticTable[i-1], true
+	}
+	i -= uint64(len(staticTable)) + 1
+	if i >= uint64(len(t.entries)) {
+		return headerField{}, false
+	}
+	return t.entries[i], true
+}
+
+// decoder turns header blocks into fields. It keeps the dynamic table
+// across blocks, so one is needed per connection.
+type decoder struct {
+	table dynamicTable
+	// maxTableSize is the limit we advertised in SETTINGS_HEADER_TABLE_SIZE.
+	maxTableSize int
+	// maxListSize bounds the decoded size of one header block.
+	maxListSize int
+}
+
+func newDecoder(maxListSize int) *decoder {
+	return &decoder{
+		table:        dynamicTable{maxSize: defaultHeaderTableSize},
+		maxTableSize: defaultHeaderTableSize,
+		maxListSize:  maxListSize,
+	}
+}
+
+func (d *decoder) decode(block []byte) ([]headerField, error) {
+	var fields []headerField
+	listSize := 0
+	sawField := false
+	for len(block) > 0 {
+		b := block[0]
+		var f headerField
+		var err error
+		switch {
+		case b&0x80 != 0:
+			var index uint64
+			index, block, err = readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if f, ok = d.table.field(index); !ok {
+				return nil, errHPACK
+			}
+		case b&0xc0 == 0x40:
+			f, block, err = d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.table.add(f)
+		case b&0xe0 == 0x20:
+			if sawField {
+				return nil, errHPACK
+			}
+			var size uint64
+			size, block, err = readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.maxTableSize) {
+				return nil, errHPACK
+			}
+			d.table.setMaxSize(int(size))
+			continue
+		default:
+			// Literal without indexing or never indexed, both with a
+			// four bit prefix.
+			f, block, err = d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		sawField = true
+		listSize += f.size()
+		if d.maxListSize > 0 && listSize > d.maxListSize {
+			return nil, errHeaderLimit
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func (d *decoder) readLiteral(p []byte, prefix uint) (headerField, []byte, error) {
+	index, p, err := readInt(p, prefix)
+	if err != nil {
+		return headerField{}, nil, err
+	}
+	var f headerField
+	if index == 0 {
+		if f.name, p, err = readString(p); err != nil {
+			return headerField{}, nil, err
+		}
+	} else {
+		named, ok := d.table.field(index)
+		if !ok {
+			return headerField{}, nil, errHPACK
+		}
+		f.name = named.name
+	}
+	if f.value, p, err = readString(p); err != nil {
+		return headerField{}, nil, err
+	}
+	return f, p, nil
+}
+
+// encoder turns fields into header blocks, indexing the ones that are
+// likely to repeat.
+type encoder struct {
+	table dynamicTable
+	// pendingSize is a table size change the peer must be told about at
+	// the start of the next block, or -1.
+	pendingSize int
+}
+
+func newEncoder() *encoder {
+	return &encoder{
+		table:       dynamicTable{maxSize: defaultHeaderTableSize},
+		pendingSize: -1,
+	}
+}
+
+// setMaxTableSize follows the peer's SETTINGS_HEADER_TABLE_SIZE.
+func (e *encoder) setMaxTableSize(n int) {
+	if n > defaultHeaderTableSize {
+		n = defaultHeaderTableSize
+	}
+	if n == e.table.maxSize {
+		return
+	}
+	e.table.setMaxSize(n)
+	e.pendingSize = n
+}
+
+func (e *encoder) encode(dst []byte, fields []headerField) []byte {
+	if e.pendingSize >= 0 {
+		dst = appendInt(dst, 0x20, 5, uint64(e.pendingSize))
+		e.pendingSize = -1
+	}
+	for _, f := range fields {
+		index, exact := e.search(f)
+		if exact {
+			dst = appendInt(dst, 0x80, 7, index)
+			continue
+		}
+
+		switch {
+		case sensitive(f.name):
+			dst = appendInt(dst, 0x10, 4, index)
+		case f.size() <= e.table.maxSize/2:
+			dst = appendInt(dst, 0x40, 6, index)
+			e.table.add(f)
+		default:
+			dst = appendInt(dst, 0x00, 4, index)
+		}
+		if index == 0 {
+			dst = appendString(dst, f.name)
+		}
+		dst = appendString(dst, f.value)
+	}
+	return dst
+}
+
+// search returns the index of an entry matching f exactly, or failing
+// that one with the same name, or 0.
+func (e *encoder) search(f headerField) (uint64, bool) {
+	var nameIndex uint64
+	for i, s := range staticTable {
+		if s.name != f.name {
+			continue
+		}
+		if s.value == f.value {
+			return uint64(i + 1), true
+		}
+		if nameIndex == 0 {
+			nameIndex = uint64(i + 1)
+		}
+	}
+	for i, d := range e.table.entries {
+		if d.name != f.name {
+			continue
+		}
+		index := uint64(len(staticTable) + i + 1)
+		if d.value == f.value {
+			return index, true
+		}
+		if nameIndex == 0 {
+			nameIndex = index
+		}
+	}
+	return nameIndex, false
+}
+
+func sensitive(name string) bool {
+	switch name {
+	case "authorization", "proxy-authorization", "cookie", "set-cookie":
+		return true
+	}
+	return false
+}
+
+func appendInt(dst []byte, first byte, prefix uint, n uint64) []byte {
+	limit := uint64(1)<<prefix - 1
+	if n < limit {
+		return append(dst, first|byte(n))
+	}
+	dst = append(dst, first|byte(limit))
+	n -= limit
+	for n >= 128 {
+		dst = append(dst, byte(n&0x7f)|0x80)
+		n >>= 7
+	}
+	return append(dst, byte(n))
+}
+
+func readInt(p []byte, prefix uint) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, nil, errHPACK
+	}
+	limit := uint64(1)<<prefix - 1
+	n := uint64(p[0]) & limit
+	p = p[1:]
+	if n < limit {
+		return n, p, nil
+	}
+	var shift uint
+	for len(p) > 0 {
+		b := p[0]
+		p = p[1:]
+		n += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return n, p, nil
+		}
+		shift += 7
+		if shift > 56 {
+			return 0, nil, errHPACK
+		}
+	}
+	return 0, nil, errHPACK
+}
+
+func appendString(dst []byte, s string) []byte {
+	if n := huffmanLen(s); n < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(n))
+		return appendHuffman(dst, s)
+	}
+	dst = appendInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+func readString(p []byte) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", nil, errHPACK
+	}
+	huffman := p[0]&0x80 != 0
+	n, p, err := readInt(p, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(p)) < n {
+		return "", nil, errHPACK
+	}
+	raw, rest := p[:n], p[n:]
+	if !huffman {
+		return string(raw), rest, nil
+	}
+	s, err := decodeHuffman(raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return s, rest, nil
+}
+
+func huffmanLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLen[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+func appendHuffman(dst []byte, s string) []byte {
+	var acc uint64
+	var n uint
+	for i := 0; i < len(s); i++ {
+		length := uint(huffmanCodeLen[s[i]])
+		acc = acc<<length | uint64(huffmanCodes[s[i]])
+		n += length
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(acc>>n))
+		}
+	}
+	if n > 0 {
+		// Pad with the most significant bits of EOS, which are all ones.
+		dst = append(dst, byte(acc<<(8-n))|byte(0xff>>n))
+	}
+	return dst
+}
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      int
+}
+
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{sym: -1}
+	insert := func(sym int, code uint32, length uint8) {
+		n := root
+		for i := int(length) - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{sym: -1}
+			}
+			n = n.children[bit]
+		}
+		n.sym = sym
+	}
+	for sym := range huffmanCodes {
+		insert(sym, huffmanCodes[sym], huffmanCodeLen[sym])
+	}
+	insert(256, 0x3fffffff, 30)
+	return root
+}
+
+func decodeHuffman(p []byte) (string, error) {
+	var b strings.Builder
+	n := huffmanRoot
+	// pending counts the bits read since the last symbol and ones tracks
+	// whether they were all set, which is the only valid padding.
+	pending, ones := 0, true
+	for _, c := range p {
+		for i := 7; i >= 0; i-- {
+			bit := (c >> uint(i)) & 1
+			n = n.children[bit]
+			if n == nil {
+				return "", errHuffman
+			}
+			pending++
+			ones = ones && bit == 1
+			if n.sym < 0 {
+				continue
+			}
+			if n.sym == 256 {
+				return "", errHuffman
+			}
+			b.WriteByte(byte(n.sym))
+			n = huffmanRoot
+			pending, ones = 0, true
+		}
+	}
+	if pending > 7 || !ones {
+		return "", errHuffman
+	}
+	return b.String(), nil
+}
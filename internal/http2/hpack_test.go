@@ -0,0 +1,150 @@
+package http2
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func TestIntegers(t *testing.T) {
+	// Test: Examples from RFC 7541, Appendix C.1
+	assert.Equal(t, []byte{0x0a}, appendInt(nil, 0, 5, 10))
+	assert.Equal(t, []byte{0x1f, 0x9a, 0x0a}, appendInt(nil, 0, 5, 1337))
+	assert.Equal(t, []byte{0x2a}, appendInt(nil, 0, 8, 42))
+
+	n, rest, err := readInt([]byte{0x1f, 0x9a, 0x0a, 0xff}, 5)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1337), n)
+	assert.Equal(t, []byte{0xff}, rest)
+
+	// Test: Truncated and overlong integers
+	_, _, err = readInt([]byte{0x1f, 0x9a}, 5)
+	assert.Error(t, err)
+	_, _, err = readInt(unhex(t, "1f ff ff ff ff ff ff ff ff ff 01"), 5)
+	assert.Error(t, err)
+}
+
+func TestHuffman(t *testing.T) {
+	// Test: Encoding from RFC 7541, Appendix C.4.1
+	encoded := unhex(t, "f1e3 c2e5 f23a 6ba0 ab90 f4ff")
+	assert.Equal(t, encoded, appendHuffman(nil, "www.example.com"))
+	assert.Equal(t, len(encoded), huffmanLen("www.example.com"))
+	decoded, err := decodeHuffman(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, "www.example.com", decoded)
+
+	// Test: Every byte value survives a round trip
+	var all strings.Builder
+	for i := 0; i < 256; i++ {
+		all.WriteByte(byte(i))
+	}
+	decoded, err = decodeHuffman(appendHuffman(nil, all.String()))
+	require.NoError(t, err)
+	assert.Equal(t, all.String(), decoded)
+
+	// Test: Padding longer than 7 bits
+	_, err = decodeHuffman(append(appendHuffman(nil, "a"), 0xff))
+	assert.Error(t, err)
+
+	// Test: Padding that is not all ones
+	_, err = decodeHuffman([]byte{0x00})
+	assert.Error(t, err)
+
+	// Test: Explicit EOS symbol
+	_, err = decodeHuffman([]byte{0xff, 0xff, 0xff, 0xfc})
+	assert.Error(t, err)
+}
+
+func TestDecoder(t *testing.T) {
+	d := newDecoder(0)
+
+	// Test: Requests with Huffman coding from RFC 7541, Appendix C.4
+	fields, err := d.decode(unhex(t, "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff"))
+	require.NoError(t, err)
+	assert.Equal(t, []headerField{
+		{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"},
+	}, fields)
+	assert.Equal(t, 57, d.table.size)
+
+	fields, err = d.decode(unhex(t, "8286 84be 5886 a8eb 1064 9cbf"))
+	require.NoError(t, err)
+	assert.Equal(t, []headerField{
+		{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"},
+		{"cache-control", "no-cache"},
+	}, fields)
+	assert.Equal(t, 110, d.table.size)
+
+	fields, err = d.decode(unhex(t, "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf"))
+	require.NoError(t, err)
+	assert.Equal(t, []headerField{
+		{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"}, {":authority", "www.example.com"},
+		{"custom-key", "custom-value"},
+	}, fields)
+	assert.Equal(t, 164, d.table.size)
+	assert.Len(t, d.table.entries, 3)
+
+	// Test: Table size update evicts entries
+	_, err = d.decode([]byte{0x20})
+	require.NoError(t, err)
+	assert.Empty(t, d.table.entries)
+
+	// Test: Size update above the advertised limit
+	_, err = d.decode(appendInt(nil, 0x20, 5, 8192))
+	assert.Error(t, err)
+
+	// Test: Index out of range
+	_, err = d.decode([]byte{0xff, 0x00})
+	assert.Error(t, err)
+
+	// Test: Header list size limit
+	limited := newDecoder(64)
+	_, err = limited.decode(newEncoder().encode(nil, []headerField{{"x-big", strings.Repeat("a", 64)}}))
+	assert.ErrorIs(t, err, errHeaderLimit)
+}
+
+func TestEncoderRoundTrip(t *testing.T) {
+	e := newEncoder()
+	d := newDecoder(0)
+	blocks := [][]headerField{
+		{{":status", "200"}, {"content-type", "text/plain"}, {"x-request", "one"}},
+		{{":status", "404"}, {"content-type", "text/plain"}, {"x-request", "two"}, {"set-cookie", "secret"}},
+		{{":status", "200"}, {"content-type", "text/plain"}, {"x-request", "one"}},
+	}
+
+	var sizes []int
+	for _, fields := range blocks {
+		block := e.encode(nil, fields)
+		sizes = append(sizes, len(block))
+		decoded, err := d.decode(block)
+		require.NoError(t, err)
+		assert.Equal(t, fields, decoded)
+		assert.Equal(t, len(e.table.entries), len(d.table.entries))
+	}
+
+	// Test: Repeated fields come from the dynamic table
+	assert.Less(t, sizes[2], sizes[0])
+
+	// Test: Sensitive fields are never indexed
+	for _, f := range e.table.entries {
+		assert.NotEqual(t, "set-cookie", f.name)
+	}
+
+	// Test: A smaller peer table is announced in the next block
+	e.setMaxTableSize(0)
+	block := e.encode(nil, blocks[0])
+	assert.Equal(t, byte(0x20), block[0])
+	decoded, err := d.decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, blocks[0], decoded)
+	assert.Empty(t, d.table.entries)
+}
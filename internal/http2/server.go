@@ -0,0 +1,824 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+)
+
+const (
+	defaultMaxConcurrentStreams = 100
+	defaultMaxBodySize          = 10 << 20
+	defaultIdleTimeout          = 2 * time.Minute
+)
+
+// ErrStreamReset is returned by writes to a stream that was reset or
+// whose connection was closed.
+var ErrStreamReset = errors.New("http2: stream reset")
+
+// Handler has the same signature as server.Handler, which this package
+// can't import.
+type Handler = func(w *response.Writer, req *request.Request)
+
+type Server struct {
+	Handler Handler
+	// NewWriter wraps each stream in a response.Writer, letting the caller
+	// install default headers and filters. response.NewFramedWriter if nil.
+	NewWriter func(f response.Framer) *response.Writer
+	// MaxConcurrentStreams is advertised to clients, 100 if zero.
+	MaxConcurrentStreams uint32
+	// MaxBodySize limits the request body buffered for a stream, 10 MiB
+	// if zero. Larger requests are answered with 413.
+	MaxBodySize int
+	// IdleTimeout limits how long the client may send nothing while no
+	// handler is running, 2 minutes if zero. The connection is then
+	// closed with GOAWAY.
+	IdleTimeout time.Duration
+}
+
+// ServeConn speaks HTTP/2 on conn, which must start with the client
+// preface. buffered holds bytes already read from conn. It returns when
+// the connection is closed.
+func (s *Server) ServeConn(conn net.Conn, buffered []byte) error {
+	return s.newConn(conn, buffered).serve(nil, nil)
+}
+
+// ServeUpgrade takes over conn after a 101 response to an HTTP/1.1
+// request with "Upgrade: h2c". The request is answered on stream 1 and
+// settings is the decoded HTTP2-Settings header.
+func (s *Server) ServeUpgrade(conn net.Conn, buffered []byte, req *request.Request, settings []byte) error {
+	return s.newConn(conn, buffered).serve(req, settings)
+}
+
+type serverConn struct {
+	srv  *Server
+	conn net.Conn
+	r    io.Reader
+	dec  *decoder
+	wg   sync.WaitGroup
+
+	// writeMu serializes frames on the wire; the encoder is guarded by it
+	// since its table must change in the order blocks are sent.
+	writeMu sync.Mutex
+	enc     *encoder
+
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	lastStreamID      uint32
+	sendWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  int
+	goingAway         bool
+	closed            bool
+
+	// A header block split over CONTINUATION frames being collected.
+	pendingStream    uint32
+	pendingEndStream bool
+	pendingBlock     []byte
+}
+
+func (s *Server) newConn(conn net.Conn, buffered []byte) *serverConn {
+	sc := &serverConn{
+		srv:               s,
+		conn:              conn,
+		r:                 bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn)),
+		dec:               newDecoder(maxHeaderListSize),
+		enc:               newEncoder(),
+		streams:           make(map[uint32]*stream),
+		sendWindow:        defaultWindowSize,
+		peerInitialWindow: defaultWindowSize,
+		peerMaxFrameSize:  defaultMaxFrameSize,
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	return sc
+}
+
+func (s *Server) maxConcurrentStreams() uint32 {
+	if s.MaxConcurrentStreams == 0 {
+		return defaultMaxConcurrentStreams
+	}
+	return s.MaxConcurrentStreams
+}
+
+func (s *Server) maxBodySize() int {
+	if s.MaxBodySize == 0 {
+		return defaultMaxBodySize
+	}
+	return s.MaxBodySize
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout == 0 {
+		return defaultIdleTimeout
+	}
+	return s.IdleTimeout
+}
+
+func (sc *serverConn) serve(upgrade *request.Request, settings []byte) error {
+	defer sc.shutdown()
+
+	err := sc.writeFrame(frameSettings, 0, 0, appendSettings(nil,
+		setting{settingMaxConcurrentStreams, sc.srv.maxConcurrentStreams()},
+		setting{settingEnablePush, 0},
+	))
+	if err != nil {
+		return err
+	}
+
+	if upgrade != nil {
+		parsed, err := parseSettings(settings)
+		if err != nil {
+			return err
+		}
+		if err := sc.applySettings(parsed); err != nil {
+			return err
+		}
+		st := sc.newStream(1, upgrade)
+		sc.lastStreamID = 1
+		sc.dispatch(st)
+	}
+
+	sc.mu.Lock()
+	sc.setReadDeadline()
+	sc.mu.Unlock()
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.r, preface); err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		return connError{errCodeProtocol, "bad client preface"}
+	}
+
+	first := true
+	for {
+		sc.mu.Lock()
+		sc.setReadDeadline()
+		sc.mu.Unlock()
+		f, err := readFrame(sc.r, defaultMaxFrameSize)
+		if err == nil {
+			if first && f.typ != frameSettings {
+				err = connError{errCodeProtocol, "expected SETTINGS"}
+			} else {
+				err = sc.processFrame(f)
+			}
+			first = false
+		}
+
+		var se streamError
+		if errors.As(err, &se) {
+			sc.resetStream(se.streamID, se.code)
+			continue
+		}
+		var ce connError
+		if errors.As(err, &ce) {
+			sc.goAway(ce.code)
+			return err
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			sc.goAway(errCodeNo)
+			return nil
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// setReadDeadline gives the client IdleTimeout to send its next frame,
+// unless a handler is running, whose response the client may be waiting
+// for. Called with sc.mu held.
+func (sc *serverConn) setReadDeadline() {
+	for _, st := range sc.streams {
+		if st.dispatched {
+			sc.conn.SetReadDeadline(time.Time{})
+			return
+		}
+	}
+	sc.conn.SetReadDeadline(time.Now().Add(sc.srv.idleTimeout()))
+}
+
+// shutdown wakes writers waiting for flow control, lets running handlers
+// finish and closes the connection.
+func (sc *serverConn) shutdown() {
+	sc.mu.Lock()
+	sc.closed = true
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	sc.wg.Wait()
+	sc.conn.Close()
+}
+
+func (sc *serverConn) processFrame(f *frame) error {
+	if sc.pendingBlock != nil && (f.typ != frameContinuation || f.streamID != sc.pendingStream) {
+		return connError{errCodeProtocol, "expected CONTINUATION"}
+	}
+
+	switch f.typ {
+	case frameSettings:
+		return sc.processSettings(f)
+	case framePing:
+		if f.streamID != 0 {
+			return connError{errCodeProtocol, "PING on a stream"}
+		}
+		if len(f.payload) != 8 {
+			return connError{errCodeFrameSize, "bad PING length"}
+		}
+		if f.has(flagAck) {
+			return nil
+		}
+		return sc.writeFrame(framePing, flagAck, 0, f.payload)
+	case frameHeaders:
+		return sc.processHeaders(f)
+	case frameContinuation:
+		if sc.pendingBlock == nil {
+			return connError{errCodeProtocol, "unexpected CONTINUATION"}
+		}
+		sc.pendingBlock = append(sc.pendingBlock, f.payload...)
+		if len(sc.pendingBlock) > maxHeaderListSize {
+			return connError{errCodeEnhanceYourCalm, "header block too large"}
+		}
+		if !f.has(flagEndHeaders) {
+			return nil
+		}
+		block := sc.pendingBlock
+		sc.pendingBlock = nil
+		return sc.processHeaderBlock(sc.pendingStream, block, sc.pendingEndStream)
+	case frameData:
+		return sc.processData(f)
+	case frameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	case frameRSTStream:
+		if f.streamID == 0 {
+			return connError{errCodeProtocol, "RST_STREAM on stream 0"}
+		}
+		if len(f.payload) != 4 {
+			return connError{errCodeFrameSize, "bad RST_STREAM length"}
+		}
+		if f.streamID > sc.lastStreamID {
+			return connError{errCodeProtocol, "RST_STREAM on idle stream"}
+		}
+		sc.closeStream(f.streamID, true)
+		return nil
+	case framePriority:
+		if f.streamID == 0 {
+			return connError{errCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.payload) != 5 {
+			return streamError{f.streamID, errCodeFrameSize}
+		}
+		return nil
+	case frameGoAway:
+		if f.streamID != 0 {
+			return connError{errCodeProtocol, "GOAWAY on a stream"}
+		}
+		sc.mu.Lock()
+		sc.goingAway = true
+		sc.mu.Unlock()
+		return nil
+	case framePushPromise:
+		return connError{errCodeProtocol, "clients can't push"}
+	default:
+		// Unknown frame types must be ignored.
+		return nil
+	}
+}
+
+func (sc *serverConn) processSettings(f *frame) error {
+	if f.streamID != 0 {
+		return connError{errCodeProtocol, "SETTINGS on a stream"}
+	}
+	if f.has(flagAck) {
+		if len(f.payload) != 0 {
+			return connError{errCodeFrameSize, "SETTINGS ack with payload"}
+		}
+		return nil
+	}
+	settings, err := parseSettings(f.payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+func (sc *serverConn) applySettings(settings []setting) error {
+	for _, s := range settings {
+		switch s.id {
+		case settingHeaderTableSize:
+			sc.writeMu.Lock()
+			sc.enc.setMaxTableSize(int(s.value))
+			sc.writeMu.Unlock()
+		case settingEnablePush:
+			if s.value > 1 {
+				return connError{errCodeProtocol, "bad SETTINGS_ENABLE_PUSH"}
+			}
+		case settingInitialWindowSize:
+			if s.value > maxWindowSize {
+				return connError{errCodeFlowControl, "bad SETTINGS_INITIAL_WINDOW_SIZE"}
+			}
+			sc.mu.Lock()
+			delta := int64(s.value) - sc.peerInitialWindow
+			sc.peerInitialWindow = int64(s.value)
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					sc.mu.Unlock()
+					return connError{errCodeFlowControl, "stream window overflow"}
+				}
+			}
+			sc.cond.Broadcast()
+			sc.mu.Unlock()
+		case settingMaxFrameSize:
+			if s.value < defaultMaxFrameSize || s.value > maxAllowedFrameSize {
+				return connError{errCodeProtocol, "bad SETTINGS_MAX_FRAME_SIZE"}
+			}
+			sc.mu.Lock()
+			sc.peerMaxFrameSize = int(s.value)
+			sc.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f *frame) error {
+	if f.streamID == 0 {
+		return connError{errCodeProtocol, "HEADERS on stream 0"}
+	}
+	block, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if f.has(flagPriority) {
+		if len(block) < 5 {
+			return connError{errCodeFrameSize, "short HEADERS priority"}
+		}
+		block = block[5:]
+	}
+	if !f.has(flagEndHeaders) {
+		sc.pendingStream = f.streamID
+		sc.pendingEndStream = f.has(flagEndStream)
+		sc.pendingBlock = append([]byte{}, block...)
+		return nil
+	}
+	return sc.processHeaderBlock(f.streamID, block, f.has(flagEndStream))
+}
+
+func (sc *serverConn) processHeaderBlock(streamID uint32, block []byte, endStream bool) error {
+	// The block is decoded even for streams we refuse, to keep the HPACK
+	// table in sync with the client.
+	fields, err := sc.dec.decode(block)
+	if errors.Is(err, errHeaderLimit) {
+		return connError{errCodeEnhanceYourCalm, err.Error()}
+	}
+	if err != nil {
+		return connError{errCodeCompression, err.Error()}
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[streamID]
+	sc.mu.Unlock()
+	if st != nil {
+		if st.tooLarge {
+			return nil
+		}
+		// Trailers end the request body.
+		if st.remoteClosed || !endStream {
+			return streamError{streamID, errCodeProtocol}
+		}
+		sc.dispatch(st)
+		return nil
+	}
+
+	if streamID%2 == 0 || streamID <= sc.lastStreamID {
+		return connError{errCodeProtocol, "bad stream ID"}
+	}
+	sc.lastStreamID = streamID
+
+	sc.mu.Lock()
+	refused := sc.goingAway || uint32(len(sc.streams)) >= sc.srv.maxConcurrentStreams()
+	sc.mu.Unlock()
+	if refused {
+		return streamError{streamID, errCodeRefusedStream}
+	}
+
+	req, err := newRequest(fields)
+	if err != nil {
+		return streamError{streamID, errCodeProtocol}
+	}
+	req.RemoteAddr = sc.conn.RemoteAddr().String()
+	st = sc.newStream(streamID, req)
+	if length, ok := req.Headers.Get("content-length"); ok {
+		if n, err := strconv.Atoi(length); err == nil && n > sc.srv.maxBodySize() {
+			sc.refuseBody(st)
+			return nil
+		}
+	}
+	if endStream {
+		sc.dispatch(st)
+	}
+	return nil
+}
+
+// newRequest maps a decoded header list onto a request, checking the
+// rules of RFC 9113, section 8.
+func newRequest(fields []headerField) (*request.Request, error) {
+	req := &request.Request{
+		RequestLine: request.RequestLine{HttpVersion: "2"},
+		Headers:     headers.NewHeaders(),
+	}
+	var authority, scheme, path string
+	regular := false
+	for _, f := range fields {
+		if strings.ToLower(f.name) != f.name {
+			return nil, errors.New("uppercase header name")
+		}
+		if !strings.HasPrefix(f.name, ":") {
+			regular = true
+			switch f.name {
+			case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+				return nil, errors.New("connection-specific header")
+			case "te":
+				if f.value != "trailers" {
+					return nil, errors.New("bad TE header")
+				}
+			case "cookie":
+				if prev, ok := req.Headers.Get("cookie"); ok {
+					req.Headers.Replace("cookie", prev+"; "+f.value)
+					continue
+				}
+			}
+			req.Headers.Set(f.name, f.value)
+			continue
+		}
+
+		if regular {
+			return nil, errors.New("pseudo-header after regular header")
+		}
+		var dst *string
+		switch f.name {
+		case ":method":
+			dst = &req.RequestLine.Method
+		case ":scheme":
+			dst = &scheme
+		case ":authority":
+			dst = &authority
+		case ":path":
+			dst = &path
+		default:
+			return nil, errors.New("unknown pseudo-header")
+		}
+		if *dst != "" {
+			return nil, errors.New("duplicate pseudo-header")
+		}
+		*dst = f.value
+	}
+
+	if req.RequestLine.Method == "CONNECT" {
+		if authority == "" || scheme != "" || path != "" {
+			return nil, errors.New("bad CONNECT request")
+		}
+		path = authority
+	} else if req.RequestLine.Method == "" || scheme == "" || path == "" {
+		return nil, errors.New("missing pseudo-header")
+	}
+	req.RequestLine.RequestTarget = path
+	if _, ok := req.Headers.Get("host"); !ok && authority != "" {
+		req.Headers.Set("host", authority)
+	}
+	return req, nil
+}
+
+func (sc *serverConn) processData(f *frame) error {
+	if f.streamID == 0 {
+		return connError{errCodeProtocol, "DATA on stream 0"}
+	}
+	sc.mu.Lock()
+	st := sc.streams[f.streamID]
+	sc.mu.Unlock()
+
+	// The connection window is refilled right away: the data is either
+	// buffered within a stream's MaxBodySize or dropped.
+	if len(f.payload) > 0 {
+		if err := sc.writeWindowUpdate(0, len(f.payload)); err != nil {
+			return err
+		}
+	}
+	if st != nil && st.tooLarge {
+		return nil
+	}
+
+	if st == nil || st.remoteClosed {
+		if f.streamID > sc.lastStreamID {
+			return connError{errCodeProtocol, "DATA on idle stream"}
+		}
+		return streamError{f.streamID, errCodeStreamClosed}
+	}
+	data, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if len(st.body)+len(data) > sc.srv.maxBodySize() {
+		sc.refuseBody(st)
+		return nil
+	}
+	st.body = append(st.body, data...)
+	if f.has(flagEndStream) {
+		sc.dispatch(st)
+		return nil
+	}
+	// The stream window is only refilled for a body still under the
+	// limit, so a client can't get more than a window past it.
+	if len(f.payload) > 0 {
+		return sc.writeWindowUpdate(f.streamID, len(f.payload))
+	}
+	return nil
+}
+
+func (sc *serverConn) writeWindowUpdate(streamID uint32, n int) error {
+	return sc.writeFrame(frameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(n)))
+}
+
+// refuseBody answers a request whose body is over MaxBodySize with 413,
+// dropping what the client still sends for it.
+func (sc *serverConn) refuseBody(st *stream) {
+	st.tooLarge = true
+	st.body = nil
+	sc.dispatch(st)
+}
+
+func (sc *serverConn) processWindowUpdate(f *frame) error {
+	if len(f.payload) != 4 {
+		return connError{errCodeFrameSize, "bad WINDOW_UPDATE length"}
+	}
+	increment := int64(binary.BigEndian.Uint32(f.payload) & streamIDMask)
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.streamID == 0 {
+		if increment == 0 {
+			return connError{errCodeProtocol, "zero WINDOW_UPDATE"}
+		}
+		sc.sendWindow += increment
+		if sc.sendWindow > maxWindowSize {
+			return connError{errCodeFlowControl, "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	st := sc.streams[f.streamID]
+	if st == nil {
+		if f.streamID > sc.lastStreamID {
+			return connError{errCodeProtocol, "WINDOW_UPDATE on idle stream"}
+		}
+		return nil
+	}
+	if increment == 0 {
+		return streamError{f.streamID, errCodeProtocol}
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return streamError{f.streamID, errCodeFlowControl}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) newStream(id uint32, req *request.Request) *stream {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st := &stream{sc: sc, id: id, req: req, sendWindow: sc.peerInitialWindow}
+	sc.streams[id] = st
+	return st
+}
+
+// dispatch runs the handler once the request has been fully received.
+func (sc *serverConn) dispatch(st *stream) {
+	st.remoteClosed = true
+	if len(st.body) > 0 {
+		st.req.Body = st.body
+		st.req.Headers.Replace("Content-Length", strconv.Itoa(len(st.body)))
+	}
+	sc.mu.Lock()
+	st.dispatched = true
+	sc.mu.Unlock()
+
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		newWriter := sc.srv.NewWriter
+		if newWriter == nil {
+			newWriter = response.NewFramedWriter
+		}
+		w := newWriter(st)
+		w.SetRequestMethod(st.req.RequestLine.Method)
+		if st.tooLarge {
+			message := []byte("request body is too large")
+			w.WriteStatusLine(response.ContentTooLarge)
+			w.WriteHeaders(response.GetDefaultHeaders(len(message)))
+			w.WriteBody(message)
+		} else {
+			sc.srv.Handler(w, st.req)
+		}
+		w.Finish()
+		st.finish()
+		if st.tooLarge {
+			// The client may still be sending the body.
+			sc.resetStream(st.id, errCodeNo)
+			return
+		}
+		sc.closeStream(st.id, false)
+	}()
+}
+
+func (sc *serverConn) closeStream(id uint32, reset bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if st, ok := sc.streams[id]; ok {
+		st.reset = st.reset || reset
+		delete(sc.streams, id)
+		sc.cond.Broadcast()
+		if st.dispatched {
+			sc.setReadDeadline()
+		}
+	}
+}
+
+func (sc *serverConn) resetStream(id uint32, code errCode) {
+	sc.closeStream(id, true)
+	sc.writeFrame(frameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+func (sc *serverConn) goAway(code errCode) {
+	payload := binary.BigEndian.AppendUint32(nil, sc.lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	sc.writeFrame(frameGoAway, 0, 0, payload)
+}
+
+func (sc *serverConn) writeFrame(typ frameType, flags uint8, streamID uint32, payload []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	return writeFrame(sc.conn, typ, flags, streamID, payload)
+}
+
+// writeHeaderBlock encodes fields and sends them as HEADERS followed by
+// as many CONTINUATION frames as the peer's frame size requires.
+func (sc *serverConn) writeHeaderBlock(streamID uint32, fields []headerField, endStream bool) error {
+	sc.mu.Lock()
+	maxFrame := sc.peerMaxFrameSize
+	sc.mu.Unlock()
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	block := sc.enc.encode(nil, fields)
+
+	typ := frameHeaders
+	var flags uint8
+	if endStream {
+		flags |= flagEndStream
+	}
+	for {
+		chunk := block
+		if len(chunk) > maxFrame {
+			chunk = chunk[:maxFrame]
+		}
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			flags |= flagEndHeaders
+		}
+		if err := writeFrame(sc.conn, typ, flags, streamID, chunk); err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			return nil
+		}
+		typ, flags = frameContinuation, 0
+	}
+}
+
+// stream implements response.Framer for one request.
+type stream struct {
+	sc  *serverConn
+	id  uint32
+	req *request.Request
+
+	// Owned by the read loop until dispatch.
+	body         []byte
+	remoteClosed bool
+	tooLarge     bool
+
+	// Guarded by sc.mu.
+	sendWindow int64
+	reset      bool
+	dispatched bool
+
+	// Owned by the handler goroutine.
+	headersSent bool
+	ended       bool
+}
+
+func (st *stream) WriteHeaders(code response.StatusCode, h headers.Headers) error {
+	st.headersSent = true
+	fields := []headerField{{":status", strconv.Itoa(int(code))}}
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fields = append(fields, headerField{strings.ToLower(key), h[key]})
+	}
+	return st.sc.writeHeaderBlock(st.id, fields, false)
+}
+
+func (st *stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n, err := st.awaitWindow(len(p))
+		if err != nil {
+			return written, err
+		}
+		if err := st.sc.writeFrame(frameData, 0, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// awaitWindow blocks until the peer can take some of want bytes and
+// reserves them.
+func (st *stream) awaitWindow(want int) (int, error) {
+	sc := st.sc
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for {
+		if st.reset {
+			return 0, ErrStreamReset
+		}
+		if sc.closed {
+			return 0, net.ErrClosed
+		}
+		if sc.sendWindow > 0 && st.sendWindow > 0 {
+			break
+		}
+		sc.cond.Wait()
+	}
+	n := int64(want)
+	n = min(n, sc.sendWindow, st.sendWindow, int64(sc.peerMaxFrameSize))
+	sc.sendWindow -= n
+	st.sendWindow -= n
+	return int(n), nil
+}
+
+func (st *stream) WriteTrailers(h headers.Headers) error {
+	if len(h) == 0 {
+		return nil
+	}
+	fields := make([]headerField, 0, len(h))
+	for key, value := range h {
+		fields = append(fields, headerField{strings.ToLower(key), value})
+	}
+	st.ended = true
+	return st.sc.writeHeaderBlock(st.id, fields, true)
+}
+
+// Abort resets the stream when its response is aborted.
+func (st *stream) Abort() {
+	st.sc.resetStream(st.id, errCodeInternal)
+}
+
+// finish ends the stream after the handler returned.
+func (st *stream) finish() {
+	st.sc.mu.Lock()
+	reset := st.reset
+	st.sc.mu.Unlock()
+	if reset || st.ended {
+		return
+	}
+	if !st.headersSent {
+		st.sc.writeHeaderBlock(st.id, []headerField{{":status", "200"}, {"content-length", "0"}}, true)
+		return
+	}
+	st.sc.writeFrame(frameData, flagEndStream, st.id, nil)
+}
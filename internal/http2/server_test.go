@@ -0,0 +1,415 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler Handler) string {
+	t.Helper()
+	return serve(t, &Server{Handler: handler, MaxConcurrentStreams: 8})
+}
+
+func serve(t *testing.T, srv *Server) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.ServeConn(conn, nil)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// testClient is a minimal HTTP/2 client speaking through the same codec.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	enc  *encoder
+	dec  *decoder
+}
+
+type testResponse struct {
+	fields   map[string]string
+	body     []byte
+	trailers map[string]string
+	reset    bool
+}
+
+func dial(t *testing.T, addr string, settings ...setting) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn), enc: newEncoder(), dec: newDecoder(0)}
+
+	_, err = conn.Write([]byte(ClientPreface))
+	require.NoError(t, err)
+	c.write(frameSettings, 0, 0, appendSettings(nil, settings...))
+
+	f := c.read()
+	require.Equal(t, frameSettings, f.typ)
+	c.write(frameSettings, flagAck, 0, nil)
+	return c
+}
+
+func (c *testClient) write(typ frameType, flags uint8, streamID uint32, payload []byte) {
+	c.t.Helper()
+	require.NoError(c.t, writeFrame(c.conn, typ, flags, streamID, payload))
+}
+
+func (c *testClient) read() *frame {
+	c.t.Helper()
+	f, err := readFrame(c.r, maxAllowedFrameSize)
+	require.NoError(c.t, err)
+	return f
+}
+
+func (c *testClient) request(streamID uint32, method, path string, body []byte) {
+	c.t.Helper()
+	block := c.enc.encode(nil, []headerField{
+		{":method", method}, {":scheme", "http"}, {":path", path}, {":authority", "localhost"},
+	})
+	if body == nil {
+		c.write(frameHeaders, flagEndHeaders|flagEndStream, streamID, block)
+		return
+	}
+	c.write(frameHeaders, flagEndHeaders, streamID, block)
+	c.write(frameData, flagEndStream, streamID, body)
+}
+
+// responses reads frames until n streams have ended. Received data is
+// acknowledged right away.
+func (c *testClient) responses(n int) map[uint32]*testResponse {
+	c.t.Helper()
+	out := map[uint32]*testResponse{}
+	get := func(id uint32) *testResponse {
+		if out[id] == nil {
+			out[id] = &testResponse{}
+		}
+		return out[id]
+	}
+	done := 0
+	for done < n {
+		f := c.read()
+		switch f.typ {
+		case frameHeaders:
+			fields, err := c.dec.decode(f.payload)
+			require.NoError(c.t, err)
+			m := map[string]string{}
+			for _, field := range fields {
+				m[field.name] = field.value
+			}
+			if r := get(f.streamID); r.fields == nil {
+				r.fields = m
+			} else {
+				r.trailers = m
+			}
+		case frameData:
+			get(f.streamID).body = append(get(f.streamID).body, f.payload...)
+			if len(f.payload) > 0 {
+				increment := binary.BigEndian.AppendUint32(nil, uint32(len(f.payload)))
+				c.write(frameWindowUpdate, 0, 0, increment)
+				c.write(frameWindowUpdate, 0, f.streamID, increment)
+			}
+		case frameRSTStream:
+			get(f.streamID).reset = true
+			done++
+			continue
+		default:
+			continue
+		}
+		if f.has(flagEndStream) {
+			done++
+		}
+	}
+	return out
+}
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	if req.RequestLine.RequestTarget == "/slow" {
+		time.Sleep(100 * time.Millisecond)
+	}
+	message := []byte(fmt.Sprintf("%s %s v%s host=%s body=%s",
+		req.RequestLine.Method, req.RequestLine.RequestTarget, req.RequestLine.HttpVersion,
+		req.Headers["host"], req.Body))
+	w.WriteStatusLine(response.OK)
+	h := response.GetDefaultHeaders(len(message))
+	h.Set("X-Stream", "yes")
+	w.WriteHeaders(h)
+	w.WriteBody(message)
+}
+
+func TestRequests(t *testing.T) {
+	addr := startServer(t, echoHandler)
+	c := dial(t, addr)
+
+	// Test: Simple GET
+	c.request(1, "GET", "/hello?x=1", nil)
+	resp := c.responses(1)[1]
+	assert.Equal(t, "200", resp.fields[":status"])
+	assert.Equal(t, "yes", resp.fields["x-stream"])
+	assert.NotContains(t, resp.fields, "connection")
+	assert.Equal(t, "GET /hello?x=1 v2 host=localhost body=", string(resp.body))
+
+	// Test: Request body in DATA frames
+	c.request(3, "POST", "/submit", []byte("payload"))
+	resp = c.responses(1)[3]
+	assert.Equal(t, "POST /submit v2 host=localhost body=payload", string(resp.body))
+
+	// Test: Streams are multiplexed, a slow one doesn't hold back others
+	c.request(5, "GET", "/slow", nil)
+	c.request(7, "GET", "/fast", nil)
+	f := c.read()
+	for f.typ != frameHeaders {
+		f = c.read()
+	}
+	assert.Equal(t, uint32(7), f.streamID)
+	c.responses(2)
+
+	// Test: Header block split over CONTINUATION frames
+	block := c.enc.encode(nil, []headerField{
+		{":method", "GET"}, {":scheme", "http"}, {":path", "/split"}, {":authority", "localhost"},
+	})
+	c.write(frameHeaders, flagEndStream, 9, block[:3])
+	c.write(frameContinuation, 0, 9, block[3:6])
+	c.write(frameContinuation, flagEndHeaders, 9, block[6:])
+	resp = c.responses(1)[9]
+	assert.Equal(t, "GET /split v2 host=localhost body=", string(resp.body))
+
+	// Test: PING is acknowledged
+	c.write(framePing, 0, 0, []byte("12345678"))
+	f = c.read()
+	assert.Equal(t, framePing, f.typ)
+	assert.True(t, f.has(flagAck))
+	assert.Equal(t, "12345678", string(f.payload))
+
+	// Test: Missing pseudo-header resets the stream
+	block = c.enc.encode(nil, []headerField{{":method", "GET"}, {":scheme", "http"}})
+	c.write(frameHeaders, flagEndHeaders|flagEndStream, 11, block)
+	assert.True(t, c.responses(1)[11].reset)
+}
+
+func TestTrailers(t *testing.T) {
+	addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Checksum")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("part one, "))
+		w.WriteChunkedBody([]byte("part two"))
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Checksum", "abc")
+		w.WriteTrailers(trailers)
+	})
+	c := dial(t, addr)
+
+	// Test: Chunked responses become DATA frames and trailers a final HEADERS
+	c.request(1, "GET", "/", nil)
+	resp := c.responses(1)[1]
+	assert.NotContains(t, resp.fields, "transfer-encoding")
+	assert.Equal(t, "part one, part two", string(resp.body))
+	assert.Equal(t, map[string]string{"x-checksum": "abc"}, resp.trailers)
+}
+
+func TestFlowControl(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 10000)
+	addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	})
+
+	// Test: Server stops at the client's stream window
+	c := dial(t, addr, setting{settingInitialWindowSize, 1000})
+	c.request(1, "GET", "/", nil)
+	received := 0
+	for received < 1000 {
+		f := c.read()
+		if f.typ == frameData {
+			assert.False(t, f.has(flagEndStream))
+			received += len(f.payload)
+		}
+	}
+	assert.Equal(t, 1000, received)
+	c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := readFrame(c.r, maxAllowedFrameSize)
+	assert.Error(t, err)
+
+	// Test: WINDOW_UPDATE lets the rest through
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	c.write(frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, 1000))
+	c.write(frameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 1000))
+	resp := c.responses(1)[1]
+	assert.Equal(t, body[1000:], resp.body)
+
+	// Test: Frames never exceed the default maximum size
+	c2 := dial(t, addr)
+	c2.request(1, "GET", "/", nil)
+	total := 0
+	for total < 65535 {
+		f := c2.read()
+		if f.typ == frameData {
+			assert.LessOrEqual(t, len(f.payload), defaultMaxFrameSize)
+			total += len(f.payload)
+		}
+	}
+	assert.Equal(t, 65535, total)
+}
+
+func TestBodyLimit(t *testing.T) {
+	addr := serve(t, &Server{Handler: echoHandler, MaxBodySize: 1000, IdleTimeout: 200 * time.Millisecond})
+	c := dial(t, addr)
+	headersOnly := func(streamID uint32, fields ...headerField) {
+		block := c.enc.encode(nil, append([]headerField{
+			{":method", "POST"}, {":scheme", "http"}, {":path", "/upload"}, {":authority", "localhost"},
+		}, fields...))
+		c.write(frameHeaders, flagEndHeaders, streamID, block)
+	}
+
+	// Test: A declared length over the limit is answered before the body
+	headersOnly(1, headerField{"content-length", "5000"})
+	resp := c.responses(1)[1]
+	assert.Equal(t, "413", resp.fields[":status"])
+
+	// Test: The stream window is refilled while the body is under the
+	// limit, and a body growing past it is answered with 413 and reset
+	headersOnly(3)
+	c.write(frameData, 0, 3, make([]byte, 600))
+	var updates []uint32
+	for len(updates) < 2 {
+		f := c.read()
+		if f.typ == frameWindowUpdate {
+			updates = append(updates, f.streamID)
+		}
+	}
+	assert.ElementsMatch(t, []uint32{0, 3}, updates)
+	c.write(frameData, 0, 3, make([]byte, 600))
+	var reset uint32
+	for {
+		f := c.read()
+		if f.typ == frameHeaders {
+			fields, err := c.dec.decode(f.payload)
+			require.NoError(t, err)
+			assert.Equal(t, headerField{":status", "413"}, fields[0])
+		}
+		if f.typ == frameRSTStream {
+			reset = binary.BigEndian.Uint32(f.payload)
+			break
+		}
+	}
+	assert.Equal(t, uint32(errCodeNo), reset)
+
+	// Test: Data still arriving for the refused stream is dropped
+	c.write(frameData, flagEndStream, 3, make([]byte, 100))
+	c.request(5, "POST", "/after", []byte("ok"))
+	f := c.read()
+	for f.typ != frameHeaders {
+		f = c.read()
+	}
+	assert.Equal(t, uint32(5), f.streamID)
+	c.dec.decode(f.payload)
+	resp = c.responses(1)[5]
+	assert.Equal(t, "POST /after v2 host=localhost body=ok", string(resp.body))
+
+	// Test: An idle connection is closed with GOAWAY
+	start := time.Now()
+	for {
+		f := c.read()
+		if f.typ == frameGoAway {
+			assert.Equal(t, uint32(errCodeNo), binary.BigEndian.Uint32(f.payload[4:]))
+			break
+		}
+	}
+	assert.Less(t, time.Since(start), 2*time.Second)
+	_, err := readFrame(c.r, maxAllowedFrameSize)
+	assert.Error(t, err)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		<-release
+		echoHandler(w, req)
+	})
+	c := dial(t, addr)
+
+	// Test: Streams beyond MaxConcurrentStreams are refused
+	for i := 0; i < 9; i++ {
+		c.request(uint32(2*i+1), "GET", "/"+strconv.Itoa(i), nil)
+	}
+	f := c.read()
+	for f.typ != frameRSTStream {
+		f = c.read()
+	}
+	assert.Equal(t, uint32(17), f.streamID)
+	assert.Equal(t, uint32(errCodeRefusedStream), binary.BigEndian.Uint32(f.payload))
+
+	close(release)
+	assert.Len(t, c.responses(8), 8)
+}
+
+func TestConnectionErrors(t *testing.T) {
+	addr := startServer(t, echoHandler)
+
+	readGoAway := func(c *testClient) errCode {
+		for {
+			f := c.read()
+			if f.typ == frameGoAway {
+				return errCode(binary.BigEndian.Uint32(f.payload[4:]))
+			}
+		}
+	}
+
+	// Test: Even stream IDs belong to the server
+	c := dial(t, addr)
+	c.request(2, "GET", "/", nil)
+	assert.Equal(t, errCodeProtocol, readGoAway(c))
+
+	// Test: Corrupt header block
+	c = dial(t, addr)
+	c.write(frameHeaders, flagEndHeaders|flagEndStream, 1, []byte{0xff, 0xff})
+	assert.Equal(t, errCodeCompression, readGoAway(c))
+
+	// Test: Oversized frame
+	c = dial(t, addr)
+	c.write(frameData, 0, 1, make([]byte, defaultMaxFrameSize+1))
+	assert.Equal(t, errCodeFrameSize, readGoAway(c))
+
+	// Test: Window overflow
+	c = dial(t, addr)
+	c.write(frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, maxWindowSize))
+	assert.Equal(t, errCodeFlowControl, readGoAway(c))
+
+	// Test: Connection must open with SETTINGS
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(ClientPreface))
+	writeFrame(conn, framePing, 0, 0, make([]byte, 8))
+	c = &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	assert.Equal(t, errCodeProtocol, readGoAway(c))
+}
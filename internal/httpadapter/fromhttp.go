@@ -0,0 +1,283 @@
+package httpadapter
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/ar3ty/httpfromtcp/internal/server"
+)
+
+// bufferSize is how much of the body is held back before the headers are
+// sent, so that short responses get a Content-Length like net/http gives
+// them.
+const bufferSize = 2048
+
+// FromHTTP runs h as a server.Handler. The response is framed the way
+// net/http frames it: bodies that end within the first 2KiB, without a
+// call to Flush, get a Content-Length, the others are chunked. Trailers
+// are declared with the Trailer header or set with http.TrailerPrefix.
+// Interim 1xx responses other than 101 are not sent.
+func FromHTTP(h http.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		r, err := newHTTPRequest(req)
+		if err != nil {
+			response.WriteError(w, response.BadRequest, nil)
+			return
+		}
+		rw := &responseWriter{w: w, header: http.Header{}, head: req.RequestLine.Method == "HEAD"}
+		h.ServeHTTP(rw, r)
+		rw.finish()
+	}
+}
+
+func newHTTPRequest(req *request.Request) (*http.Request, error) {
+	target := req.RequestLine.RequestTarget
+	var u *url.URL
+	var err error
+	if req.RequestLine.Method == "CONNECT" && !strings.HasPrefix(target, "/") {
+		u = &url.URL{Host: target}
+	} else {
+		u, err = url.ParseRequestURI(target)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := &http.Request{
+		Method:     req.RequestLine.Method,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		RemoteAddr: req.RemoteAddr,
+		RequestURI: target,
+		TLS:        req.TLS,
+	}
+	if req.Proto == "h2" || req.Proto == "h2c" {
+		r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+	}
+	for key, value := range req.Headers {
+		r.Header.Set(key, value)
+	}
+	r.Host = r.Header.Get("Host")
+	r.Header.Del("Host")
+	if u.Host != "" {
+		r.Host = u.Host
+	}
+	if len(req.Body) > 0 {
+		r.Body = io.NopCloser(bytes.NewReader(req.Body))
+	}
+	r.ContentLength = int64(len(req.Body))
+	return r, nil
+}
+
+// responseWriter is the http.ResponseWriter handed to wrapped handlers.
+type responseWriter struct {
+	w      *response.Writer
+	header http.Header
+	head   bool
+
+	code int
+	// sent is the header as it was when WriteHeader was called; later
+	// changes only matter for trailers.
+	sent        http.Header
+	wroteHeader bool
+	committed   bool
+	noBody      bool
+	chunked     bool
+	// buf holds the body until the headers are sent; for HEAD requests
+	// only its length matters.
+	buf     []byte
+	written int
+	// trailers are the names declared in the Trailer header.
+	trailers []string
+	err      error
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		return
+	}
+	rw.wroteHeader = true
+	rw.code = code
+	rw.sent = rw.header.Clone()
+	rw.noBody = code == http.StatusNoContent || code == http.StatusNotModified || code < 200
+	for _, value := range rw.sent["Trailer"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				rw.trailers = append(rw.trailers, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.noBody {
+		return 0, http.ErrBodyNotAllowed
+	}
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	rw.written += len(p)
+	if rw.head {
+		if !rw.committed {
+			rw.buf = append(rw.buf, p[:min(len(p), bufferSize-len(rw.buf))]...)
+		}
+		return len(p), nil
+	}
+	if !rw.committed {
+		rw.buf = append(rw.buf, p...)
+		if len(rw.buf) > bufferSize {
+			rw.commit(false)
+			rw.flushBuffer()
+		}
+		return len(p), rw.err
+	}
+	return rw.writeBody(p)
+}
+
+// Flush sends the headers and whatever body is held back. Responses
+// flushed before they end are chunked.
+func (rw *responseWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.committed {
+		rw.commit(false)
+		rw.flushBuffer()
+	}
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buffered, err := rw.w.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn))
+	return conn, bufio.NewReadWriter(r, bufio.NewWriter(conn)), nil
+}
+
+// commit sends the status line and headers. With final set the whole
+// body is in buf and its length can be announced.
+func (rw *responseWriter) commit(final bool) {
+	rw.committed = true
+	h := headers.NewHeaders()
+	for key, values := range rw.sent {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			continue
+		}
+		for _, value := range values {
+			h.Set(key, value)
+		}
+	}
+	_, hasType := rw.sent["Content-Type"]
+	if !hasType && !rw.noBody && len(rw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(rw.buf))
+	}
+
+	_, hasLength := rw.sent["Content-Length"]
+	switch {
+	case rw.noBody || hasLength || (rw.head && rw.written == 0):
+	case final && len(rw.trailers) == 0 && !rw.hasPrefixedTrailers():
+		h.Replace("Content-Length", strconv.Itoa(rw.written))
+	case rw.head:
+	default:
+		rw.chunked = true
+		h.Replace("Transfer-Encoding", "chunked")
+	}
+
+	if err := rw.w.WriteStatusLine(response.StatusCode(rw.code)); err != nil {
+		rw.err = err
+		return
+	}
+	if err := rw.w.WriteHeaders(h); err != nil {
+		rw.err = err
+	}
+}
+
+func (rw *responseWriter) flushBuffer() {
+	if rw.head || len(rw.buf) == 0 || rw.err != nil {
+		rw.buf = nil
+		return
+	}
+	_, err := rw.writeBody(rw.buf)
+	rw.err = err
+	rw.buf = nil
+}
+
+func (rw *responseWriter) writeBody(p []byte) (int, error) {
+	if rw.head {
+		return len(p), nil
+	}
+	if rw.chunked {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return rw.w.WriteChunkedBody(p)
+	}
+	return rw.w.WriteBody(p)
+}
+
+func (rw *responseWriter) hasPrefixedTrailers() bool {
+	for key := range rw.header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// finish completes the response once the handler returned.
+func (rw *responseWriter) finish() {
+	if rw.w.Hijacked() {
+		return
+	}
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.committed {
+		rw.commit(true)
+		rw.flushBuffer()
+	}
+	if !rw.chunked || rw.err != nil {
+		return
+	}
+	if _, err := rw.w.WriteChunkedBodyDone(); err != nil {
+		return
+	}
+	trailers := headers.NewHeaders()
+	for _, name := range rw.trailers {
+		if value := rw.header.Get(name); value != "" {
+			trailers.Set(name, value)
+		}
+	}
+	for key, values := range rw.header {
+		if name, ok := strings.CutPrefix(key, http.TrailerPrefix); ok {
+			for _, value := range values {
+				trailers.Set(name, value)
+			}
+		}
+	}
+	rw.w.WriteTrailers(trailers)
+}
@@ -0,0 +1,240 @@
+package httpadapter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	nethttptest "net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/httptest"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/ar3ty/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exchange sends a raw request to addr and parses the response as it
+// came off the wire. Date and Connection are dropped as they differ
+// between the servers by design.
+func exchange(t *testing.T, addr, method, target string) *response.Response {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: localhost\r\nUser-Agent: test\r\n\r\n", method, target)
+	require.NoError(t, err)
+	resp, err := response.NewReader(conn).ReadResponse(method)
+	require.NoError(t, err)
+	resp.Headers.Delete("Date")
+	resp.Headers.Delete("Connection")
+	return resp
+}
+
+func assertSameResponse(t *testing.T, want, got *response.Response) {
+	t.Helper()
+	assert.Equal(t, want.StatusCode, got.StatusCode)
+	assert.Equal(t, want.Headers, got.Headers)
+	assert.Equal(t, want.Chunked, got.Chunked)
+	assert.Equal(t, string(want.Body), string(got.Body))
+	assert.Equal(t, want.Trailers, got.Trailers)
+}
+
+func conformanceHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/small", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<html><body>hello</body></html>")
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, strings.Repeat("0123456789", 500))
+	})
+	mux.HandleFunc("/flush", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "first ")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "second")
+	})
+	mux.HandleFunc("/trailers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "body")
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "yes")
+	})
+	mux.HandleFunc("/empty", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/length", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "fixed")
+	})
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s host=%s ua=%s", r.Method, r.URL.Path, r.URL.RawQuery, r.Host, r.UserAgent())
+	})
+	return mux
+}
+
+func TestFromHTTP(t *testing.T) {
+	h := conformanceHandler()
+	reference := nethttptest.NewServer(h)
+	defer reference.Close()
+	adapted, err := httptest.NewServer(FromHTTP(h))
+	require.NoError(t, err)
+	defer adapted.Close()
+	referenceAddr := strings.TrimPrefix(reference.URL, "http://")
+	adaptedAddr := adapted.Addr().String()
+
+	// Test: Wire output matches net/http
+	for _, tc := range []struct{ method, target string }{
+		{"GET", "/small"},
+		{"GET", "/large"},
+		{"GET", "/flush"},
+		{"GET", "/trailers"},
+		{"GET", "/empty"},
+		{"GET", "/length"},
+		{"HEAD", "/small"},
+		{"HEAD", "/empty"},
+		{"GET", "/echo?x=1"},
+		{"GET", "/missing"},
+	} {
+		t.Run(tc.method+tc.target, func(t *testing.T) {
+			assertSameResponse(t, exchange(t, referenceAddr, tc.method, tc.target),
+				exchange(t, adaptedAddr, tc.method, tc.target))
+		})
+	}
+
+	// Test: Short bodies get a length and a sniffed type, long ones are chunked
+	resp := exchange(t, adaptedAddr, "GET", "/small")
+	assert.Equal(t, "31", resp.Headers["content-length"])
+	assert.Equal(t, "text/html; charset=utf-8", resp.Headers["content-type"])
+	assert.True(t, exchange(t, adaptedAddr, "GET", "/large").Chunked)
+
+	// Test: Requests are translated
+	resp, err = httptest.Record(FromHTTP(h), httptest.NewRequest("GET", "/echo?a=b", nil, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "GET /echo a=b host=example.com ua=", string(resp.Body))
+
+	// Test: Request bodies are readable
+	resp, err = httptest.Record(FromHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d %s %s", r.ContentLength, body, r.Proto)
+	})), httptest.NewRequest("POST", "/", nil, []byte("payload")))
+	require.NoError(t, err)
+	assert.Equal(t, "7 payload HTTP/1.1", string(resp.Body))
+
+	// Test: Hijacking hands over the connection
+	hijacking, err := httptest.NewServer(FromHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("raw bytes")
+		brw.Flush()
+	})))
+	require.NoError(t, err)
+	defer hijacking.Close()
+	conn, err := net.Dial("tcp", hijacking.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "raw bytes", string(data))
+}
+
+func conformanceServerHandler(w *response.Writer, req *request.Request) {
+	switch req.RequestLine.RequestTarget {
+	case "/chunked":
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Checksum")
+		h.Set("Content-Type", "text/plain")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("part one, "))
+		w.WriteChunkedBody([]byte("part two"))
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Checksum", "abc")
+		w.WriteTrailers(trailers)
+	case "/missing":
+		message := []byte("not found")
+		w.WriteStatusLine(response.NotFound)
+		w.WriteHeaders(response.GetDefaultHeaders(len(message)))
+		w.WriteBody(message)
+	case "/untyped":
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "13")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("<html></html>"))
+	default:
+		message := []byte(fmt.Sprintf("%s %s v%s host=%s ua=%s", req.RequestLine.Method,
+			req.RequestLine.RequestTarget, req.RequestLine.HttpVersion, req.Headers["host"], req.Headers["user-agent"]))
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(message)))
+		w.WriteBody(message)
+	}
+}
+
+func TestToHTTP(t *testing.T) {
+	reference, err := httptest.NewServer(conformanceServerHandler)
+	require.NoError(t, err)
+	defer reference.Close()
+	mux := http.NewServeMux()
+	mux.Handle("/", ToHTTP(conformanceServerHandler))
+	mounted := nethttptest.NewServer(mux)
+	defer mounted.Close()
+	mountedAddr := strings.TrimPrefix(mounted.URL, "http://")
+
+	// Test: Wire output matches our server
+	for _, target := range []string{"/echo?x=1", "/chunked", "/missing", "/untyped"} {
+		t.Run(target, func(t *testing.T) {
+			assertSameResponse(t, exchange(t, reference.Addr().String(), "GET", target),
+				exchange(t, mountedAddr, "GET", target))
+		})
+	}
+
+	// Test: Bodies and protocol reach the handler
+	body := ""
+	mux.Handle("/post", ToHTTP(func(w *response.Writer, req *request.Request) {
+		body = fmt.Sprintf("%s %s %s", req.Body, req.Headers["content-length"], req.Proto)
+		w.WriteStatusLine(response.NoContent)
+		w.WriteHeaders(nil)
+	}))
+	resp, err := http.Post(mounted.URL+"/post", "text/plain", strings.NewReader("payload"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "payload 7 http/1.1", body)
+
+	// Test: Bodies over the limit are refused before the handler runs
+	body = ""
+	resp, err = http.Post(mounted.URL+"/post", "application/octet-stream",
+		bytes.NewReader(make([]byte, server.DefaultMaxDecodedBodySize+1)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Empty(t, body)
+
+	// Test: Round trip through both adapters
+	roundTrip, err := httptest.NewServer(FromHTTP(ToHTTP(conformanceServerHandler)))
+	require.NoError(t, err)
+	defer roundTrip.Close()
+	got, err := roundTrip.Client.Get(roundTrip.URL + "/chunked")
+	require.NoError(t, err)
+	assert.Equal(t, "part one, part two", string(got.Body))
+	assert.Equal(t, "abc", got.Trailers["x-checksum"])
+}
@@ -0,0 +1,126 @@
+package httpadapter
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/ar3ty/httpfromtcp/internal/server"
+)
+
+// ToHTTP runs h as an http.Handler, for mounting in a net/http mux. The
+// net/http server picks the framing: responses without Content-Length
+// are flushed on every write so they stream as chunks, and trailers are
+// passed on with http.TrailerPrefix. Request bodies are read whole before
+// h runs, so those over server.DefaultMaxDecodedBodySize are refused with
+// 413.
+func ToHTTP(h server.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, server.DefaultMaxDecodedBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(rw, "request body is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(rw, "couldn't read request body", http.StatusBadRequest)
+			return
+		}
+		req := newRequest(r, body)
+
+		f := &framer{rw: rw}
+		w := response.NewFramedWriter(f)
+		w.SetRequestMethod(r.Method)
+		if hijacker, ok := rw.(http.Hijacker); ok {
+			w.SetHijacker(func() (net.Conn, []byte, error) {
+				conn, brw, err := hijacker.Hijack()
+				if err != nil {
+					return nil, nil, err
+				}
+				buffered, _ := brw.Reader.Peek(brw.Reader.Buffered())
+				return conn, buffered, nil
+			})
+		}
+		h(w, req)
+		if !w.Hijacked() {
+			w.Finish()
+		}
+	})
+}
+
+func newRequest(r *http.Request, body []byte) *request.Request {
+	target := r.RequestURI
+	if target == "" {
+		target = r.URL.RequestURI()
+	}
+	req := &request.Request{
+		RequestLine: request.RequestLine{
+			HttpVersion:   "1.1",
+			RequestTarget: target,
+			Method:        r.Method,
+		},
+		Headers:    headers.NewHeaders(),
+		Body:       body,
+		RemoteAddr: r.RemoteAddr,
+		Proto:      "http/1.1",
+		TLS:        r.TLS,
+	}
+	if r.ProtoMajor == 2 {
+		req.RequestLine.HttpVersion = "2"
+		req.Proto = "h2c"
+		if r.TLS != nil {
+			req.Proto = "h2"
+		}
+	}
+	req.Headers.Set("Host", r.Host)
+	for key, values := range r.Header {
+		for _, value := range values {
+			req.Headers.Set(key, value)
+		}
+	}
+	if len(body) > 0 {
+		req.Headers.Replace("Content-Length", strconv.Itoa(len(body)))
+	}
+	return req
+}
+
+// framer hands a response.Writer's output to an http.ResponseWriter.
+type framer struct {
+	rw     http.ResponseWriter
+	stream bool
+}
+
+func (f *framer) WriteHeaders(code response.StatusCode, h headers.Headers) error {
+	header := f.rw.Header()
+	for key, value := range h {
+		header.Set(key, value)
+	}
+	if _, ok := h.Get("Content-Type"); !ok {
+		// The response goes out as the handler wrote it, unsniffed.
+		header["Content-Type"] = nil
+	}
+	_, hasLength := h.Get("Content-Length")
+	f.stream = !hasLength
+	f.rw.WriteHeader(int(code))
+	return nil
+}
+
+func (f *framer) Write(p []byte) (int, error) {
+	n, err := f.rw.Write(p)
+	if err != nil || !f.stream {
+		return n, err
+	}
+	return n, http.NewResponseController(f.rw).Flush()
+}
+
+func (f *framer) WriteTrailers(h headers.Headers) error {
+	for key, value := range h {
+		f.rw.Header().Set(http.TrailerPrefix+key, value)
+	}
+	return nil
+}
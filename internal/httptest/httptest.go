@@ -0,0 +1,120 @@
+package httptest
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/ar3ty/httpfromtcp/internal/client"
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/ar3ty/httpfromtcp/internal/server"
+)
+
+// RemoteAddr is the client address of requests built by NewRequest.
+const RemoteAddr = "192.0.2.1:1234"
+
+// NewRequest builds a parsed HTTP/1.1 request as the server would hand it
+// to a handler. The headers are copied; Host defaults to example.com and
+// Content-Length is set for a body.
+func NewRequest(method, target string, h headers.Headers, body []byte) *request.Request {
+	req := &request.Request{
+		RequestLine: request.RequestLine{
+			HttpVersion:   "1.1",
+			RequestTarget: target,
+			Method:        method,
+		},
+		Headers:    headers.NewHeaders(),
+		Body:       []byte{},
+		RemoteAddr: RemoteAddr,
+		Proto:      "http/1.1",
+	}
+	for key, value := range h {
+		req.Headers.Set(key, value)
+	}
+	if _, ok := req.Headers.Get("Host"); !ok {
+		req.Headers.Set("Host", "example.com")
+	}
+	if len(body) > 0 {
+		req.Body = append(req.Body, body...)
+		req.Headers.Replace("Content-Length", strconv.Itoa(len(body)))
+	}
+	return req
+}
+
+// Recorder keeps what a handler writes to Writer.
+type Recorder struct {
+	Writer *response.Writer
+	method string
+	buf    bytes.Buffer
+}
+
+// NewRecorder returns a recorder for a response to a request with the
+// given method, which decides whether the response may carry a body.
+func NewRecorder(method string) *Recorder {
+	r := &Recorder{method: method}
+	r.Writer = response.NewWriter(&r.buf)
+	r.Writer.SetRequestMethod(method)
+	return r
+}
+
+// Bytes returns the raw response written so far.
+func (r *Recorder) Bytes() []byte {
+	return r.buf.Bytes()
+}
+
+// Result finishes the response and parses it.
+func (r *Recorder) Result() (*response.Response, error) {
+	if err := r.Writer.Finish(); err != nil {
+		return nil, err
+	}
+	if r.buf.Len() == 0 {
+		return nil, fmt.Errorf("handler wrote no response")
+	}
+	return response.NewReader(bytes.NewReader(r.buf.Bytes())).ReadResponse(r.method)
+}
+
+// Record runs handler for req and returns the parsed response.
+func Record(handler server.Handler, req *request.Request) (*response.Response, error) {
+	rec := NewRecorder(req.RequestLine.Method)
+	handler(rec.Writer, req)
+	return rec.Result()
+}
+
+// Server is a server.Server listening on a loopback port.
+type Server struct {
+	*server.Server
+	// URL is the base URL of the server, without a trailing slash.
+	URL string
+	// Client is a client for the server whose pooled connections are
+	// closed with the server.
+	Client *client.Client
+}
+
+func NewServer(handler server.Handler) (*Server, error) {
+	return NewServerWithConfig(handler, server.Config{})
+}
+
+func NewServerWithConfig(handler server.Handler, config server.Config) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create listener: %v", err)
+	}
+	scheme := "http"
+	if config.TLSConfig != nil {
+		scheme = "https"
+	}
+	s := server.ServeListener(listener, handler, config)
+	return &Server{
+		Server: s,
+		URL:    scheme + "://" + s.Addr().String(),
+		Client: &client.Client{},
+	}, nil
+}
+
+func (s *Server) Close() error {
+	s.Client.CloseIdleConnections()
+	return s.Server.Close()
+}
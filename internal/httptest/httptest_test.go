@@ -0,0 +1,92 @@
+package httptest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/ar3ty/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	if req.RequestLine.RequestTarget == "/stream" {
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("one "))
+		w.WriteChunkedBody([]byte("two"))
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Count", "2")
+		w.WriteTrailers(trailers)
+		return
+	}
+	message := []byte(fmt.Sprintf("%s %s host=%s from=%s body=%s", req.RequestLine.Method,
+		req.RequestLine.RequestTarget, req.Headers["host"], req.RemoteAddr, req.Body))
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(message)))
+	w.WriteBody(message)
+}
+
+func TestRecord(t *testing.T) {
+	// Test: Request defaults
+	req := NewRequest("POST", "/submit", nil, []byte("data"))
+	assert.Equal(t, "example.com", req.Headers["host"])
+	assert.Equal(t, "4", req.Headers["content-length"])
+
+	// Test: Fixed-length response
+	resp, err := Record(echoHandler, req)
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, resp.StatusCode)
+	assert.Equal(t, "text/plain", resp.Headers["content-type"])
+	assert.Equal(t, "POST /submit host=example.com from="+RemoteAddr+" body=data", string(resp.Body))
+	assert.False(t, resp.Chunked)
+
+	// Test: Chunked response with trailers
+	resp, err = Record(echoHandler, NewRequest("GET", "/stream", nil, nil))
+	require.NoError(t, err)
+	assert.True(t, resp.Chunked)
+	assert.Equal(t, "one two", string(resp.Body))
+	assert.Equal(t, "2", resp.Trailers["x-count"])
+
+	// Test: HEAD responses are parsed without a body
+	resp, err = Record(echoHandler, NewRequest("HEAD", "/", nil, nil))
+	require.NoError(t, err)
+	assert.Empty(t, resp.Body)
+	assert.NotEmpty(t, resp.Headers["content-length"])
+
+	// Test: Given headers are kept
+	h := headers.NewHeaders()
+	h.Set("Host", "localhost")
+	resp, err = Record(echoHandler, NewRequest("GET", "/", h, nil))
+	require.NoError(t, err)
+	assert.Contains(t, string(resp.Body), "host=localhost")
+
+	// Test: A handler that writes nothing
+	_, err = Record(func(*response.Writer, *request.Request) {}, NewRequest("GET", "/", nil, nil))
+	assert.Error(t, err)
+}
+
+func TestServer(t *testing.T) {
+	s, err := NewServerWithConfig(echoHandler, server.Config{ServerName: "test"})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: The server answers on loopback
+	assert.Contains(t, s.URL, "http://127.0.0.1:")
+	resp, err := s.Client.Get(s.URL + "/path")
+	require.NoError(t, err)
+	assert.Equal(t, "test", resp.Headers["server"])
+	assert.Contains(t, string(resp.Body), "GET /path host=127.0.0.1:")
+
+	// Test: Chunked responses over the wire
+	resp, err = s.Client.Get(s.URL + "/stream")
+	require.NoError(t, err)
+	assert.Equal(t, "one two", string(resp.Body))
+	assert.Equal(t, "2", resp.Trailers["x-count"])
+}
@@ -0,0 +1,329 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+)
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets suit durations in seconds of typical requests.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// Registry holds metrics and writes them in the Prometheus text
+// exposition format, in the order they were registered.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	byName  map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{byName: map[string]metric{}}
+}
+
+type metric interface {
+	base() *vec
+	write(b *bytes.Buffer)
+}
+
+// Counter registers a counter. Registering a name again returns the
+// metric already registered, which must be of the same kind and have the
+// same labels.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return r.register(&Counter{newVec(name, help, "counter", labels)}).(*Counter)
+}
+
+// Gauge registers a gauge, see Counter.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return r.register(&Gauge{newVec(name, help, "gauge", labels)}).(*Gauge)
+}
+
+// Histogram registers a histogram with the given upper bounds, in
+// increasing order, or DefaultBuckets if nil. See Counter.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) || slices.Contains(labels, "le") {
+		panic(fmt.Sprintf("metrics: invalid histogram %s", name))
+	}
+	h := &Histogram{newVec(name, help, "histogram", labels), slices.Clone(buckets)}
+	return r.register(h).(*Histogram)
+}
+
+func (r *Registry) register(m metric) metric {
+	v := m.base()
+	if !metricName.MatchString(v.name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", v.name))
+	}
+	for _, label := range v.labels {
+		if !labelName.MatchString(label) || strings.HasPrefix(label, "__") {
+			panic(fmt.Sprintf("metrics: invalid label name %q", label))
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.byName[v.name]; ok {
+		e := existing.base()
+		same := e.kind == v.kind && slices.Equal(e.labels, v.labels)
+		if h, ok := m.(*Histogram); ok && same {
+			same = slices.Equal(h.buckets, existing.(*Histogram).buckets)
+		}
+		if !same {
+			panic(fmt.Sprintf("metrics: %s registered twice with different definitions", v.name))
+		}
+		return existing
+	}
+	r.byName[v.name] = m
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// WriteTo writes all metrics in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+	var b bytes.Buffer
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	return b.WriteTo(w)
+}
+
+// Handler answers GET and HEAD requests with the metrics of r.
+func (r *Registry) Handler() func(w *response.Writer, req *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		method := req.RequestLine.Method
+		if method != "GET" && method != "HEAD" {
+			message := []byte("405 Method Not Allowed\n")
+			w.SetDefaultHeader("Allow", "GET, HEAD")
+			w.WriteStatusLine(response.MethodNotAllowed)
+			w.WriteHeaders(response.GetDefaultHeaders(len(message)))
+			w.WriteBody(message)
+			return
+		}
+		var b bytes.Buffer
+		r.WriteTo(&b)
+		h := response.GetDefaultHeaders(b.Len())
+		h.Replace("Content-Type", ContentType)
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		if method == "GET" {
+			w.WriteBody(b.Bytes())
+		}
+	}
+}
+
+// Counter is a value that only goes up. Methods take one value for each
+// label the counter was registered with.
+type Counter struct {
+	*vec
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter by v, which must not be negative.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: counter %s decreased", c.name))
+	}
+	c.update(labelValues, func(s *series) { s.value += v })
+}
+
+func (c *Counter) write(b *bytes.Buffer) {
+	c.writeHeader(b)
+	for _, s := range c.snapshot() {
+		writeSample(b, c.name, c.labels, s.labels, s.value)
+	}
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	*vec
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.update(labelValues, func(s *series) { s.value = v })
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.update(labelValues, func(s *series) { s.value += v })
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *Gauge) write(b *bytes.Buffer) {
+	g.writeHeader(b)
+	for _, s := range g.snapshot() {
+		writeSample(b, g.name, g.labels, s.labels, s.value)
+	}
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	*vec
+	buckets []float64
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.update(labelValues, func(s *series) {
+		if s.counts == nil {
+			s.counts = make([]uint64, len(h.buckets))
+		}
+		for i, upper := range h.buckets {
+			if v <= upper {
+				s.counts[i]++
+			}
+		}
+		s.sum += v
+		s.count++
+	})
+}
+
+func (h *Histogram) write(b *bytes.Buffer) {
+	h.writeHeader(b)
+	names := append(slices.Clone(h.labels), "le")
+	for _, s := range h.snapshot() {
+		values := append(slices.Clone(s.labels), "")
+		for i, upper := range h.buckets {
+			values[len(values)-1] = formatFloat(upper)
+			var count uint64
+			if s.counts != nil {
+				count = s.counts[i]
+			}
+			writeSample(b, h.name+"_bucket", names, values, float64(count))
+		}
+		values[len(values)-1] = "+Inf"
+		writeSample(b, h.name+"_bucket", names, values, float64(s.count))
+		writeSample(b, h.name+"_sum", h.labels, s.labels, s.sum)
+		writeSample(b, h.name+"_count", h.labels, s.labels, float64(s.count))
+	}
+}
+
+// vec holds the series of a metric, one for each combination of label
+// values seen.
+type vec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64
+	// Histograms only; counts are cumulative.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newVec(name, help, kind string, labels []string) *vec {
+	return &vec{name: name, help: help, kind: kind, labels: slices.Clone(labels), series: map[string]*series{}}
+}
+
+func (v *vec) base() *vec {
+	return v
+}
+
+func (v *vec) update(labelValues []string, f func(s *series)) {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: slices.Clone(labelValues)}
+		v.series[key] = s
+	}
+	f(s)
+}
+
+// snapshot copies the series, sorted by label values. A metric without
+// labels always has its one series, at zero until it is first updated.
+func (v *vec) snapshot() []series {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.labels) == 0 && len(v.series) == 0 {
+		return []series{{}}
+	}
+	out := make([]series, 0, len(v.series))
+	for _, s := range v.series {
+		c := *s
+		c.counts = slices.Clone(s.counts)
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return slices.Compare(out[i].labels, out[j].labels) < 0
+	})
+	return out
+}
+
+func (v *vec) writeHeader(b *bytes.Buffer) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(v.help)
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", v.name, help, v.name, v.kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(b *bytes.Buffer, name string, labels, values []string, value float64) {
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, `%s="%s"`, label, labelEscaper.Replace(values[i]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(value))
+	b.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
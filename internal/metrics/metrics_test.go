@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	// Test: Text exposition of every kind
+	r := NewRegistry()
+	requests := r.Counter("requests_total", "Requests seen.", "method", "code")
+	active := r.Gauge("active", "Active things.")
+	duration := r.Histogram("duration_seconds", "How long it took.", []float64{0.1, 1})
+	r.Counter("idle_total", "Never used.", "label")
+	requests.Inc("GET", "200")
+	requests.Add(2, "GET", "200")
+	requests.Inc("DELETE", "404")
+	active.Inc()
+	active.Inc()
+	active.Dec()
+	duration.Observe(0.05)
+	duration.Observe(0.5)
+	duration.Observe(3)
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, `# HELP requests_total Requests seen.
+# TYPE requests_total counter
+requests_total{method="DELETE",code="404"} 1
+requests_total{method="GET",code="200"} 3
+# HELP active Active things.
+# TYPE active gauge
+active 1
+# HELP duration_seconds How long it took.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.1"} 1
+duration_seconds_bucket{le="1"} 2
+duration_seconds_bucket{le="+Inf"} 3
+duration_seconds_sum 3.55
+duration_seconds_count 3
+# HELP idle_total Never used.
+# TYPE idle_total counter
+`, buf.String())
+
+	// Test: Unlabeled metrics start at zero
+	r = NewRegistry()
+	r.Counter("hits_total", "Hits.")
+	r.Histogram("size", "Sizes.", []float64{1})
+	buf.Reset()
+	r.WriteTo(&buf)
+	assert.Equal(t, `# HELP hits_total Hits.
+# TYPE hits_total counter
+hits_total 0
+# HELP size Sizes.
+# TYPE size histogram
+size_bucket{le="1"} 0
+size_bucket{le="+Inf"} 0
+size_sum 0
+size_count 0
+`, buf.String())
+
+	// Test: Label values and help are escaped
+	r = NewRegistry()
+	r.Gauge("info", "Line one\nline \\ two.", "value").Set(1, "a \"quoted\"\nvalue\\")
+	buf.Reset()
+	r.WriteTo(&buf)
+	assert.Equal(t, `# HELP info Line one\nline \\ two.
+# TYPE info gauge
+info{value="a \"quoted\"\nvalue\\"} 1
+`, buf.String())
+
+	// Test: Registering again returns the same metric
+	r = NewRegistry()
+	first := r.Counter("hits_total", "Hits.", "path")
+	assert.Same(t, first, r.Counter("hits_total", "Hits.", "path"))
+	assert.Panics(t, func() { r.Gauge("hits_total", "Hits.", "path") })
+	assert.Panics(t, func() { r.Counter("hits_total", "Hits.") })
+
+	// Test: Invalid definitions and uses
+	assert.Panics(t, func() { r.Counter("bad-name", "") })
+	assert.Panics(t, func() { r.Counter("ok_total", "", "bad-label") })
+	assert.Panics(t, func() { r.Histogram("h", "", []float64{2, 1}) })
+	assert.Panics(t, func() { r.Histogram("h", "", nil, "le") })
+	assert.Panics(t, func() { first.Inc() })
+	assert.Panics(t, func() { first.Add(-1, "/") })
+}
+
+// serve runs h for a request with the given method and parses what it
+// wrote. The httptest package can't be used, as it imports the server.
+func serve(t *testing.T, h func(*response.Writer, *request.Request), method string) *response.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	h(w, &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: "/metrics", HttpVersion: "1.1"},
+		Headers:     headers.NewHeaders(),
+	})
+	resp, err := response.NewReader(&buf).ReadResponse(method)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("hits_total", "Hits.").Inc()
+
+	// Test: GET returns the exposition
+	resp := serve(t, r.Handler(), "GET")
+	assert.Equal(t, response.OK, resp.StatusCode)
+	assert.Equal(t, ContentType, resp.Headers["content-type"])
+	assert.Equal(t, "# HELP hits_total Hits.\n# TYPE hits_total counter\nhits_total 1\n", string(resp.Body))
+
+	// Test: Other methods are refused
+	resp = serve(t, r.Handler(), "POST")
+	assert.Equal(t, response.MethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "GET, HEAD", resp.Headers["allow"])
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"context"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/request"
+)
+
+type Policy int
+
+const (
+	RoundRobin Policy = iota
+	LeastConnections
+	ConsistentHash
+)
+
+const (
+	defaultMaxFailures   = 3
+	defaultEjectDuration = 30 * time.Second
+	defaultCheckTimeout  = 2 * time.Second
+	ringReplicas         = 100
+)
+
+type PoolConfig struct {
+	Upstreams []*url.URL
+	Policy    Policy
+	// HashKey returns the value ConsistentHash balances on, the client IP if nil.
+	HashKey func(req *request.Request) string
+	// HealthCheckPath is requested on every upstream each HealthCheckInterval.
+	// Active checks are off when the path is empty.
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	// MaxFailures consecutive failed requests eject an upstream, 3 if zero.
+	MaxFailures int
+	// EjectDuration is how long an ejected upstream is skipped when active
+	// checks are off, 30s if zero. With active checks it stays out until
+	// a check passes.
+	EjectDuration time.Duration
+	// Retries is how many other upstreams an idempotent request is retried
+	// on after a connection failure.
+	Retries int
+}
+
+type backend struct {
+	url          *url.URL
+	active       atomic.Int64
+	failures     atomic.Int64
+	ejectedUntil atomic.Int64
+	down         atomic.Bool
+}
+
+func (b *backend) available(now time.Time) bool {
+	return !b.down.Load() && now.UnixNano() >= b.ejectedUntil.Load()
+}
+
+// Pool balances requests over several upstreams and tracks their health.
+type Pool struct {
+	config   PoolConfig
+	backends []*backend
+	ring     []ringEntry
+	next     atomic.Uint64
+	client   *http.Client
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type ringEntry struct {
+	hash    uint32
+	backend *backend
+}
+
+func NewPool(config PoolConfig) *Pool {
+	if config.MaxFailures == 0 {
+		config.MaxFailures = defaultMaxFailures
+	}
+	if config.EjectDuration == 0 {
+		config.EjectDuration = defaultEjectDuration
+	}
+	if config.HealthCheckTimeout == 0 {
+		config.HealthCheckTimeout = defaultCheckTimeout
+	}
+	if config.HealthCheckInterval == 0 {
+		config.HealthCheckInterval = 10 * time.Second
+	}
+
+	p := &Pool{
+		config: config,
+		client: &http.Client{Timeout: config.HealthCheckTimeout},
+		stop:   make(chan struct{}),
+	}
+	for _, u := range config.Upstreams {
+		b := &backend{url: u}
+		p.backends = append(p.backends, b)
+		for i := 0; i < ringReplicas; i++ {
+			key := u.String() + "#" + strconv.Itoa(i)
+			p.ring = append(p.ring, ringEntry{hash: crc32.ChecksumIEEE([]byte(key)), backend: b})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+
+	if config.HealthCheckPath != "" {
+		p.checkAll()
+		go p.healthLoop()
+	}
+	return p
+}
+
+// Close stops the active health checks.
+func (p *Pool) Close() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// pick returns an available upstream that is not in tried, or nil.
+func (p *Pool) pick(req *request.Request, tried map[*backend]bool) *backend {
+	now := time.Now()
+	usable := func(b *backend) bool { return !tried[b] && b.available(now) }
+
+	switch p.config.Policy {
+	case LeastConnections:
+		var best *backend
+		start := int(p.next.Add(1))
+		for i := range p.backends {
+			b := p.backends[(start+i)%len(p.backends)]
+			if usable(b) && (best == nil || b.active.Load() < best.active.Load()) {
+				best = b
+			}
+		}
+		return best
+	case ConsistentHash:
+		if len(p.ring) == 0 {
+			return nil
+		}
+		h := crc32.ChecksumIEEE([]byte(p.hashKey(req)))
+		idx := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+		for i := range p.ring {
+			b := p.ring[(idx+i)%len(p.ring)].backend
+			if usable(b) {
+				return b
+			}
+		}
+		return nil
+	default:
+		n := len(p.backends)
+		start := int(p.next.Add(1) - 1)
+		for i := 0; i < n; i++ {
+			b := p.backends[(start+i)%n]
+			if usable(b) {
+				return b
+			}
+		}
+		return nil
+	}
+}
+
+func (p *Pool) hashKey(req *request.Request) string {
+	if p.config.HashKey != nil {
+		return p.config.HashKey(req)
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// report records the outcome of a request for passive health tracking.
+func (p *Pool) report(b *backend, ok bool) {
+	if ok {
+		b.failures.Store(0)
+		return
+	}
+	if b.failures.Add(1) < int64(p.config.MaxFailures) {
+		return
+	}
+	b.failures.Store(0)
+	if p.config.HealthCheckPath != "" {
+		b.down.Store(true)
+		return
+	}
+	b.ejectedUntil.Store(time.Now().Add(p.config.EjectDuration).UnixNano())
+}
+
+func (p *Pool) healthLoop() {
+	ticker := time.NewTicker(p.config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.checkAll()
+		}
+	}
+}
+
+func (p *Pool) checkAll() {
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			healthy := p.check(b)
+			b.down.Store(!healthy)
+			if healthy {
+				b.failures.Store(0)
+			}
+		}(b)
+	}
+	wg.Wait()
+}
+
+func (p *Pool) check(b *backend) bool {
+	u := *b.url
+	u.Path = singleJoin(u.Path, p.config.HealthCheckPath)
+	u.RawQuery = ""
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.HealthCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+func singleJoin(base, path string) string {
+	if len(base) > 0 && base[len(base)-1] == '/' {
+		base = base[:len(base)-1]
+	}
+	if len(path) == 0 || path[0] != '/' {
+		path = "/" + path
+	}
+	return base + path
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/ar3ty/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type replica struct {
+	url     *url.URL
+	healthy atomic.Bool
+	release chan struct{}
+}
+
+func startReplicas(t *testing.T, n int) []*replica {
+	t.Helper()
+	replicas := make([]*replica, n)
+	for i := range replicas {
+		r := &replica{release: make(chan struct{})}
+		r.healthy.Store(true)
+		id := fmt.Sprintf("replica-%d", i)
+		s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+			code := response.OK
+			switch req.RequestLine.RequestTarget {
+			case "/health":
+				if !r.healthy.Load() {
+					code = response.InternalServerError
+				}
+			case "/slow":
+				<-r.release
+			}
+			message := []byte(id)
+			w.WriteStatusLine(code)
+			w.WriteHeaders(response.GetDefaultHeaders(len(message)))
+			w.WriteBody(message)
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		r.url = &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)}
+		replicas[i] = r
+	}
+	return replicas
+}
+
+func urls(replicas []*replica) []*url.URL {
+	out := make([]*url.URL, len(replicas))
+	for i, r := range replicas {
+		out[i] = r.url
+	}
+	return out
+}
+
+func get(t *testing.T, target string, hdrs map[string]string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest("GET", target, nil)
+	require.NoError(t, err)
+	for k, v := range hdrs {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func deadURL(t *testing.T) *url.URL {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	return &url.URL{Scheme: "http", Host: addr}
+}
+
+type countingTransport struct {
+	host  string
+	count atomic.Int64
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == c.host {
+		c.count.Add(1)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// panickingTransport answers with a body that panics when read.
+type panickingTransport struct{}
+
+func (panickingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: 200, Header: http.Header{}, ContentLength: -1, Body: panickingBody{}}, nil
+}
+
+type panickingBody struct{}
+
+func (panickingBody) Read([]byte) (int, error) { panic("broken body") }
+func (panickingBody) Close() error             { return nil }
+
+func TestRoundRobin(t *testing.T) {
+	replicas := startReplicas(t, 3)
+	pool := NewPool(PoolConfig{Upstreams: urls(replicas)})
+	defer pool.Close()
+	proxyURL := startProxy(t, Config{Pool: pool})
+
+	// Test: Requests are spread evenly
+	hits := map[string]int{}
+	for i := 0; i < 6; i++ {
+		code, body := get(t, proxyURL+"/", nil)
+		assert.Equal(t, 200, code)
+		hits[body]++
+	}
+	assert.Equal(t, map[string]int{"replica-0": 2, "replica-1": 2, "replica-2": 2}, hits)
+}
+
+func TestLeastConnections(t *testing.T) {
+	replicas := startReplicas(t, 3)
+	pool := NewPool(PoolConfig{Upstreams: urls(replicas), Policy: LeastConnections})
+	defer pool.Close()
+	proxyURL := startProxy(t, Config{Pool: pool})
+
+	// Test: A busy upstream is skipped while others are idle
+	var wg sync.WaitGroup
+	var busy string
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, busy = get(t, proxyURL+"/slow", nil)
+	}()
+	require.Eventually(t, func() bool {
+		for _, b := range pool.backends {
+			if b.active.Load() == 1 {
+				return true
+			}
+		}
+		return false
+	}, 2*time.Second, 10*time.Millisecond)
+
+	hits := map[string]int{}
+	for i := 0; i < 4; i++ {
+		_, body := get(t, proxyURL+"/", nil)
+		hits[body]++
+	}
+	for _, r := range replicas {
+		close(r.release)
+	}
+	wg.Wait()
+	assert.NotContains(t, hits, busy)
+	assert.Len(t, hits, 2)
+
+	// Test: A panic while relaying doesn't leave the upstream busy
+	broken := NewPool(PoolConfig{Upstreams: urls(replicas[:1]), Policy: LeastConnections})
+	defer broken.Close()
+	handler, err := Handler(Config{Pool: broken, Transport: panickingTransport{}})
+	require.NoError(t, err)
+	s, err := server.ServeWithConfig(0, handler, server.Config{ErrorLog: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	require.NoError(t, err)
+	defer s.Close()
+	if resp, err := http.Get(fmt.Sprintf("http://%s/", s.Addr())); err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	require.Eventually(t, func() bool {
+		return broken.backends[0].active.Load() == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestConsistentHash(t *testing.T) {
+	replicas := startReplicas(t, 3)
+	pool := NewPool(PoolConfig{
+		Upstreams: urls(replicas),
+		Policy:    ConsistentHash,
+		HashKey: func(req *request.Request) string {
+			user, _ := req.Headers.Get("X-User")
+			return user
+		},
+	})
+	defer pool.Close()
+	proxyURL := startProxy(t, Config{Pool: pool})
+
+	// Test: The same key always lands on the same upstream
+	owners := map[string]string{}
+	for i := 0; i < 20; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		_, first := get(t, proxyURL+"/", map[string]string{"X-User": user})
+		_, second := get(t, proxyURL+"/", map[string]string{"X-User": user})
+		assert.Equal(t, first, second)
+		owners[user] = first
+	}
+
+	// Test: Keys are spread over several upstreams
+	used := map[string]bool{}
+	for _, owner := range owners {
+		used[owner] = true
+	}
+	assert.Greater(t, len(used), 1)
+
+	// Test: Losing an upstream only moves its own keys
+	pool.backends[0].down.Store(true)
+	for user, owner := range owners {
+		_, body := get(t, proxyURL+"/", map[string]string{"X-User": user})
+		if owner != "replica-0" {
+			assert.Equal(t, owner, body)
+		} else {
+			assert.NotEqual(t, "replica-0", body)
+		}
+	}
+}
+
+func TestActiveHealthChecks(t *testing.T) {
+	replicas := startReplicas(t, 2)
+	replicas[1].healthy.Store(false)
+	pool := NewPool(PoolConfig{
+		Upstreams:           urls(replicas),
+		HealthCheckPath:     "/health",
+		HealthCheckInterval: 20 * time.Millisecond,
+	})
+	defer pool.Close()
+	proxyURL := startProxy(t, Config{Pool: pool})
+
+	// Test: Failing upstream gets no traffic
+	for i := 0; i < 4; i++ {
+		_, body := get(t, proxyURL+"/", nil)
+		assert.Equal(t, "replica-0", body)
+	}
+
+	// Test: Recovered upstream is brought back
+	replicas[1].healthy.Store(true)
+	assert.Eventually(t, func() bool {
+		_, body := get(t, proxyURL+"/", nil)
+		return body == "replica-1"
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestPassiveEjectionAndRetries(t *testing.T) {
+	replicas := startReplicas(t, 1)
+	dead := deadURL(t)
+	transport := &countingTransport{host: dead.Host}
+	pool := NewPool(PoolConfig{
+		Upstreams:   []*url.URL{dead, replicas[0].url},
+		MaxFailures: 2,
+		Retries:     1,
+	})
+	defer pool.Close()
+	proxyURL := startProxy(t, Config{Pool: pool, Transport: transport})
+
+	// Test: Idempotent requests are retried on another upstream
+	for i := 0; i < 10; i++ {
+		code, body := get(t, proxyURL+"/", nil)
+		assert.Equal(t, 200, code)
+		assert.Equal(t, "replica-0", body)
+	}
+
+	// Test: Consecutive failures eject the upstream
+	assert.Equal(t, int64(2), transport.count.Load())
+
+	// Test: Non-idempotent requests are not retried
+	transport = &countingTransport{host: dead.Host}
+	pool = NewPool(PoolConfig{Upstreams: []*url.URL{dead, replicas[0].url}, Retries: 3})
+	defer pool.Close()
+	proxyURL = startProxy(t, Config{Pool: pool, Transport: transport})
+	resp, err := http.Post(proxyURL+"/", "text/plain", strings.NewReader("order"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 502, resp.StatusCode)
+	assert.Equal(t, int64(1), transport.count.Load())
+
+	// Test: No upstream left
+	pool.backends[0].down.Store(true)
+	pool.backends[1].down.Store(true)
+	code, _ := get(t, proxyURL+"/", nil)
+	assert.Equal(t, 503, code)
+}
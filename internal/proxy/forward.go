@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/ar3ty/httpfromtcp/internal/server"
+)
+
+const defaultDialTimeout = 10 * time.Second
+
+type ForwardConfig struct {
+	// AllowedPorts lists the destination ports clients may reach, 80 and
+	// 443 if nil.
+	AllowedPorts []int
+	// AllowedHosts lists the destination hosts clients may reach. A
+	// "*.example.com" entry matches every subdomain and "*" any host. No
+	// host is allowed if nil.
+	AllowedHosts []string
+	// AllowPrivate lets clients reach loopback, private and link-local
+	// addresses, which are refused by default whatever name resolved to
+	// them.
+	AllowPrivate bool
+	// Transport sends relayed requests. If nil, requests are sent like
+	// http.DefaultTransport does, dialing as for CONNECT tunnels. A
+	// Transport given here is not held to AllowPrivate.
+	Transport http.RoundTripper
+	// DialTimeout limits connecting to CONNECT destinations, 10s if zero.
+	DialTimeout time.Duration
+	// Next handles requests in origin-form, which are not meant for the
+	// proxy. They are rejected with 400 if nil.
+	Next server.Handler
+}
+
+// Forward makes the server an explicit forward proxy: absolute-form
+// requests are relayed to their origin and CONNECT opens a tunnel.
+func Forward(config ForwardConfig) server.Handler {
+	if config.AllowedPorts == nil {
+		config.AllowedPorts = []int{80, 443}
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = defaultDialTimeout
+	}
+	// Addresses are checked as they are dialed, so a name can't resolve to
+	// a public address for the check and a private one for the connection.
+	dialer := &net.Dialer{Timeout: config.DialTimeout}
+	if !config.AllowPrivate {
+		dialer.Control = publicOnly
+	}
+	if config.Transport == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = dialer.DialContext
+		config.Transport = transport
+	}
+
+	return func(w *response.Writer, req *request.Request) {
+		target := req.RequestLine.RequestTarget
+		switch {
+		case req.RequestLine.Method == "CONNECT":
+			config.tunnel(w, target, dialer)
+		case strings.HasPrefix(strings.ToLower(target), "http://"):
+			config.relay(w, req)
+		case config.Next != nil:
+			config.Next(w, req)
+		default:
+			response.WriteError(w, response.BadRequest, nil)
+		}
+	}
+}
+
+func (c ForwardConfig) relay(w *response.Writer, req *request.Request) {
+	u, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil || u.Host == "" {
+		response.WriteError(w, response.BadRequest, nil)
+		return
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	if !c.allowed(u.Hostname(), port) {
+		response.WriteError(w, response.Forbidden, nil)
+		return
+	}
+
+	origin := *req
+	origin.RequestLine.RequestTarget = u.RequestURI()
+	Config{
+		Upstream:  &url.URL{Scheme: "http", Host: u.Host},
+		Transport: c.Transport,
+	}.serve(w, &origin)
+}
+
+func (c ForwardConfig) tunnel(w *response.Writer, authority string, dialer *net.Dialer) {
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil || host == "" {
+		response.WriteError(w, response.BadRequest, nil)
+		return
+	}
+	if !c.allowed(host, port) {
+		response.WriteError(w, response.Forbidden, nil)
+		return
+	}
+
+	upstream, err := dialer.Dial("tcp", authority)
+	if err != nil {
+		log.Printf("Error connecting to %s: %v", authority, err)
+		response.WriteError(w, statusForError(err), nil)
+		return
+	}
+	defer upstream.Close()
+
+	if err := w.WriteStatusLine(response.OK); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(nil); err != nil {
+		return
+	}
+	client, buffered, err := w.Hijack()
+	if err != nil {
+		log.Printf("Error hijacking connection: %v", err)
+		return
+	}
+	defer client.Close()
+
+	// The client may have started its handshake without waiting for our
+	// response, and the parser could have read some of it already.
+	if len(buffered) > 0 {
+		if _, err := upstream.Write(buffered); err != nil {
+			return
+		}
+	}
+
+	splice(client, upstream)
+}
+
+// splice copies bytes both ways until each side has finished sending.
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a)
+		closeWrite(b)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b)
+		closeWrite(a)
+	}()
+	wg.Wait()
+}
+
+func closeWrite(conn net.Conn) {
+	if tcp, ok := conn.(interface{ CloseWrite() error }); ok {
+		tcp.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+func (c ForwardConfig) allowed(host, port string) bool {
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	portOK := false
+	for _, p := range c.AllowedPorts {
+		if p == portNum {
+			portOK = true
+			break
+		}
+	}
+	if !portOK {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range c.AllowedHosts {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+var errPrivateAddress = errors.New("destination address is not public")
+
+// nonPublic lists the ranges refused besides what netip classifies as
+// loopback, private or link-local.
+var nonPublic = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// publicOnly is a net.Dialer Control function refusing connections to
+// addresses that aren't public.
+func publicOnly(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := addrPort.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return errPrivateAddress
+	}
+	for _, prefix := range nonPublic {
+		if prefix.Contains(ip) {
+			return errPrivateAddress
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/ar3ty/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startEcho(t *testing.T) (string, int) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String(), listener.Addr().(*net.TCPAddr).Port
+}
+
+func connect(t *testing.T, proxyAddr, target string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	require.NoError(t, err)
+	return conn, reader, resp
+}
+
+func TestConnectTunnel(t *testing.T) {
+	echoAddr, echoPort := startEcho(t)
+	s, err := server.Serve(0, Forward(ForwardConfig{
+		AllowedPorts: []int{echoPort},
+		AllowedHosts: []string{"127.0.0.1"},
+		AllowPrivate: true,
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+	proxyAddr := fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+
+	// Test: Bytes are spliced both ways
+	conn, reader, resp := connect(t, proxyAddr, echoAddr)
+	assert.Equal(t, 200, resp.StatusCode)
+	_, err = conn.Write([]byte("ping over the tunnel"))
+	require.NoError(t, err)
+	buf := make([]byte, len("ping over the tunnel"))
+	_, err = io.ReadFull(reader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping over the tunnel", string(buf))
+
+	// Test: Data sent right behind the CONNECT request is not lost
+	early, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	early.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = fmt.Fprintf(early, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nearly bird", echoAddr, echoAddr)
+	require.NoError(t, err)
+	earlyReader := bufio.NewReader(early)
+	resp, err = http.ReadResponse(earlyReader, &http.Request{Method: "CONNECT"})
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	buf = make([]byte, len("early bird"))
+	_, err = io.ReadFull(earlyReader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "early bird", string(buf))
+	early.Close()
+
+	// Test: Half-close reaches the destination and ends the tunnel
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+	conn.Close()
+
+	// Test: Port outside the allowlist
+	conn, _, resp = connect(t, proxyAddr, "127.0.0.1:"+strconv.Itoa(echoPort+1))
+	assert.Equal(t, 403, resp.StatusCode)
+	conn.Close()
+
+	// Test: Host outside the allowlist
+	conn, _, resp = connect(t, proxyAddr, "localhost:"+strconv.Itoa(echoPort))
+	assert.Equal(t, 403, resp.StatusCode)
+	conn.Close()
+
+	// Test: Malformed authority
+	conn, _, resp = connect(t, proxyAddr, "no-port-here")
+	assert.Equal(t, 400, resp.StatusCode)
+	conn.Close()
+
+	// Test: Without an allowlist no host can be reached
+	closed, err := server.Serve(0, Forward(ForwardConfig{AllowedPorts: []int{echoPort}, AllowPrivate: true}))
+	require.NoError(t, err)
+	defer closed.Close()
+	conn, _, resp = connect(t, closed.Addr().String(), echoAddr)
+	assert.Equal(t, 403, resp.StatusCode)
+	conn.Close()
+
+	// Test: Loopback and private addresses are refused after resolution,
+	// even to a host on the allowlist
+	public, err := server.Serve(0, Forward(ForwardConfig{AllowedPorts: []int{echoPort}, AllowedHosts: []string{"*"}}))
+	require.NoError(t, err)
+	defer public.Close()
+	for _, target := range []string{echoAddr, "localhost:" + strconv.Itoa(echoPort), "[::ffff:127.0.0.1]:" + strconv.Itoa(echoPort), "10.0.0.1:" + strconv.Itoa(echoPort)} {
+		conn, _, resp = connect(t, public.Addr().String(), target)
+		assert.Equal(t, 403, resp.StatusCode, target)
+		conn.Close()
+	}
+}
+
+func TestForwardRelay(t *testing.T) {
+	upstream, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		host, _ := req.Headers.Get("Host")
+		_, proxyAuth := req.Headers.Get("Proxy-Authorization")
+		message := []byte(fmt.Sprintf("%s %s host=%s proxy-auth=%t body=%s",
+			req.RequestLine.Method, req.RequestLine.RequestTarget, host, proxyAuth, req.Body))
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(message)))
+		w.WriteBody(message)
+	})
+	require.NoError(t, err)
+	defer upstream.Close()
+	upstreamPort := upstream.Addr().(*net.TCPAddr).Port
+
+	s, err := server.Serve(0, Forward(ForwardConfig{
+		AllowedPorts: []int{upstreamPort},
+		AllowedHosts: []string{"127.0.0.1"},
+		AllowPrivate: true,
+		Next: func(w *response.Writer, _ *request.Request) {
+			message := []byte("local")
+			w.WriteStatusLine(response.OK)
+			w.WriteHeaders(response.GetDefaultHeaders(len(message)))
+			w.WriteBody(message)
+		},
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+	proxyURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port))
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// Test: Absolute-form requests are relayed in origin-form
+	target := fmt.Sprintf("http://127.0.0.1:%d/tea?sugar=no", upstreamPort)
+	req, err := http.NewRequest("POST", target, nil)
+	require.NoError(t, err)
+	req.Header.Set("Proxy-Authorization", "Basic secret")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("POST /tea?sugar=no host=127.0.0.1:%d proxy-auth=false body=", upstreamPort), string(body))
+
+	// Test: Disallowed port
+	resp, err = client.Get(fmt.Sprintf("http://127.0.0.1:%d/", upstreamPort+1))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// Test: Relayed requests can't reach loopback addresses by default
+	public, err := server.Serve(0, Forward(ForwardConfig{AllowedPorts: []int{upstreamPort}, AllowedHosts: []string{"*"}}))
+	require.NoError(t, err)
+	defer public.Close()
+	publicURL, _ := url.Parse("http://" + public.Addr().String())
+	publicClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(publicURL)}}
+	resp, err = publicClient.Get(fmt.Sprintf("http://localhost:%d/", upstreamPort))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// Test: Origin-form requests go to the next handler
+	resp, err = http.Get(proxyURL.String() + "/")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "local", string(body))
+}
@@ -0,0 +1,397 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/ar3ty/httpfromtcp/internal/server"
+)
+
+// hopHeaders are meaningful only for a single connection and are never
+// forwarded (RFC 9110, 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type Config struct {
+	// Upstream is the base URL requests are forwarded to.
+	Upstream *url.URL
+	// Pool balances requests over several upstreams instead of Upstream.
+	Pool *Pool
+	// StripPrefix is removed from the request target before forwarding.
+	// Targets not below it are refused with 400.
+	StripPrefix string
+	// Transport sends the upstream requests, http.DefaultTransport if nil.
+	Transport http.RoundTripper
+	// Trailers adds X-Content-Length and digest trailers describing the
+	// proxied body.
+	Trailers bool
+	// Digests lists the algorithms sent as X-Content-<NAME> trailers,
+	// sha256 if nil. Supported: md5, sha1, sha256, sha512.
+	Digests []string
+}
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+type digest struct {
+	trailer string
+	hash    hash.Hash
+}
+
+// Handler forwards requests to config.Upstream, or an upstream of
+// config.Pool, and relays the responses. Redirects from the upstream are
+// passed to the client, not followed. It fails if config.Digests names an
+// unsupported algorithm.
+func Handler(config Config) (server.Handler, error) {
+	if config.Transport == nil {
+		config.Transport = http.DefaultTransport
+	}
+	if config.Trailers && config.Digests == nil {
+		config.Digests = []string{"sha256"}
+	}
+	for _, name := range config.Digests {
+		if _, ok := digestAlgorithms[strings.ToLower(name)]; !ok {
+			return nil, fmt.Errorf("proxy: unsupported digest algorithm %q", name)
+		}
+	}
+	return config.serve, nil
+}
+
+func (c Config) serve(w *response.Writer, req *request.Request) {
+	if c.Pool != nil {
+		c.balance(w, req)
+		return
+	}
+
+	outReq, err := c.newUpstreamRequest(req, c.Upstream)
+	if err != nil {
+		response.WriteError(w, response.BadRequest, nil)
+		return
+	}
+
+	resp, err := c.Transport.RoundTrip(outReq)
+	if err != nil {
+		log.Printf("Error proxying to %s: %v", outReq.URL, err)
+		response.WriteError(w, statusForError(err), nil)
+		return
+	}
+	defer resp.Body.Close()
+
+	c.writeResponse(w, req, resp)
+}
+
+func (c Config) balance(w *response.Writer, req *request.Request) {
+	attempts := 1
+	if idempotent(req.RequestLine.Method) {
+		attempts += c.Pool.config.Retries
+	}
+
+	tried := map[*backend]bool{}
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		b := c.Pool.pick(req, tried)
+		if b == nil {
+			break
+		}
+		tried[b] = true
+
+		outReq, err := c.newUpstreamRequest(req, b.url)
+		if err != nil {
+			response.WriteError(w, response.BadRequest, nil)
+			return
+		}
+
+		if lastErr = c.attempt(w, req, b, outReq); lastErr == nil {
+			return
+		}
+	}
+
+	if lastErr != nil {
+		response.WriteError(w, statusForError(lastErr), nil)
+		return
+	}
+	response.WriteError(w, response.ServiceUnavailable, nil)
+}
+
+// attempt sends outReq to b and relays the response. It returns the error
+// of a request that failed before any response, which can be retried.
+func (c Config) attempt(w *response.Writer, req *request.Request, b *backend, outReq *http.Request) error {
+	// Deferred, so that a panicking handler chain can't leave b looking
+	// busy forever.
+	b.active.Add(1)
+	defer b.active.Add(-1)
+
+	resp, err := c.Transport.RoundTrip(outReq)
+	if err != nil {
+		c.Pool.report(b, false)
+		log.Printf("Error proxying to %s: %v", outReq.URL, err)
+		return err
+	}
+	defer resp.Body.Close()
+	c.Pool.report(b, resp.StatusCode != 502 && resp.StatusCode != 503 && resp.StatusCode != 504)
+	c.writeResponse(w, req, resp)
+	return nil
+}
+
+func (c Config) newUpstreamRequest(req *request.Request, upstream *url.URL) (*http.Request, error) {
+	target := req.RequestLine.RequestTarget
+	if c.StripPrefix != "" {
+		trimmed, ok := strings.CutPrefix(target, strings.TrimSuffix(c.StripPrefix, "/"))
+		if !ok || trimmed != "" && trimmed[0] != '/' && trimmed[0] != '?' {
+			return nil, fmt.Errorf("target %q is outside of %q", target, c.StripPrefix)
+		}
+		target = trimmed
+	}
+	if !strings.HasPrefix(target, "/") {
+		target = "/" + target
+	}
+	ref, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, err
+	}
+
+	u := *upstream
+	u.Path = strings.TrimSuffix(u.Path, "/") + ref.Path
+	u.RawPath = ""
+	u.RawQuery = ref.RawQuery
+
+	var body io.Reader
+	if len(req.Body) > 0 {
+		body = bytes.NewReader(req.Body)
+	}
+	outReq, err := http.NewRequest(req.RequestLine.Method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	copyHeaders(outReq.Header, req.Headers)
+	outReq.Header.Del("Host")
+	outReq.Header.Del("Content-Length")
+	outReq.Host = upstream.Host
+	if _, ok := outReq.Header["User-Agent"]; !ok {
+		// Keep Go's transport from adding its own user agent.
+		outReq.Header.Set("User-Agent", "")
+	}
+
+	addForwarded(outReq.Header, req)
+	return outReq, nil
+}
+
+func (c Config) writeResponse(w *response.Writer, req *request.Request, resp *http.Response) {
+	h := headers.NewHeaders()
+	for key, values := range resp.Header {
+		for _, value := range values {
+			h.Set(key, value)
+		}
+	}
+	removeHopHeaders(h)
+
+	head := req.RequestLine.Method == "HEAD"
+	noBody := head || resp.StatusCode == 204 || resp.StatusCode == 304 || resp.StatusCode < 200
+	chunked := !noBody && (c.Trailers || resp.ContentLength < 0 || len(resp.Trailer) > 0)
+
+	if chunked {
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		for key := range resp.Trailer {
+			h.Set("Trailer", key)
+		}
+		if c.Trailers {
+			for _, d := range c.newDigests() {
+				h.Set("Trailer", d.trailer)
+			}
+			h.Set("Trailer", "X-Content-Length")
+		}
+	} else if !noBody {
+		h.Replace("Content-Length", fmt.Sprintf("%d", resp.ContentLength))
+	}
+
+	if err := w.WriteStatusLine(response.StatusCode(resp.StatusCode)); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	if noBody {
+		return
+	}
+	if !chunked {
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			log.Printf("Error copying upstream body: %v", err)
+		}
+		return
+	}
+
+	// Reading the next chunk only after the previous one was written keeps
+	// a slow client from making us buffer the upstream body.
+	digests := c.newDigests()
+	hashes := make([]io.Writer, len(digests))
+	for i, d := range digests {
+		hashes[i] = d.hash
+	}
+	hashWriter := io.MultiWriter(hashes...)
+	length := 0
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.WriteChunkedBody(buf[:n]); err != nil {
+				log.Printf("Error writing chunk body: %v", err)
+				return
+			}
+			hashWriter.Write(buf[:n])
+			length += n
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error reading upstream body: %v", err)
+			return
+		}
+	}
+
+	if _, err := w.WriteChunkedBodyDone(); err != nil {
+		return
+	}
+	trailers := headers.NewHeaders()
+	for key, values := range resp.Trailer {
+		for _, value := range values {
+			trailers.Set(key, value)
+		}
+	}
+	if c.Trailers {
+		for _, d := range digests {
+			trailers.Set(d.trailer, fmt.Sprintf("%x", d.hash.Sum(nil)))
+		}
+		trailers.Set("X-Content-Length", fmt.Sprintf("%d", length))
+	}
+	w.WriteTrailers(trailers)
+}
+
+func (c Config) newDigests() []digest {
+	if !c.Trailers {
+		return nil
+	}
+	digests := make([]digest, 0, len(c.Digests))
+	for _, name := range c.Digests {
+		name = strings.ToLower(name)
+		digests = append(digests, digest{
+			trailer: "X-Content-" + strings.ToUpper(name),
+			hash:    digestAlgorithms[name](),
+		})
+	}
+	return digests
+}
+
+func copyHeaders(dst http.Header, src headers.Headers) {
+	for key, value := range src {
+		dst.Set(key, value)
+	}
+	for _, name := range connectionTokens(src) {
+		dst.Del(name)
+	}
+	for _, name := range hopHeaders {
+		dst.Del(name)
+	}
+	if te, ok := src.Get("TE"); ok && strings.Contains(strings.ToLower(te), "trailers") {
+		// "TE: trailers" is the one hop-by-hop value worth passing on.
+		dst.Set("TE", "trailers")
+	}
+}
+
+func removeHopHeaders(h headers.Headers) {
+	for _, name := range connectionTokens(h) {
+		h.Delete(name)
+	}
+	for _, name := range hopHeaders {
+		h.Delete(name)
+	}
+}
+
+func connectionTokens(h headers.Headers) []string {
+	val, ok := h.Get("Connection")
+	if !ok {
+		return nil
+	}
+	var names []string
+	for _, name := range strings.Split(val, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// addForwarded appends the client to X-Forwarded-For and Forwarded (RFC 7239).
+func addForwarded(h http.Header, req *request.Request) {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return
+	}
+	if prior := h.Get("X-Forwarded-For"); prior != "" {
+		h.Set("X-Forwarded-For", prior+", "+ip)
+	} else {
+		h.Set("X-Forwarded-For", ip)
+	}
+
+	node := ip
+	if strings.Contains(ip, ":") {
+		node = `"[` + ip + `]"`
+	}
+	element := "for=" + node
+	if host, _ := req.Headers.Get("Host"); host != "" {
+		element += `;host="` + host + `"`
+	}
+	if req.TLS != nil {
+		element += ";proto=https"
+	} else {
+		element += ";proto=http"
+	}
+	if prior := h.Get("Forwarded"); prior != "" {
+		h.Set("Forwarded", prior+", "+element)
+	} else {
+		h.Set("Forwarded", element)
+	}
+}
+
+func statusForError(err error) response.StatusCode {
+	if errors.Is(err, errPrivateAddress) {
+		return response.Forbidden
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return response.GatewayTimeout
+	}
+	return response.BadGateway
+}
@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/ar3ty/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type seenRequest struct {
+	method  string
+	target  string
+	headers map[string]string
+	body    string
+}
+
+func startUpstream(t *testing.T) (*url.URL, <-chan seenRequest) {
+	t.Helper()
+	seen := make(chan seenRequest, 16)
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		hdrs := map[string]string{}
+		for k, v := range req.Headers {
+			hdrs[k] = v
+		}
+		seen <- seenRequest{
+			method:  req.RequestLine.Method,
+			target:  req.RequestLine.RequestTarget,
+			headers: hdrs,
+			body:    string(req.Body),
+		}
+
+		if strings.HasSuffix(req.RequestLine.RequestTarget, "/stream") {
+			w.WriteStatusLine(response.OK)
+			h := response.GetDefaultHeaders(0)
+			h.Delete("Content-Length")
+			h.Set("Transfer-Encoding", "chunked")
+			w.WriteHeaders(h)
+			for i := 0; i < 3; i++ {
+				w.WriteChunkedBody([]byte(fmt.Sprintf("part %d\n", i)))
+			}
+			return
+		}
+
+		message := []byte("created " + string(req.Body))
+		w.WriteStatusLine(response.Created)
+		h := response.GetDefaultHeaders(len(message))
+		h.Set("X-Upstream", "yes")
+		h.Replace("Connection", "X-Secret")
+		h.Set("X-Secret", "hop")
+		w.WriteHeaders(h)
+		w.WriteBody(message)
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	u, err := url.Parse(fmt.Sprintf("http://127.0.0.1:%d/api", s.Addr().(*net.TCPAddr).Port))
+	require.NoError(t, err)
+	return u, seen
+}
+
+func startProxy(t *testing.T, config Config) string {
+	t.Helper()
+	handler, err := Handler(config)
+	require.NoError(t, err)
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return fmt.Sprintf("http://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+}
+
+func TestProxy(t *testing.T) {
+	upstream, seen := startUpstream(t)
+	proxyURL := startProxy(t, Config{Upstream: upstream, StripPrefix: "/httpbin"})
+
+	// Test: Method, body, headers and query are forwarded
+	req, err := http.NewRequest("PUT", proxyURL+"/httpbin/items?id=7", strings.NewReader("coffee"))
+	require.NoError(t, err)
+	req.Header.Set("X-Custom", "kept")
+	req.Header.Set("Proxy-Authorization", "Basic secret")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+
+	got := <-seen
+	assert.Equal(t, "PUT", got.method)
+	assert.Equal(t, "/api/items?id=7", got.target)
+	assert.Equal(t, "coffee", got.body)
+	assert.Equal(t, "kept", got.headers["x-custom"])
+	assert.Equal(t, upstream.Host, got.headers["host"])
+	assert.NotContains(t, got.headers, "proxy-authorization")
+	assert.Equal(t, "10.0.0.1, 127.0.0.1", got.headers["x-forwarded-for"])
+	assert.Contains(t, got.headers["forwarded"], "for=127.0.0.1;host=")
+
+	// Test: Upstream status and headers are preserved, hop-by-hop ones are not
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, "created coffee", string(body))
+	assert.Equal(t, "yes", resp.Header.Get("X-Upstream"))
+	assert.Empty(t, resp.Header.Get("X-Secret"))
+
+	// Test: Chunked upstream body is relayed
+	resp, err = http.Get(proxyURL + "/httpbin/stream")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	<-seen
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "part 0\npart 1\npart 2\n", string(body))
+
+	// Test: Target outside of the prefix
+	for _, target := range []string{"/elsewhere", "/httpbinfoo"} {
+		resp, err = http.Get(proxyURL + target)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, 400, resp.StatusCode, target)
+	}
+}
+
+func TestAddForwarded(t *testing.T) {
+	req := &request.Request{Headers: headers.NewHeaders(), RemoteAddr: "192.0.2.1:5000"}
+	req.Headers.Set("Host", "example.com")
+
+	// Test: Plain connections are forwarded as http
+	h := http.Header{}
+	addForwarded(h, req)
+	assert.Equal(t, `for=192.0.2.1;host="example.com";proto=http`, h.Get("Forwarded"))
+
+	// Test: TLS connections are forwarded as https, after earlier proxies
+	req.TLS = &tls.ConnectionState{}
+	req.RemoteAddr = "[2001:db8::1]:5000"
+	addForwarded(h, req)
+	assert.Equal(t, `for=192.0.2.1;host="example.com";proto=http, for="[2001:db8::1]";host="example.com";proto=https`, h.Get("Forwarded"))
+	assert.Equal(t, "192.0.2.1, 2001:db8::1", h.Get("X-Forwarded-For"))
+}
+
+func TestProxyTrailers(t *testing.T) {
+	upstream, seen := startUpstream(t)
+	proxyURL := startProxy(t, Config{Upstream: upstream, Trailers: true})
+
+	// Test: Digest trailers follow the body
+	resp, err := http.Get(proxyURL + "/stream")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	<-seen
+	assert.Equal(t, "part 0\npart 1\npart 2\n", string(body))
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(body)), resp.Trailer.Get("X-Content-SHA256"))
+	assert.Equal(t, fmt.Sprintf("%d", len(body)), resp.Trailer.Get("X-Content-Length"))
+
+	// Test: Configured digest algorithms
+	proxyURL = startProxy(t, Config{Upstream: upstream, Trailers: true, Digests: []string{"md5", "sha256"}})
+	resp, err = http.Get(proxyURL + "/stream")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	<-seen
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum(body)), resp.Trailer.Get("X-Content-MD5"))
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256(body)), resp.Trailer.Get("X-Content-SHA256"))
+
+	// Test: Unsupported digest algorithm
+	_, err = Handler(Config{Upstream: upstream, Trailers: true, Digests: []string{"crc32"}})
+	assert.Error(t, err)
+}
+
+func TestProxyStreamingMemory(t *testing.T) {
+	// Buffering the body anywhere would need more than maxGrowth, even in
+	// the short run; the full run shows it holds for gigabytes.
+	const maxGrowth = 8 << 20
+	total := 3 << 30
+	if testing.Short() {
+		total = 64 << 20
+	}
+
+	block := make([]byte, 64*1024)
+	for i := range block {
+		block[i] = byte(i * 31)
+	}
+	s, err := server.Serve(0, func(w *response.Writer, _ *request.Request) {
+		w.WriteStatusLine(response.OK)
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Replace("Content-Type", "application/octet-stream")
+		w.WriteHeaders(h)
+		for sent := 0; sent < total; sent += len(block) {
+			if _, err := w.WriteChunkedBody(block); err != nil {
+				return
+			}
+		}
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	upstream := &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)}
+	proxyURL := startProxy(t, Config{Upstream: upstream, Trailers: true})
+
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapInuse
+
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	go func() {
+		var stats runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > peak.Load() {
+				peak.Store(stats.HeapInuse)
+			}
+		}
+	}()
+
+	// Test: Trailers of a multi-gigabyte body are computed in constant memory
+	resp, err := http.Get(proxyURL + "/")
+	require.NoError(t, err)
+	hash := sha256.New()
+	n, err := io.Copy(hash, resp.Body)
+	resp.Body.Close()
+	close(done)
+	require.NoError(t, err)
+	assert.Equal(t, int64(total), n)
+	assert.Equal(t, fmt.Sprintf("%x", hash.Sum(nil)), resp.Trailer.Get("X-Content-SHA256"))
+	assert.Equal(t, fmt.Sprintf("%d", total), resp.Trailer.Get("X-Content-Length"))
+	assert.Less(t, peak.Load()-min(peak.Load(), baseline), uint64(maxGrowth))
+}
+
+func TestProxyBackpressure(t *testing.T) {
+	const blocks = 4096
+	block := make([]byte, 64*1024)
+	wrote := make(chan struct{}, blocks)
+	finished := make(chan struct{})
+	s, err := server.Serve(0, func(w *response.Writer, _ *request.Request) {
+		defer close(finished)
+		w.WriteStatusLine(response.OK)
+		h := response.GetDefaultHeaders(0)
+		h.Delete("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteHeaders(h)
+		for i := 0; i < blocks; i++ {
+			if _, err := w.WriteChunkedBody(block); err != nil {
+				return
+			}
+			wrote <- struct{}{}
+		}
+		w.WriteChunkedBodyDone()
+		w.WriteTrailers(nil)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	upstream := &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)}
+	proxyURL := startProxy(t, Config{Upstream: upstream, Trailers: true})
+
+	// Test: A client that stops reading stalls the upstream
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyURL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	sent := 0
+	stalled := false
+	for !stalled {
+		select {
+		case <-wrote:
+			sent++
+		case <-finished:
+			t.Fatal("upstream finished without the client reading")
+		case <-time.After(200 * time.Millisecond):
+			stalled = true
+		}
+	}
+	assert.Less(t, sent, blocks)
+
+	// Test: Reading resumes the upstream
+	go io.Copy(io.Discard, conn)
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("upstream didn't resume")
+	}
+	assert.Equal(t, blocks, sent+len(wrote))
+}
+
+func TestProxyUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	// Test: Unreachable upstream is a bad gateway
+	proxyURL := startProxy(t, Config{Upstream: &url.URL{Scheme: "http", Host: addr}})
+	resp, err := http.Get(proxyURL + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 502, resp.StatusCode)
+}
@@ -0,0 +1,87 @@
+package request
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+	ErrBodyTooLarge        = errors.New("decoded body is larger than allowed")
+)
+
+// DecodeBody replaces a gzip or deflate encoded body with the decoded bytes
+// and drops the Content-Encoding header. Decoding stops with ErrBodyTooLarge
+// once the output grows past maxSize bytes.
+func (r *Request) DecodeBody(maxSize int) error {
+	val, ok := r.Headers.Get("Content-Encoding")
+	if !ok {
+		return nil
+	}
+
+	codings := strings.Split(val, ",")
+	body := r.Body
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+		var err error
+		switch coding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			body, err = decodeGzip(body, maxSize)
+		case "deflate":
+			body, err = decodeDeflate(body, maxSize)
+		default:
+			return fmt.Errorf("%w: %s", ErrUnsupportedEncoding, coding)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	r.Body = body
+	r.Headers.Delete("Content-Encoding")
+	if _, ok := r.Headers.Get("Content-Length"); ok {
+		r.Headers.Replace("Content-Length", strconv.Itoa(len(body)))
+	}
+	return nil
+}
+
+func decodeGzip(data []byte, maxSize int) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip body: %w", err)
+	}
+	defer reader.Close()
+	return readLimited(reader, maxSize)
+}
+
+func decodeDeflate(data []byte, maxSize int) ([]byte, error) {
+	// "deflate" is meant to be zlib wrapped, but some clients send raw deflate.
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		raw := flate.NewReader(bytes.NewReader(data))
+		defer raw.Close()
+		return readLimited(raw, maxSize)
+	}
+	defer reader.Close()
+	return readLimited(reader, maxSize)
+}
+
+func readLimited(reader io.Reader, maxSize int) ([]byte, error) {
+	decoded, err := io.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encoded body: %w", err)
+	}
+	if len(decoded) > maxSize {
+		return nil, ErrBodyTooLarge
+	}
+	return decoded, nil
+}
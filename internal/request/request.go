@@ -2,6 +2,7 @@ package request
 
 import (
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -21,6 +22,25 @@ const (
 )
 const bufferSize = 8
 
+// ErrIncompleteRequest is returned when the connection ends in the middle
+// of a request. ReadRequest returns io.EOF if it ends between requests.
+var ErrIncompleteRequest = errors.New("incomplete request")
+
+// Malformed requests fail with an error wrapping one of these, telling
+// which part of the request is at fault.
+var (
+	ErrInvalidRequestLine   = errors.New("invalid request line")
+	ErrInvalidMethod        = errors.New("invalid method")
+	ErrUnsupportedVersion   = errors.New("unsupported http version")
+	ErrInvalidHeader        = errors.New("invalid header")
+	ErrInvalidContentLength = errors.New("invalid content length")
+)
+
+// ErrUnsupportedTransferEncoding is returned for requests with a
+// Transfer-Encoding header. Their bodies are not decoded, so the request
+// can't be told apart from the next one on the connection.
+var ErrUnsupportedTransferEncoding = errors.New("unsupported transfer encoding")
+
 type RequestLine struct {
 	HttpVersion   string
 	RequestTarget string
@@ -32,6 +52,16 @@ type Request struct {
 	Headers     headers.Headers
 	Body        []byte
 	Status      parseStatus
+	// RemoteAddr is the network address of the client, set by the server.
+	RemoteAddr string
+	// Proto is the protocol the request arrived over, named as in ALPN:
+	// "http/1.1", "h2" or "h2c". Set by the server.
+	Proto string
+	// TLS describes the connection for requests received over TLS.
+	TLS *tls.ConnectionState
+	// ID identifies the request in logs. Set by the server when access
+	// logging is on.
+	ID string
 }
 
 func requestLineFromString(line string) (*RequestLine, error) {
@@ -48,25 +78,19 @@ func requestLineFromString(line string) (*RequestLine, error) {
 
 	parts := strings.Split(line, " ")
 	if len(parts) != 3 {
-		return nil, errors.New("invalid request line structure")
+		return nil, fmt.Errorf("%w: structure", ErrInvalidRequestLine)
 	}
 	method := parts[0]
 	if _, ok := methods[method]; !ok {
-		return nil, errors.New("invalid method")
+		return nil, fmt.Errorf("%w: %s", ErrInvalidMethod, method)
 	}
 	target := parts[1]
 	if len(target) == 0 {
-		return nil, errors.New("invalid target")
+		return nil, fmt.Errorf("%w: empty target", ErrInvalidRequestLine)
 	}
 	protocolVersion := strings.Split(parts[2], "/")
-	if len(protocolVersion) != 2 {
-		return nil, errors.New("invalid http version variable")
-	}
-	if protocolVersion[0] != "HTTP" {
-		return nil, fmt.Errorf("invalid http version variable: %s", protocolVersion[0])
-	}
-	if protocolVersion[1] != "1.1" {
-		return nil, fmt.Errorf("invalid http version variable: %s", protocolVersion[1])
+	if len(protocolVersion) != 2 || protocolVersion[0] != "HTTP" || protocolVersion[1] != "1.1" {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedVersion, parts[2])
 	}
 	return &RequestLine{
 		HttpVersion:   protocolVersion[1],
@@ -104,7 +128,7 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	case parseStatusParsingHeaders:
 		n, done, err := r.Headers.Parse(data)
 		if err != nil {
-			return 0, err
+			return 0, fmt.Errorf("%w: %w", ErrInvalidHeader, err)
 		}
 		if done {
 			r.Status = parseStatusParsingBody
@@ -112,23 +136,28 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		return n, nil
 	case parseStatusParsingBody:
 		val, ok := r.Headers.Get("content-length")
+		if te, chunked := r.Headers.Get("transfer-encoding"); chunked {
+			if ok {
+				return 0, fmt.Errorf("%w: sent with transfer-encoding", ErrInvalidContentLength)
+			}
+			return 0, fmt.Errorf("%w: %s", ErrUnsupportedTransferEncoding, te)
+		}
 		if !ok {
 			r.Status = parseStatusDone
 			return 0, nil
 		}
-		contentLength, err := strconv.Atoi(val)
+		contentLength, err := parseContentLength(val)
 		if err != nil {
-			return 0, fmt.Errorf("invalid content length value: err")
+			return 0, err
 		}
 
-		r.Body = append(r.Body, data...)
-		if len(r.Body) > contentLength {
-			return 0, errors.New("body is longer than declared")
-		}
+		// Bytes past the declared length belong to the next request.
+		n := min(len(data), contentLength-len(r.Body))
+		r.Body = append(r.Body, data[:n]...)
 		if len(r.Body) == contentLength {
 			r.Status = parseStatusDone
 		}
-		return len(data), nil
+		return n, nil
 
 	case parseStatusDone:
 		return 0, errors.New("trying to read data in a done state")
@@ -137,6 +166,21 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	}
 }
 
+// parseContentLength accepts repeated Content-Length headers, which arrive
+// joined by commas, only when they all carry the same value.
+func parseContentLength(val string) (int, error) {
+	contentLength := -1
+	for _, v := range strings.Split(val, ",") {
+		v = strings.TrimSpace(v)
+		n, err := strconv.Atoi(v)
+		if err != nil || strings.TrimLeft(v, "0123456789") != "" || contentLength >= 0 && n != contentLength {
+			return 0, fmt.Errorf("%w: %s", ErrInvalidContentLength, val)
+		}
+		contentLength = n
+	}
+	return contentLength, nil
+}
+
 func (r *Request) parse(data []byte) (int, error) {
 	totalParsed := 0
 	for r.Status != parseStatusDone {
@@ -153,8 +197,33 @@ func (r *Request) parse(data []byte) (int, error) {
 }
 
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize)
-	readToIndex := 0
+	return NewReader(reader).ReadRequest()
+}
+
+// Reader parses requests from a connection and keeps the bytes it read
+// past the end of a request.
+type Reader struct {
+	reader      io.Reader
+	buf         []byte
+	readToIndex int
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, bufferSize),
+	}
+}
+
+// Buffered returns the bytes read from the connection that the parser
+// hasn't consumed.
+func (r *Reader) Buffered() []byte {
+	return r.buf[:r.readToIndex]
+}
+
+// ReadRequest parses the next request. Bytes that follow it stay buffered
+// for the next call, so pipelined requests are read one by one.
+func (r *Reader) ReadRequest() (*Request, error) {
 	req := &Request{
 		Headers: headers.NewHeaders(),
 		Status:  parseStatusInitialized,
@@ -162,33 +231,40 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
 	}
 
 	for req.Status != parseStatusDone {
-		if readToIndex >= len(buf) {
-			newBuf := make([]byte, 2*len(buf))
-			_ = copy(newBuf, buf)
-			buf = newBuf
-		}
-		n, err := reader.Read(buf[readToIndex:])
+		// A pipelined request may already be buffered in full.
+		n, err := req.parse(r.buf[:r.readToIndex])
 		if err != nil {
-			if err == io.EOF {
-				if req.Status != parseStatusDone {
-					return nil, fmt.Errorf("incomplete request")
-				}
-				break
-			}
 			return nil, err
 		}
-		readToIndex += n
+		if n != 0 {
+			length := r.readToIndex - n
+			_ = copy(r.buf, r.buf[n:r.readToIndex])
+			r.readToIndex = length
+			continue
+		}
+		if req.Status == parseStatusDone {
+			break
+		}
 
-		n, err = req.parse(buf[:readToIndex])
+		if r.readToIndex >= len(r.buf) {
+			newBuf := make([]byte, 2*len(r.buf))
+			_ = copy(newBuf, r.buf)
+			r.buf = newBuf
+		}
+		n, err = r.reader.Read(r.buf[r.readToIndex:])
+		r.readToIndex += n
 		if err != nil {
+			if err == io.EOF && n > 0 {
+				continue
+			}
+			if err == io.EOF {
+				if req.Status == parseStatusInitialized && r.readToIndex == 0 {
+					return nil, io.EOF
+				}
+				return nil, ErrIncompleteRequest
+			}
 			return nil, err
 		}
-
-		if n != 0 {
-			length := readToIndex - n
-			_ = copy(buf, buf[n:readToIndex])
-			readToIndex = length
-		}
 	}
 
 	return req, nil
@@ -1,9 +1,16 @@
 package request
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"io"
+	"strings"
 	"testing"
 
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -73,7 +80,7 @@ func TestRequestlineParse(t *testing.T) {
 		numBytesPerRead: 50,
 	}
 	_, err = RequestFromReader(reader)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrInvalidRequestLine)
 
 	//Test: Invalid number of parts in request line
 	reader = &chunkReader{
@@ -81,7 +88,7 @@ func TestRequestlineParse(t *testing.T) {
 		numBytesPerRead: 24,
 	}
 	_, err = RequestFromReader(reader)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrInvalidMethod)
 
 	//Test: Invalid version in request line
 	reader = &chunkReader{
@@ -89,7 +96,7 @@ func TestRequestlineParse(t *testing.T) {
 		numBytesPerRead: 10,
 	}
 	_, err = RequestFromReader(reader)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
 }
 
 func TestHeadersParse(t *testing.T) {
@@ -111,7 +118,7 @@ func TestHeadersParse(t *testing.T) {
 		numBytesPerRead: 3,
 	}
 	_, err = RequestFromReader(reader)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrInvalidHeader)
 
 	// Test: Empty Headers
 	reader = &chunkReader{
@@ -178,7 +185,33 @@ func TestBodyParse(t *testing.T) {
 		numBytesPerRead: 3,
 	}
 	_, err = RequestFromReader(reader)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+
+	// Test: Invalid content length
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: -1\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrInvalidContentLength)
+
+	// Test: Repeated content lengths must agree
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 2\r\nContent-Length: 2\r\n\r\nok"))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(r.Body))
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 2\r\nContent-Length: 3\r\n\r\nok!"))
+	require.ErrorIs(t, err, ErrInvalidContentLength)
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: +2\r\n\r\nok"))
+	require.ErrorIs(t, err, ErrInvalidContentLength)
+
+	// Test: Transfer-Encoding is refused, and ambiguous with Content-Length
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n"))
+	require.ErrorIs(t, err, ErrUnsupportedTransferEncoding)
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 2\r\n\r\nok"))
+	require.ErrorIs(t, err, ErrInvalidContentLength)
 
 	// Test: Empty Body, 0 reported content length
 	reader = &chunkReader{
@@ -218,3 +251,110 @@ func TestBodyParse(t *testing.T) {
 	require.NotNil(t, r)
 	assert.Empty(t, r.Body)
 }
+
+func encode(t *testing.T, coding string, data []byte) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	var w io.WriteCloser
+	switch coding {
+	case "gzip":
+		w = gzip.NewWriter(buf)
+	case "deflate":
+		w = zlib.NewWriter(buf)
+	case "raw-deflate":
+		fw, err := flate.NewWriter(buf, flate.DefaultCompression)
+		require.NoError(t, err)
+		w = fw
+	}
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func encodedRequest(contentEncoding string, body []byte) *Request {
+	h := headers.NewHeaders()
+	h.Set("Content-Encoding", contentEncoding)
+	h.Set("Content-Length", "1")
+	return &Request{Headers: h, Body: body}
+}
+
+func TestDecodeBody(t *testing.T) {
+	payload := []byte(strings.Repeat("hello world!\n", 100))
+
+	// Test: Gzip body
+	r := encodedRequest("gzip", encode(t, "gzip", payload))
+	require.NoError(t, r.DecodeBody(1<<20))
+	assert.Equal(t, payload, r.Body)
+	_, ok := r.Headers.Get("Content-Encoding")
+	assert.False(t, ok)
+	assert.Equal(t, "1300", r.Headers["content-length"])
+
+	// Test: Zlib wrapped deflate body
+	r = encodedRequest("deflate", encode(t, "deflate", payload))
+	require.NoError(t, r.DecodeBody(1<<20))
+	assert.Equal(t, payload, r.Body)
+
+	// Test: Raw deflate body
+	r = encodedRequest("deflate", encode(t, "raw-deflate", payload))
+	require.NoError(t, r.DecodeBody(1<<20))
+	assert.Equal(t, payload, r.Body)
+
+	// Test: Stacked codings are decoded in reverse order
+	r = encodedRequest("deflate, gzip", encode(t, "gzip", encode(t, "deflate", payload)))
+	require.NoError(t, r.DecodeBody(1<<20))
+	assert.Equal(t, payload, r.Body)
+
+	// Test: No Content-Encoding leaves the body untouched
+	r = &Request{Headers: headers.NewHeaders(), Body: []byte("plain")}
+	require.NoError(t, r.DecodeBody(1<<20))
+	assert.Equal(t, "plain", string(r.Body))
+
+	// Test: Unsupported coding
+	r = encodedRequest("br", []byte("whatever"))
+	assert.ErrorIs(t, r.DecodeBody(1<<20), ErrUnsupportedEncoding)
+
+	// Test: Decoded size limit
+	bomb := encode(t, "gzip", make([]byte, 10<<20))
+	r = encodedRequest("gzip", bomb)
+	assert.ErrorIs(t, r.DecodeBody(1<<20), ErrBodyTooLarge)
+
+	// Test: Corrupt gzip body
+	r = encodedRequest("gzip", []byte("not gzip at all"))
+	require.Error(t, r.DecodeBody(1<<20))
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	reader := NewReader(&chunkReader{
+		data: "POST /one HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nfirst" +
+			"GET /two HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+			"POST /three HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nthird",
+		numBytesPerRead: 1024,
+	})
+
+	// Test: Bytes past a body are kept for the next request
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/one", r.RequestLine.RequestTarget)
+	assert.Equal(t, "first", string(r.Body))
+
+	// Test: A request already buffered is parsed without reading
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/two", r.RequestLine.RequestTarget)
+	assert.Empty(t, r.Body)
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/three", r.RequestLine.RequestTarget)
+	assert.Equal(t, "third", string(r.Body))
+
+	// Test: The connection ending between requests is io.EOF
+	_, err = reader.ReadRequest()
+	assert.Equal(t, io.EOF, err)
+
+	// Test: The connection ending within a request
+	reader = NewReader(&chunkReader{data: "GET / HTTP/1.1\r\nHost: local", numBytesPerRead: 3})
+	_, err = reader.ReadRequest()
+	assert.ErrorIs(t, err, ErrIncompleteRequest)
+}
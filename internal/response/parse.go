@@ -0,0 +1,294 @@
+package response
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+)
+
+type parseStatus int
+
+const (
+	parseStatusStatusLine parseStatus = iota
+	parseStatusHeaders
+	parseStatusBody
+	parseStatusChunkSize
+	parseStatusChunkData
+	parseStatusTrailers
+	parseStatusUntilClose
+	parseStatusDone
+)
+
+const bufferSize = 1024
+
+var ErrIncompleteResponse = errors.New("incomplete response")
+
+type Response struct {
+	HttpVersion string
+	StatusCode  StatusCode
+	Reason      string
+	Headers     headers.Headers
+	Body        []byte
+	Trailers    headers.Headers
+	// Chunked reports whether the body used chunked transfer coding.
+	Chunked bool
+	// CloseDelimited reports whether the body ended with the connection,
+	// which then can't carry another response.
+	CloseDelimited bool
+	// Interim holds the 1xx responses that preceded this one.
+	Interim []*Response
+
+	status        parseStatus
+	method        string
+	contentLength int
+	chunkLeft     int
+}
+
+func parseStatusLine(data []byte) (string, StatusCode, string, int, error) {
+	idx := bytes.Index(data, []byte("\r\n"))
+	if idx == -1 {
+		return "", 0, "", 0, nil
+	}
+	parts := strings.SplitN(string(data[:idx]), " ", 3)
+	if len(parts) < 2 {
+		return "", 0, "", 0, errors.New("invalid status line structure")
+	}
+	version, ok := strings.CutPrefix(parts[0], "HTTP/")
+	if !ok || (version != "1.1" && version != "1.0") {
+		return "", 0, "", 0, fmt.Errorf("invalid http version: %s", parts[0])
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil || len(parts[1]) != 3 {
+		return "", 0, "", 0, fmt.Errorf("invalid status code: %s", parts[1])
+	}
+	reason := ""
+	if len(parts) == 3 {
+		reason = parts[2]
+	}
+	return version, StatusCode(code), reason, idx + 2, nil
+}
+
+func (r *Response) parseSingle(data []byte) (int, error) {
+	switch r.status {
+	case parseStatusStatusLine:
+		version, code, reason, n, err := parseStatusLine(data)
+		if err != nil || n == 0 {
+			return 0, err
+		}
+		r.HttpVersion, r.StatusCode, r.Reason = version, code, reason
+		r.status = parseStatusHeaders
+		return n, nil
+	case parseStatusHeaders:
+		n, done, err := r.Headers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+		if done {
+			if err := r.startBody(); err != nil {
+				return 0, err
+			}
+		}
+		return n, nil
+	case parseStatusBody:
+		n := min(len(data), r.contentLength-len(r.Body))
+		r.Body = append(r.Body, data[:n]...)
+		if len(r.Body) == r.contentLength {
+			r.status = parseStatusDone
+		}
+		return n, nil
+	case parseStatusChunkSize:
+		idx := bytes.Index(data, []byte("\r\n"))
+		if idx == -1 {
+			return 0, nil
+		}
+		line, _, _ := strings.Cut(string(data[:idx]), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("invalid chunk size: %q", line)
+		}
+		r.chunkLeft = int(size)
+		r.status = parseStatusChunkData
+		if size == 0 {
+			r.status = parseStatusTrailers
+		}
+		return idx + 2, nil
+	case parseStatusChunkData:
+		if r.chunkLeft > 0 {
+			n := min(len(data), r.chunkLeft)
+			r.Body = append(r.Body, data[:n]...)
+			r.chunkLeft -= n
+			return n, nil
+		}
+		if len(data) < 2 {
+			return 0, nil
+		}
+		if !bytes.HasPrefix(data, []byte("\r\n")) {
+			return 0, errors.New("missing CRLF after chunk")
+		}
+		r.status = parseStatusChunkSize
+		return 2, nil
+	case parseStatusTrailers:
+		n, done, err := r.Trailers.Parse(data)
+		if err != nil {
+			return 0, err
+		}
+		if done {
+			r.status = parseStatusDone
+		}
+		return n, nil
+	case parseStatusUntilClose:
+		r.Body = append(r.Body, data...)
+		return len(data), nil
+	case parseStatusDone:
+		return 0, errors.New("trying to read data in a done state")
+	default:
+		return 0, errors.New("unknown status")
+	}
+}
+
+// startBody picks how the body is delimited once the headers are in,
+// following RFC 9112, section 6.3.
+func (r *Response) startBody() error {
+	if r.method == "HEAD" || (r.method == "CONNECT" && r.StatusCode >= 200 && r.StatusCode < 300) ||
+		(r.StatusCode >= 100 && r.StatusCode < 200) || r.StatusCode == NoContent || r.StatusCode == NotModified {
+		r.status = parseStatusDone
+		return nil
+	}
+	if te, ok := r.Headers.Get("Transfer-Encoding"); ok {
+		codings := strings.Split(strings.ToLower(te), ",")
+		if strings.TrimSpace(codings[len(codings)-1]) == "chunked" {
+			r.Chunked = true
+			r.status = parseStatusChunkSize
+			return nil
+		}
+		r.CloseDelimited = true
+		r.status = parseStatusUntilClose
+		return nil
+	}
+	if val, ok := r.Headers.Get("Content-Length"); ok {
+		contentLength, err := strconv.Atoi(val)
+		if err != nil || contentLength < 0 {
+			return fmt.Errorf("invalid content length value: %s", val)
+		}
+		r.contentLength = contentLength
+		r.status = parseStatusBody
+		if contentLength == 0 {
+			r.status = parseStatusDone
+		}
+		return nil
+	}
+	r.CloseDelimited = true
+	r.status = parseStatusUntilClose
+	return nil
+}
+
+func (r *Response) parse(data []byte) (int, error) {
+	totalParsed := 0
+	for r.status != parseStatusDone {
+		n, err := r.parseSingle(data[totalParsed:])
+		if err != nil {
+			return 0, err
+		}
+		totalParsed += n
+		if n == 0 {
+			break
+		}
+	}
+	return totalParsed, nil
+}
+
+func ResponseFromReader(reader io.Reader) (*Response, error) {
+	return NewReader(reader).ReadResponse("GET")
+}
+
+// Reader parses responses from a connection and keeps the bytes it read
+// past the end of a response for the next one.
+type Reader struct {
+	reader      io.Reader
+	buf         []byte
+	readToIndex int
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, bufferSize),
+	}
+}
+
+// Buffered returns the bytes read from the connection that the parser
+// hasn't consumed.
+func (r *Reader) Buffered() []byte {
+	return r.buf[:r.readToIndex]
+}
+
+// ReadResponse parses the response to a request with the given method,
+// which decides whether a body may follow: responses to HEAD and
+// successful responses to CONNECT have none. Interim 1xx responses other
+// than 101 are collected in Interim of the final response.
+func (r *Reader) ReadResponse(method string) (*Response, error) {
+	var interim []*Response
+	for {
+		resp, err := r.readOne(method)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == SwitchingProtocols {
+			resp.Interim = interim
+			return resp, nil
+		}
+		interim = append(interim, resp)
+	}
+}
+
+func (r *Reader) readOne(method string) (*Response, error) {
+	resp := &Response{
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		Body:     []byte{},
+		method:   method,
+		status:   parseStatusStatusLine,
+	}
+
+	for resp.status != parseStatusDone {
+		// Whatever is already buffered goes through the parser first.
+		n, err := resp.parse(r.buf[:r.readToIndex])
+		if err != nil {
+			return nil, err
+		}
+		if n != 0 {
+			_ = copy(r.buf, r.buf[n:r.readToIndex])
+			r.readToIndex -= n
+			continue
+		}
+		if resp.status == parseStatusDone {
+			break
+		}
+
+		if r.readToIndex >= len(r.buf) {
+			newBuf := make([]byte, 2*len(r.buf))
+			_ = copy(newBuf, r.buf)
+			r.buf = newBuf
+		}
+		n, err = r.reader.Read(r.buf[r.readToIndex:])
+		r.readToIndex += n
+		if err != nil {
+			if err == io.EOF && n == 0 {
+				if resp.status == parseStatusUntilClose {
+					resp.status = parseStatusDone
+					break
+				}
+				return nil, ErrIncompleteResponse
+			}
+			if err != io.EOF {
+				return nil, err
+			}
+		}
+	}
+	return resp, nil
+}
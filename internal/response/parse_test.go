@@ -0,0 +1,114 @@
+package response
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chunkReader returns up to numBytesPerRead bytes per Read.
+type chunkReader struct {
+	data            string
+	numBytesPerRead int
+	pos             int
+}
+
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+	endIndex := min(cr.pos+cr.numBytesPerRead, len(cr.data))
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+	return n, nil
+}
+
+func TestResponseFromReader(t *testing.T) {
+	// Test: Content-Length body read a few bytes at a time
+	resp, err := ResponseFromReader(&chunkReader{
+		data:            "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Type: text/plain\r\n\r\nhello",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", resp.HttpVersion)
+	assert.Equal(t, OK, resp.StatusCode)
+	assert.Equal(t, "OK", resp.Reason)
+	assert.Equal(t, "text/plain", resp.Headers["content-type"])
+	assert.Equal(t, "hello", string(resp.Body))
+	assert.False(t, resp.Chunked)
+
+	// Test: Chunked body with extensions and trailers
+	resp, err = ResponseFromReader(&chunkReader{
+		data: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5;ext=1\r\nhello\r\n7\r\n, world\r\n0\r\nX-Checksum: abc\r\n\r\n",
+		numBytesPerRead: 4,
+	})
+	require.NoError(t, err)
+	assert.True(t, resp.Chunked)
+	assert.Equal(t, "hello, world", string(resp.Body))
+	assert.Equal(t, "abc", resp.Trailers["x-checksum"])
+
+	// Test: Body delimited by closing the connection
+	resp, err = ResponseFromReader(strings.NewReader("HTTP/1.0 200 OK\r\n\r\nuntil the end"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", resp.HttpVersion)
+	assert.True(t, resp.CloseDelimited)
+	assert.Equal(t, "until the end", string(resp.Body))
+
+	// Test: Interim responses come before the final one
+	resp, err = ResponseFromReader(strings.NewReader("HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 103 Early Hints\r\nLink: </a>\r\n\r\nHTTP/1.1 204 No Content\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, NoContent, resp.StatusCode)
+	assert.Empty(t, resp.Body)
+	require.Len(t, resp.Interim, 2)
+	assert.Equal(t, Continue, resp.Interim[0].StatusCode)
+	assert.Equal(t, "</a>", resp.Interim[1].Headers["link"])
+
+	// Test: 304 has no body despite Content-Length
+	resp, err = ResponseFromReader(strings.NewReader("HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Empty(t, resp.Body)
+
+	// Test: Truncated body
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort"))
+	assert.ErrorIs(t, err, ErrIncompleteResponse)
+
+	// Test: Malformed status line, chunk size and chunk framing
+	_, err = ResponseFromReader(strings.NewReader("HTTP/2 200 OK\r\n\r\n"))
+	assert.Error(t, err)
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 20 OK\r\n\r\n"))
+	assert.Error(t, err)
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n"))
+	assert.Error(t, err)
+	_, err = ResponseFromReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nokX"))
+	assert.Error(t, err)
+}
+
+func TestReader(t *testing.T) {
+	r := NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n" +
+		"HTTP/1.1 200 Connection Established\r\n\r\n" +
+		"HTTP/1.1 404 Not Found\r\nContent-Length: 4\r\n\r\nnope" +
+		"tunnel bytes"))
+
+	// Test: HEAD responses have no body despite Content-Length
+	resp, err := r.ReadResponse("HEAD")
+	require.NoError(t, err)
+	assert.Empty(t, resp.Body)
+
+	// Test: Successful CONNECT responses have no body
+	resp, err = r.ReadResponse("CONNECT")
+	require.NoError(t, err)
+	assert.Equal(t, "Connection Established", resp.Reason)
+	assert.Empty(t, resp.Body)
+
+	// Test: Pipelined responses are read in order and the rest stays buffered
+	resp, err = r.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, NotFound, resp.StatusCode)
+	assert.Equal(t, "nope", string(resp.Body))
+	assert.Equal(t, "tunnel bytes", string(r.Buffered()))
+}
@@ -8,16 +8,135 @@ import (
 
 type StatusCode int
 
+// TimeFormat is the IMF-fixdate layout used by the Date header.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
 const (
-	OK                  StatusCode = 200
-	BadRequest          StatusCode = 400
-	InternalServerError StatusCode = 500
+	Continue                    StatusCode = 100
+	SwitchingProtocols          StatusCode = 101
+	EarlyHints                  StatusCode = 103
+	OK                          StatusCode = 200
+	Created                     StatusCode = 201
+	Accepted                    StatusCode = 202
+	NonAuthoritativeInfo        StatusCode = 203
+	NoContent                   StatusCode = 204
+	ResetContent                StatusCode = 205
+	PartialContent              StatusCode = 206
+	MultipleChoices             StatusCode = 300
+	MovedPermanently            StatusCode = 301
+	Found                       StatusCode = 302
+	SeeOther                    StatusCode = 303
+	NotModified                 StatusCode = 304
+	TemporaryRedirect           StatusCode = 307
+	PermanentRedirect           StatusCode = 308
+	BadRequest                  StatusCode = 400
+	Unauthorized                StatusCode = 401
+	Forbidden                   StatusCode = 403
+	NotFound                    StatusCode = 404
+	MethodNotAllowed            StatusCode = 405
+	NotAcceptable               StatusCode = 406
+	ProxyAuthRequired           StatusCode = 407
+	RequestTimeout              StatusCode = 408
+	Conflict                    StatusCode = 409
+	Gone                        StatusCode = 410
+	LengthRequired              StatusCode = 411
+	PreconditionFailed          StatusCode = 412
+	ContentTooLarge             StatusCode = 413
+	URITooLong                  StatusCode = 414
+	UnsupportedMediaType        StatusCode = 415
+	RangeNotSatisfiable         StatusCode = 416
+	ExpectationFailed           StatusCode = 417
+	MisdirectedRequest          StatusCode = 421
+	UnprocessableContent        StatusCode = 422
+	UpgradeRequired             StatusCode = 426
+	PreconditionRequired        StatusCode = 428
+	TooManyRequests             StatusCode = 429
+	RequestHeaderFieldsTooLarge StatusCode = 431
+	InternalServerError         StatusCode = 500
+	NotImplemented              StatusCode = 501
+	BadGateway                  StatusCode = 502
+	ServiceUnavailable          StatusCode = 503
+	GatewayTimeout              StatusCode = 504
+	HTTPVersionNotSupported     StatusCode = 505
 )
 
+var statusText = map[StatusCode]string{
+	Continue:                    "Continue",
+	SwitchingProtocols:          "Switching Protocols",
+	EarlyHints:                  "Early Hints",
+	OK:                          "OK",
+	Created:                     "Created",
+	Accepted:                    "Accepted",
+	NonAuthoritativeInfo:        "Non-Authoritative Information",
+	NoContent:                   "No Content",
+	ResetContent:                "Reset Content",
+	PartialContent:              "Partial Content",
+	MultipleChoices:             "Multiple Choices",
+	MovedPermanently:            "Moved Permanently",
+	Found:                       "Found",
+	SeeOther:                    "See Other",
+	NotModified:                 "Not Modified",
+	TemporaryRedirect:           "Temporary Redirect",
+	PermanentRedirect:           "Permanent Redirect",
+	BadRequest:                  "Bad Request",
+	Unauthorized:                "Unauthorized",
+	Forbidden:                   "Forbidden",
+	NotFound:                    "Not Found",
+	MethodNotAllowed:            "Method Not Allowed",
+	NotAcceptable:               "Not Acceptable",
+	ProxyAuthRequired:           "Proxy Authentication Required",
+	RequestTimeout:              "Request Timeout",
+	Conflict:                    "Conflict",
+	Gone:                        "Gone",
+	LengthRequired:              "Length Required",
+	PreconditionFailed:          "Precondition Failed",
+	ContentTooLarge:             "Content Too Large",
+	URITooLong:                  "URI Too Long",
+	UnsupportedMediaType:        "Unsupported Media Type",
+	RangeNotSatisfiable:         "Range Not Satisfiable",
+	ExpectationFailed:           "Expectation Failed",
+	MisdirectedRequest:          "Misdirected Request",
+	UnprocessableContent:        "Unprocessable Content",
+	UpgradeRequired:             "Upgrade Required",
+	PreconditionRequired:        "Precondition Required",
+	TooManyRequests:             "Too Many Requests",
+	RequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	InternalServerError:         "Internal Server Error",
+	NotImplemented:              "Not Implemented",
+	BadGateway:                  "Bad Gateway",
+	ServiceUnavailable:          "Service Unavailable",
+	GatewayTimeout:              "Gateway Timeout",
+	HTTPVersionNotSupported:     "HTTP Version Not Supported",
+}
+
+// StatusText returns the reason phrase for code, or an empty string if the code is unknown.
+func StatusText(code StatusCode) string {
+	return statusText[code]
+}
+
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	h := headers.NewHeaders()
 	h.Set("Content-Length", fmt.Sprintf("%d", contentLen))
-	h.Set("Connection", "close")
 	h.Set("Content-Type", "text/plain")
 	return h
 }
+
+// WriteError answers with code and a plain text body naming it. Headers in
+// h, which may be nil, are sent along with the defaults.
+func WriteError(w *Writer, code StatusCode, h headers.Headers) error {
+	message := []byte(fmt.Sprintf("%d %s\n", code, StatusText(code)))
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	for k, v := range GetDefaultHeaders(len(message)) {
+		h.Replace(k, v)
+	}
+	if err := w.WriteStatusLine(code); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	_, err := w.WriteBody(message)
+	return err
+}
@@ -1,12 +1,26 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/ar3ty/httpfromtcp/internal/headers"
 )
 
+var (
+	ErrNotHijackable = errors.New("connection can't be hijacked")
+	ErrHijacked      = errors.New("connection has been hijacked")
+	ErrAborted       = errors.New("response has been aborted")
+	// ErrContentLength is returned by body writes past the declared
+	// Content-Length, and by Finish when the body is short of it.
+	ErrContentLength = errors.New("body length doesn't match Content-Length")
+)
+
 type WriterState int
 
 const (
@@ -14,50 +28,167 @@ const (
 	writingHeaders
 	writingBody
 	writingTrailers
+	writingDone
 )
 
+// BodyFilter is called right before the headers are sent. It may modify the
+// headers and return a writer wrapping body that receives every body byte.
+// If the returned writer is an io.Closer, it is closed when the body ends.
+type BodyFilter func(code StatusCode, h headers.Headers, body io.Writer) io.Writer
+
+// Framer carries a response over something other than HTTP/1.1 text,
+// like an HTTP/2 stream. Body bytes arrive through Write. Framers with an
+// Abort method have it called when the response is aborted.
+type Framer interface {
+	io.Writer
+	WriteHeaders(code StatusCode, h headers.Headers) error
+	WriteTrailers(h headers.Headers) error
+}
+
+// connectionHeaders only make sense on an HTTP/1.1 connection and are
+// dropped when a Framer is used.
+var connectionHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
 type Writer struct {
-	state  WriterState
-	writer io.Writer
+	state      WriterState
+	writer     io.Writer
+	dst        io.Writer
+	framer     Framer
+	err        error
+	defaults   headers.Headers
+	filters    []BodyFilter
+	status     StatusCode
+	body       io.Writer
+	closers    []io.Closer
+	chunked    bool
+	closeAfter bool
+	sent       int64
+	head       bool
+	// remaining counts the body bytes still owed to the declared
+	// Content-Length, or is -1 when the length isn't tracked.
+	remaining  int64
+	noSendfile bool
+	hijacker   func() (net.Conn, []byte, error)
+	hijacked   bool
+	aborted    bool
+	onFinish   []func()
 }
 
 func NewWriter(w io.Writer) *Writer {
+	writer := &Writer{
+		state:    writingStatusLine,
+		dst:      w,
+		defaults: headers.NewHeaders(),
+	}
+	writer.writer = errRecorder{writer}
+	return writer
+}
+
+// NewFramedWriter returns a Writer that hands the response to f.
+func NewFramedWriter(f Framer) *Writer {
 	return &Writer{
-		state:  writingStatusLine,
-		writer: w,
+		state:    writingStatusLine,
+		framer:   f,
+		defaults: headers.NewHeaders(),
 	}
 }
 
+// SetRequestMethod tells the Writer the method of the request it
+// answers. Responses to HEAD have no body: what handlers write to it is
+// dropped, and their Content-Length isn't checked against it.
+func (w *Writer) SetRequestMethod(method string) {
+	w.head = method == "HEAD"
+}
+
+// SetDefaultHeader registers a header that is sent with the response
+// unless the handler provides its own value for the same key.
+func (w *Writer) SetDefaultHeader(key, value string) {
+	w.defaults.Replace(key, value)
+}
+
+// AddBodyFilter registers f to run when the headers are written. Filters
+// added later wrap the body writers returned by earlier ones.
+func (w *Writer) AddBodyFilter(f BodyFilter) {
+	w.filters = append(w.filters, f)
+}
+
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	if w.state != writingStatusLine {
-		return fmt.Errorf("writing status-line is not allowed in current state")
+	if err := w.checkState(writingStatusLine, "status-line"); err != nil {
+		return err
 	}
 	defer func() { w.state = writingHeaders }()
-
-	var reasonPhrase string
-	switch statusCode {
-	case OK:
-		reasonPhrase = "OK"
-	case BadRequest:
-		reasonPhrase = "Bad Request"
-	case InternalServerError:
-		reasonPhrase = "Internal Server Error"
-	default:
-		reasonPhrase = ""
+	w.status = statusCode
+	if w.framer != nil {
+		return nil
 	}
-	status := []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, reasonPhrase))
+
+	status := []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, StatusText(statusCode)))
 
 	_, err := w.writer.Write(status)
 	return err
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
-	if w.state != writingHeaders {
-		return fmt.Errorf("writing headers is not allowed in current state")
+func (w *Writer) WriteHeaders(h headers.Headers) error {
+	if err := w.checkState(writingHeaders, "headers"); err != nil {
+		return err
 	}
 	defer func() { w.state = writingBody }()
 
-	for key, value := range headers {
+	// Defaults and body filters change the headers, so they work on a copy
+	// and the caller's map can be reused.
+	sent := make(headers.Headers, len(h)+len(w.defaults))
+	for key, value := range h {
+		sent[key] = value
+	}
+	h = sent
+	for key, value := range w.defaults {
+		if _, ok := h.Get(key); !ok {
+			h.Set(key, value)
+		}
+	}
+
+	w.body = entityWriter{w}
+	if w.framer != nil {
+		w.body = framedBody{w}
+	}
+	if w.head {
+		w.body = io.Discard
+	}
+	for _, filter := range w.filters {
+		body := filter(w.status, h, w.body)
+		if body == w.body {
+			continue
+		}
+		if c, ok := body.(io.Closer); ok {
+			w.closers = append([]io.Closer{c}, w.closers...)
+		}
+		w.body = body
+	}
+
+	te, _ := h.Get("Transfer-Encoding")
+	w.chunked = strings.Contains(strings.ToLower(te), "chunked")
+	connection, _ := h.Get("Connection")
+	length, hasLength := h.Get("Content-Length")
+	bodyless := w.status < 200 || w.status == NoContent || w.status == NotModified
+	w.closeAfter = headers.HasToken(connection, "close") || (!w.chunked && !hasLength && !bodyless)
+	w.remaining = -1
+	if hasLength && !w.chunked && !bodyless && !w.head {
+		n, err := strconv.ParseInt(length, 10, 64)
+		if err != nil || n < 0 {
+			w.closeAfter = true
+		} else {
+			w.remaining = n
+		}
+	}
+
+	if w.framer != nil {
+		for _, key := range connectionHeaders {
+			h.Delete(key)
+		}
+		return w.fail(w.framer.WriteHeaders(w.status, h))
+	}
+
+	for key, value := range h {
 		_, err := w.writer.Write([]byte(fmt.Sprintf("%s: %s\r\n", key, value)))
 		if err != nil {
 			return err
@@ -69,17 +200,284 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 }
 
 func (w *Writer) WriteBody(p []byte) (int, error) {
-	if w.state != writingBody {
-		return 0, fmt.Errorf("writing body is not allowed in current state")
+	if err := w.checkState(writingBody, "body"); err != nil {
+		return 0, err
+	}
+	return w.body.Write(p)
+}
+
+// SetHijacker installs the function Hijack uses to take over the connection.
+func (w *Writer) SetHijacker(hijacker func() (net.Conn, []byte, error)) {
+	w.hijacker = hijacker
+}
+
+// Hijack hands the connection over to the caller, who becomes responsible
+// for closing it. The returned bytes were already read from the connection
+// by the request parser and must be processed before reading from conn.
+// Every Writer method fails with ErrHijacked afterwards.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if w.aborted {
+		return nil, nil, ErrAborted
+	}
+	if w.hijacker == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	conn, buffered, err := w.hijacker()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	return conn, buffered, nil
+}
+
+// Hijackable reports whether Hijack can be tried, for handlers that
+// must know before answering. Framed writers can't be hijacked.
+func (w *Writer) Hijackable() bool {
+	return w.hijacker != nil && !w.hijacked && !w.aborted
+}
+
+// Hijacked reports whether the connection was taken over by Hijack.
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+// Status returns the status code of the response, zero before
+// WriteStatusLine.
+func (w *Writer) Status() StatusCode {
+	return w.status
+}
+
+// BytesSent returns how many body bytes were sent, after body filters
+// and without transfer coding overhead.
+func (w *Writer) BytesSent() int64 {
+	return w.sent
+}
+
+// Err returns the first error met writing to the connection. Writes on a
+// connection the client has gone away from fail this way.
+func (w *Writer) Err() error {
+	return w.err
+}
+
+// OnFinish registers f to run once the response is finished or aborted,
+// before Finish writes anything. Handlers use it to stop goroutines that
+// would otherwise keep writing to w after they return.
+func (w *Writer) OnFinish(f func()) {
+	w.onFinish = append(w.onFinish, f)
+}
+
+func (w *Writer) runOnFinish() {
+	hooks := w.onFinish
+	w.onFinish = nil
+	for _, f := range hooks {
+		f()
+	}
+}
+
+// Abort gives up on a response that can't be completed. The client sees
+// it cut short: the connection is closed, or the HTTP/2 stream reset.
+// Every Writer method fails with ErrAborted afterwards.
+func (w *Writer) Abort() {
+	if w.aborted || w.hijacked {
+		return
+	}
+	w.aborted = true
+	w.runOnFinish()
+	if a, ok := w.framer.(interface{ Abort() }); ok {
+		a.Abort()
+	}
+}
+
+// KeepAlive reports whether the connection can carry another response
+// once this one is finished: the headers were sent, the body has its own
+// framing and matches its Content-Length, and the response didn't ask for
+// the connection to be closed.
+func (w *Writer) KeepAlive() bool {
+	return !w.hijacked && !w.aborted && w.err == nil && w.state != writingStatusLine && w.state != writingHeaders &&
+		!w.closeAfter && w.remaining <= 0
+}
+
+func (w *Writer) checkState(state WriterState, part string) error {
+	if w.hijacked {
+		return ErrHijacked
+	}
+	if w.aborted {
+		return ErrAborted
+	}
+	if w.state != state {
+		return fmt.Errorf("writing %s is not allowed in current state", part)
+	}
+	return nil
+}
+
+// Write makes Writer an io.Writer for the response body.
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.WriteBody(p)
+}
+
+// DisableSendfile makes ReadFrom always copy through user space.
+func (w *Writer) DisableSendfile() {
+	w.noSendfile = true
+}
+
+// ReadFrom writes the body from r. When the response goes straight to a
+// *net.TCPConn and r is an *os.File, the copy is left to the connection,
+// which uses sendfile; everything else is copied through a buffer.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if err := w.checkState(writingBody, "body"); err != nil {
+		return 0, err
+	}
+	if conn, ok := w.sendfileConn(r); ok {
+		if w.remaining < 0 {
+			n, err := conn.ReadFrom(r)
+			w.sent += n
+			return n, w.fail(err)
+		}
+		// The limited reader still lets the connection use sendfile.
+		n, err := conn.ReadFrom(&io.LimitedReader{R: r, N: w.remaining})
+		w.sent += n
+		w.remaining -= n
+		if err != nil {
+			return n, w.fail(err)
+		}
+		if w.remaining == 0 {
+			if m, _ := r.Read(make([]byte, 1)); m > 0 {
+				return n, ErrContentLength
+			}
+		}
+		return n, nil
 	}
-	return w.writer.Write(p)
+	return io.Copy(struct{ io.Writer }{w.body}, r)
+}
+
+// sendfileConn returns the connection ReadFrom can hand r to, so that the
+// kernel copies it with sendfile.
+func (w *Writer) sendfileConn(r io.Reader) (*net.TCPConn, bool) {
+	conn, ok := w.dst.(*net.TCPConn)
+	if !ok || w.noSendfile || w.chunked {
+		return nil, false
+	}
+	if _, ok := w.body.(entityWriter); !ok {
+		return nil, false
+	}
+	if lr, ok := r.(*io.LimitedReader); ok {
+		r = lr.R
+	}
+	if _, ok := r.(*os.File); !ok {
+		return nil, false
+	}
+	return conn, true
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
-	if w.state != writingBody {
-		return 0, fmt.Errorf("writing body is not allowed in current state")
+	if err := w.checkState(writingBody, "body"); err != nil {
+		return 0, err
+	}
+	if w.chunked || w.framer != nil || w.head {
+		return w.body.Write(p)
+	}
+	n, err := w.writeChunk(p)
+	if err == nil {
+		w.sent += int64(len(p))
+	}
+	return n, err
+}
+
+func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if err := w.checkState(writingBody, "body"); err != nil {
+		return 0, err
+	}
+	defer func() { w.state = writingTrailers }()
+
+	if err := w.closeFilters(); err != nil {
+		return 0, err
+	}
+	if w.framer != nil || w.head {
+		return 0, nil
+	}
+
+	num := []byte("0\r\n")
+	n, err := w.writer.Write(num)
+	if err != nil {
+		return n, err
 	}
+	return 0, nil
+}
 
+func (w *Writer) WriteTrailers(h headers.Headers) error {
+	if err := w.checkState(writingTrailers, "trailers"); err != nil {
+		return err
+	}
+	defer func() { w.state = writingDone }()
+	if w.head {
+		return nil
+	}
+	if w.framer != nil {
+		return w.fail(w.framer.WriteTrailers(h))
+	}
+
+	for key, value := range h {
+		_, err := w.writer.Write([]byte(fmt.Sprintf("%s: %s\r\n", key, value)))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := w.writer.Write([]byte("\r\n"))
+	return err
+}
+
+// Finish completes a response the handler left open: it flushes body
+// filters and terminates a chunked body that has not been ended yet.
+func (w *Writer) Finish() error {
+	if w.hijacked {
+		return ErrHijacked
+	}
+	if w.aborted {
+		return ErrAborted
+	}
+	w.runOnFinish()
+	switch w.state {
+	case writingBody:
+		if !w.chunked {
+			w.state = writingDone
+			if err := w.closeFilters(); err != nil {
+				return err
+			}
+			if w.remaining > 0 {
+				// The client would wait for the missing bytes, or take
+				// the next response for them.
+				w.Abort()
+				return ErrContentLength
+			}
+			return nil
+		}
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+		return w.WriteTrailers(nil)
+	case writingTrailers:
+		return w.WriteTrailers(nil)
+	default:
+		return nil
+	}
+}
+
+func (w *Writer) closeFilters() error {
+	closers := w.closers
+	w.closers = nil
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writeChunk(p []byte) (int, error) {
 	total := 0
 	num := []byte(fmt.Sprintf("%x\r\n", len(p)))
 	n, err := w.writer.Write(num)
@@ -103,33 +501,74 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	return total, nil
 }
 
-func (w *Writer) WriteChunkedBodyDone() (int, error) {
-	if w.state != writingBody {
-		return 0, fmt.Errorf("writing body is not allowed in current state")
-	}
-	defer func() { w.state = writingTrailers }()
+// entityWriter is the innermost body writer; it frames data as chunks
+// when the response uses chunked transfer coding.
+type entityWriter struct {
+	w *Writer
+}
 
-	num := []byte("0\r\n")
-	n, err := w.writer.Write(num)
-	if err != nil {
+func (e entityWriter) Write(p []byte) (int, error) {
+	if !e.w.chunked {
+		p, over := e.w.limit(p)
+		n, err := e.w.writer.Write(p)
+		e.w.sent += int64(n)
+		if err == nil && over {
+			err = ErrContentLength
+		}
 		return n, err
 	}
-	return 0, nil
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := e.w.writeChunk(p); err != nil {
+		return 0, err
+	}
+	e.w.sent += int64(len(p))
+	return len(p), nil
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
-	if w.state != writingTrailers {
-		return fmt.Errorf("writing trailers is not allowed in current state")
+// framedBody is the innermost body writer of framed responses.
+type framedBody struct {
+	w *Writer
+}
+
+func (f framedBody) Write(p []byte) (int, error) {
+	p, over := f.w.limit(p)
+	n, err := f.w.framer.Write(p)
+	f.w.sent += int64(n)
+	if err == nil && over {
+		return n, ErrContentLength
 	}
-	defer func() { w.state = writingBody }()
+	return n, f.w.fail(err)
+}
 
-	for key, value := range h {
-		_, err := w.writer.Write([]byte(fmt.Sprintf("%s: %s\r\n", key, value)))
-		if err != nil {
-			return err
-		}
+// limit cuts p to the bytes still owed to the declared Content-Length and
+// reports whether it had to.
+func (w *Writer) limit(p []byte) ([]byte, bool) {
+	if w.remaining < 0 {
+		return p, false
+	}
+	over := int64(len(p)) > w.remaining
+	if over {
+		p = p[:w.remaining]
 	}
+	w.remaining -= int64(len(p))
+	return p, over
+}
 
-	_, err := w.writer.Write([]byte("\r\n"))
+// errRecorder keeps the first error of the connection for Err.
+type errRecorder struct {
+	w *Writer
+}
+
+func (e errRecorder) Write(p []byte) (int, error) {
+	n, err := e.w.dst.Write(p)
+	return n, e.w.fail(err)
+}
+
+func (w *Writer) fail(err error) error {
+	if err != nil && w.err == nil {
+		w.err = err
+	}
 	return err
 }
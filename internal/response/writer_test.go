@@ -0,0 +1,262 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterRoundTrip(t *testing.T) {
+	// Test: Fixed-length response
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(NotFound))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(9)))
+	_, err := w.WriteBody([]byte("not found"))
+	require.NoError(t, err)
+	resp, err := ResponseFromReader(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, NotFound, resp.StatusCode)
+	assert.Equal(t, "Not Found", resp.Reason)
+	assert.NotContains(t, resp.Headers, "connection")
+	assert.Equal(t, "not found", string(resp.Body))
+
+	// Test: Chunked response with trailers
+	buf.Reset()
+	w = NewWriter(&buf)
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("part one, "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("part two"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	resp, err = ResponseFromReader(&buf)
+	require.NoError(t, err)
+	assert.True(t, resp.Chunked)
+	assert.Equal(t, "part one, part two", string(resp.Body))
+	assert.Equal(t, "abc", resp.Trailers["x-checksum"])
+
+	// Test: Finish terminates a chunked body written through Write
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.Write([]byte(strings.Repeat("x", 3000)))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	resp, err = ResponseFromReader(&buf)
+	require.NoError(t, err)
+	assert.Len(t, resp.Body, 3000)
+	assert.Empty(t, resp.Trailers)
+
+	// Test: Default headers fill in what the handler left out
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetDefaultHeader("Server", "httpfromtcp")
+	require.NoError(t, w.WriteStatusLine(NoContent))
+	require.NoError(t, w.WriteHeaders(nil))
+	resp, err = ResponseFromReader(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, NoContent, resp.StatusCode)
+	assert.Equal(t, "httpfromtcp", resp.Headers["server"])
+
+	// Test: The handler's headers are left as they were
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetDefaultHeader("Server", "httpfromtcp")
+	w.AddBodyFilter(func(_ StatusCode, h headers.Headers, body io.Writer) io.Writer {
+		h.Set("Vary", "Accept-Encoding")
+		return body
+	})
+	plain := GetDefaultHeaders(0)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(plain))
+	assert.Equal(t, GetDefaultHeaders(0), plain)
+	resp, err = ResponseFromReader(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, "httpfromtcp", resp.Headers["server"])
+	assert.Equal(t, "Accept-Encoding", resp.Headers["vary"])
+
+	// Test: Writing out of order fails
+	w = NewWriter(&buf)
+	assert.Error(t, w.WriteHeaders(nil))
+	_, err = w.WriteBody([]byte("early"))
+	assert.Error(t, err)
+
+	// Test: An aborted response takes no more writes and ends the connection
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(h))
+	w.Abort()
+	_, err = w.WriteChunkedBody([]byte("late"))
+	assert.ErrorIs(t, err, ErrAborted)
+	assert.ErrorIs(t, w.Finish(), ErrAborted)
+	assert.False(t, w.KeepAlive())
+	assert.NotContains(t, buf.String(), "late")
+
+	// Test: Body writes are held to the declared Content-Length
+	length := headers.NewHeaders()
+	length.Set("Content-Length", "5")
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(length))
+	n, err := w.WriteBody([]byte("hello, world"))
+	assert.ErrorIs(t, err, ErrContentLength)
+	assert.Equal(t, 5, n)
+	require.NoError(t, w.Finish())
+	assert.True(t, w.KeepAlive())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello"))
+
+	// Test: A short body aborts the response
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(length))
+	_, err = w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	assert.False(t, w.KeepAlive())
+	assert.ErrorIs(t, w.Finish(), ErrContentLength)
+	assert.False(t, w.KeepAlive())
+
+	// Test: Responses to HEAD have no body to check
+	w = NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(length))
+	require.NoError(t, w.Finish())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Bodies written for HEAD are dropped
+	for _, chunked := range []bool{false, true} {
+		buf.Reset()
+		w = NewWriter(&buf)
+		w.SetRequestMethod("HEAD")
+		h := headers.NewHeaders()
+		if chunked {
+			h.Set("Transfer-Encoding", "chunked")
+		} else {
+			h.Set("Content-Length", "5")
+		}
+		require.NoError(t, w.WriteStatusLine(OK))
+		require.NoError(t, w.WriteHeaders(h))
+		n, err := w.WriteBody([]byte("hello"))
+		require.NoError(t, err)
+		assert.Equal(t, 5, n)
+		_, err = w.ReadFrom(strings.NewReader("hello"))
+		require.NoError(t, err)
+		require.NoError(t, w.Finish())
+		assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"))
+		assert.NotContains(t, buf.String(), "hello")
+		assert.True(t, w.KeepAlive())
+	}
+
+	// Test: Finish hooks run once, before the body is ended
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(OK))
+	require.NoError(t, w.WriteHeaders(h))
+	finished := 0
+	w.OnFinish(func() {
+		finished++
+		_, err := w.WriteChunkedBody([]byte("last"))
+		assert.NoError(t, err)
+	})
+	require.NoError(t, w.Finish())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 1, finished)
+	assert.Contains(t, buf.String(), "4\r\nlast\r\n0\r\n")
+
+	// Test: Error responses name their status and keep extra headers
+	buf.Reset()
+	w = NewWriter(&buf)
+	extra := headers.NewHeaders()
+	extra.Set("Allow", "GET")
+	require.NoError(t, WriteError(w, MethodNotAllowed, extra))
+	resp, err = ResponseFromReader(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, MethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "GET", resp.Headers["allow"])
+	assert.Equal(t, "405 Method Not Allowed\n", string(resp.Body))
+}
+
+func TestSendfile(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	server, err := listener.Accept()
+	require.NoError(t, err)
+	defer server.Close()
+
+	content := []byte(strings.Repeat("sendfile ", 1000))
+	path := filepath.Join(t.TempDir(), "body")
+	require.NoError(t, os.WriteFile(path, content, 0o644))
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	start := func(w *Writer, h headers.Headers) {
+		t.Helper()
+		require.NoError(t, w.WriteStatusLine(OK))
+		require.NoError(t, w.WriteHeaders(h))
+	}
+
+	// Test: Files sent over a TCP connection use sendfile
+	w := NewWriter(server)
+	start(w, GetDefaultHeaders(len(content)))
+	_, ok := w.sendfileConn(file)
+	assert.True(t, ok)
+	_, ok = w.sendfileConn(io.LimitReader(file, 10))
+	assert.True(t, ok)
+	n, err := w.ReadFrom(file)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+	assert.Equal(t, int64(len(content)), w.BytesSent())
+	require.NoError(t, w.Finish())
+	resp, err := ResponseFromReader(client)
+	require.NoError(t, err)
+	assert.Equal(t, content, resp.Body)
+
+	// Test: Other readers, writers and chunked bodies are copied
+	_, ok = w.sendfileConn(bytes.NewReader(content))
+	assert.False(t, ok)
+	_, ok = NewWriter(&bytes.Buffer{}).sendfileConn(file)
+	assert.False(t, ok)
+	w = NewWriter(server)
+	chunked := headers.NewHeaders()
+	chunked.Set("Transfer-Encoding", "chunked")
+	start(w, chunked)
+	_, ok = w.sendfileConn(file)
+	assert.False(t, ok)
+
+	// Test: DisableSendfile copies files too
+	w = NewWriter(server)
+	w.DisableSendfile()
+	start(w, GetDefaultHeaders(len(content)))
+	_, ok = w.sendfileConn(file)
+	assert.False(t, ok)
+	_, err = file.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	n, err = w.ReadFrom(file)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"io"
+	"net"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/debug"
+)
+
+// ConnState is what a client connection is doing.
+type ConnState int
+
+const (
+	// StateNew is a connection just accepted, waiting for its first
+	// request or in its TLS handshake.
+	StateNew ConnState = iota
+	// StateReading is a connection reading a request.
+	StateReading
+	// StateActive is a connection with a handler running, or serving
+	// HTTP/2.
+	StateActive
+	// StateIdle is a connection waiting for its next request.
+	StateIdle
+	// StateHijacked is a connection taken over by a handler. It is final:
+	// the server no longer tracks the connection.
+	StateHijacked
+	// StateClosed is a connection the server closed. It is final.
+	StateClosed
+)
+
+func (c ConnState) String() string {
+	switch c {
+	case StateNew:
+		return "new"
+	case StateReading:
+		return "reading"
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateHijacked:
+		return "hijacked"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnInfo describes an open client connection. Hijacked connections
+// are no longer tracked.
+type ConnInfo struct {
+	RemoteAddr string
+	// Proto is "http/1.1", "h2" or "h2c".
+	Proto string
+	State ConnState
+	// Since is when the connection was accepted.
+	Since time.Time
+}
+
+// trackedConn is the entry of a connection in Server.conns. info is
+// guarded by Server.mu.
+type trackedConn struct {
+	conn net.Conn
+	info ConnInfo
+}
+
+func (s *Server) track(conn net.Conn) *trackedConn {
+	tc := &trackedConn{conn: conn, info: ConnInfo{
+		RemoteAddr: conn.RemoteAddr().String(),
+		Proto:      "http/1.1",
+		State:      StateNew,
+		Since:      time.Now(),
+	}}
+	s.mu.Lock()
+	if s.conns == nil {
+		s.conns = map[*trackedConn]struct{}{}
+	}
+	s.conns[tc] = struct{}{}
+	s.mu.Unlock()
+	if s.config.ConnState != nil {
+		s.config.ConnState(conn, StateNew)
+	}
+	return tc
+}
+
+// untrack drops a connection that was closed or hijacked.
+func (s *Server) untrack(tc *trackedConn, state ConnState) {
+	s.mu.Lock()
+	delete(s.conns, tc)
+	s.mu.Unlock()
+	if s.config.ConnState != nil {
+		s.config.ConnState(tc.conn, state)
+	}
+}
+
+// setState moves a connection to state, if it is in one of from when
+// given.
+func (s *Server) setState(tc *trackedConn, state ConnState, from ...ConnState) {
+	s.mu.Lock()
+	old := tc.info.State
+	changed := old != state && (len(from) == 0 || slices.Contains(from, old))
+	if changed {
+		tc.info.State = state
+	}
+	s.mu.Unlock()
+	if changed && s.config.ConnState != nil {
+		s.config.ConnState(tc.conn, state)
+	}
+}
+
+func (s *Server) setProto(tc *trackedConn, proto string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tc.info.Proto = proto
+}
+
+// Conns returns the open connections, oldest first.
+func (s *Server) Conns() []ConnInfo {
+	s.mu.Lock()
+	conns := make([]ConnInfo, 0, len(s.conns))
+	for tc := range s.conns {
+		conns = append(conns, tc.info)
+	}
+	s.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Since.Before(conns[j].Since) })
+	return conns
+}
+
+// stateReader marks a new or idle connection as reading once bytes of
+// the next request arrive.
+type stateReader struct {
+	r  io.Reader
+	s  *Server
+	tc *trackedConn
+}
+
+func (sr stateReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	if n > 0 {
+		sr.s.setState(sr.tc, StateReading, StateNew, StateIdle)
+	}
+	return n, err
+}
+
+// debugSource shows a server on the debug endpoints.
+type debugSource struct {
+	s *Server
+}
+
+func (d debugSource) Conns() []debug.Conn {
+	var conns []debug.Conn
+	for _, c := range d.s.Conns() {
+		conns = append(conns, debug.Conn{RemoteAddr: c.RemoteAddr, Proto: c.Proto, State: c.State.String(), Since: c.Since})
+	}
+	return conns
+}
+
+func (d debugSource) Settings() any {
+	c := d.s.config
+	return struct {
+		Addr               string `json:"addr"`
+		ServerName         string `json:"server_name"`
+		TLS                bool   `json:"tls"`
+		EnableH2C          bool   `json:"enable_h2c"`
+		IdleTimeout        string `json:"idle_timeout"`
+		DecodeBodies       bool   `json:"decode_bodies"`
+		MaxDecodedBodySize int    `json:"max_decoded_body_size"`
+		DisableSendfile    bool   `json:"disable_sendfile"`
+		AccessLog          bool   `json:"access_log"`
+		MetricsPath        string `json:"metrics_path"`
+		MaxConns           int    `json:"max_conns"`
+		QueueConns         bool   `json:"queue_conns"`
+		MaxConnsPerIP      int    `json:"max_conns_per_ip"`
+	}{
+		Addr:               d.s.Addr().String(),
+		ServerName:         c.ServerName,
+		TLS:                c.TLSConfig != nil,
+		EnableH2C:          c.EnableH2C,
+		IdleTimeout:        d.s.idleTimeout().String(),
+		DecodeBodies:       c.DecodeBodies,
+		MaxDecodedBodySize: d.s.maxDecodedBodySize(),
+		DisableSendfile:    c.DisableSendfile,
+		AccessLog:          c.AccessLog != nil,
+		MetricsPath:        c.MetricsPath,
+		MaxConns:           c.MaxConns,
+		QueueConns:         c.QueueConns,
+		MaxConnsPerIP:      c.MaxConnsPerIP,
+	}
+}
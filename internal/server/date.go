@@ -0,0 +1,40 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/response"
+)
+
+type dateValue struct {
+	unix  int64
+	value string
+}
+
+// dateCache formats the Date header at most once per second of clock time.
+type dateCache struct {
+	clock   func() time.Time
+	current atomic.Pointer[dateValue]
+}
+
+func newDateCache(clock func() time.Time) *dateCache {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &dateCache{clock: clock}
+}
+
+func (d *dateCache) get() string {
+	now := d.clock()
+	sec := now.Unix()
+	if cur := d.current.Load(); cur != nil && cur.unix == sec {
+		return cur.value
+	}
+	v := &dateValue{
+		unix:  sec,
+		value: now.UTC().Format(response.TimeFormat),
+	}
+	d.current.Store(v)
+	return v.value
+}
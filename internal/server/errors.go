@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/ar3ty/httpfromtcp/internal/http2"
+)
+
+type errorClass int
+
+const (
+	classReset errorClass = iota
+	classBrokenPipe
+	classTimeout
+	classOther
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case classReset:
+		return "client reset"
+	case classBrokenPipe:
+		return "broken pipe"
+	case classTimeout:
+		return "timeout"
+	default:
+		return "other"
+	}
+}
+
+// ConnErrors counts failed reads and writes on client connections by
+// cause.
+type ConnErrors struct {
+	Reset      uint64
+	BrokenPipe uint64
+	Timeout    uint64
+	Other      uint64
+}
+
+type connErrorCounters struct {
+	counts [classOther + 1]atomic.Uint64
+}
+
+func classify(err error) errorClass {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, http2.ErrStreamReset):
+		return classReset
+	case errors.Is(err, syscall.EPIPE):
+		return classBrokenPipe
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return classTimeout
+	default:
+		return classOther
+	}
+}
+
+// ConnErrors returns how many connection errors the server has seen.
+func (s *Server) ConnErrors() ConnErrors {
+	c := &s.connErrors.counts
+	return ConnErrors{
+		Reset:      c[classReset].Load(),
+		BrokenPipe: c[classBrokenPipe].Load(),
+		Timeout:    c[classTimeout].Load(),
+		Other:      c[classOther].Load(),
+	}
+}
+
+// connError records an error on a client connection. Clients going away
+// are routine and logged at debug level, timeouts at info, and anything
+// else as an error.
+func (s *Server) connError(err error, op string, remoteAddr string) {
+	class := classify(err)
+	s.connErrors.counts[class].Add(1)
+	if s.metrics != nil {
+		s.metrics.connErrors.Inc(classLabels[class])
+	}
+
+	level := slog.LevelError
+	switch class {
+	case classReset, classBrokenPipe:
+		level = slog.LevelDebug
+	case classTimeout:
+		level = slog.LevelInfo
+	}
+	s.errorLog().LogAttrs(context.Background(), level, "connection error",
+		slog.String("op", op),
+		slog.String("class", class.String()),
+		slog.String("remote_addr", remoteAddr),
+		slog.String("err", err.Error()),
+	)
+}
+
+func (s *Server) errorLog() *slog.Logger {
+	if s.config.ErrorLog == nil {
+		return slog.Default()
+	}
+	return s.config.ErrorLog
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/response"
+)
+
+const (
+	defaultRetryAfter = time.Second
+	// rejectTimeout bounds the time spent answering a rejected connection,
+	// or draining one that sent a malformed request.
+	rejectTimeout = time.Second
+)
+
+const (
+	rejectMaxConns      = "max_conns"
+	rejectMaxConnsPerIP = "max_conns_per_ip"
+)
+
+// acquire waits for a connection slot under MaxConns and reports false
+// if the server was closed meanwhile.
+func (s *Server) acquire() bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// admit takes what a connection from ip needs to be served, or returns
+// why it can't be. queued tells that the slot under MaxConns was
+// acquired while waiting for the connection.
+func (s *Server) admit(ip string, queued bool) string {
+	if s.config.MaxConnsPerIP > 0 {
+		s.mu.Lock()
+		full := s.perIP[ip] >= s.config.MaxConnsPerIP
+		if !full {
+			s.perIP[ip]++
+		}
+		s.mu.Unlock()
+		if full {
+			if queued {
+				<-s.slots
+			}
+			return rejectMaxConnsPerIP
+		}
+	}
+	if s.slots != nil && !queued {
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			s.releaseIP(ip)
+			return rejectMaxConns
+		}
+	}
+	return ""
+}
+
+// release gives back what admit took for a connection.
+func (s *Server) release(ip string) {
+	s.releaseIP(ip)
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+func (s *Server) releaseIP(ip string) {
+	if s.config.MaxConnsPerIP == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.perIP[ip]--; s.perIP[ip] <= 0 {
+		delete(s.perIP, ip)
+	}
+}
+
+// reject answers a connection over a limit with a 503 and closes it.
+func (s *Server) reject(conn net.Conn, reason string) {
+	defer conn.Close()
+	if s.metrics != nil {
+		s.metrics.rejected.Inc(reason)
+	}
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	retryAfter := s.config.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+	w := s.newWriter(conn)
+	w.SetDefaultHeader("Connection", "close")
+	w.SetDefaultHeader("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	report(w, response.ServiceUnavailable, "too many connections")
+	drain(conn)
+}
+
+// drain reads what the client sent until it closes, which keeps closing
+// conn from resetting the connection before the response was read. The
+// caller bounds it with a deadline.
+func drain(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+	io.Copy(io.Discard, conn)
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
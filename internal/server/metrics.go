@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/metrics"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+)
+
+// defaultRoute labels requests when Config.Route is not set. Request paths
+// aren't used, so that clients can't create a series for every path.
+const defaultRoute = "other"
+
+// serverMetrics is the instrumentation of a server with Config.Metrics.
+type serverMetrics struct {
+	accepted    *metrics.Counter
+	active      *metrics.Gauge
+	rejected    *metrics.Counter
+	requests    *metrics.Counter
+	duration    *metrics.Histogram
+	received    *metrics.Counter
+	sent        *metrics.Counter
+	parseErrors *metrics.Counter
+	connErrors  *metrics.Counter
+	panics      *metrics.Counter
+}
+
+func newServerMetrics(r *metrics.Registry) *serverMetrics {
+	return &serverMetrics{
+		accepted: r.Counter("http_server_connections_accepted_total",
+			"Connections accepted."),
+		active: r.Gauge("http_server_connections_active",
+			"Connections being served."),
+		rejected: r.Counter("http_server_connections_rejected_total",
+			"Connections rejected, by the limit they were over.", "limit"),
+		requests: r.Counter("http_server_requests_total",
+			"Requests answered, by method, route and status.", "method", "route", "status"),
+		duration: r.Histogram("http_server_request_duration_seconds",
+			"Time from a parsed request to the end of its response.", nil, "method", "route"),
+		received: r.Counter("http_server_request_body_bytes_total",
+			"Request body bytes received."),
+		sent: r.Counter("http_server_response_body_bytes_total",
+			"Response body bytes sent."),
+		parseErrors: r.Counter("http_server_parse_errors_total",
+			"Malformed requests, by the part at fault.", "type"),
+		connErrors: r.Counter("http_server_connection_errors_total",
+			"Failed reads and writes on client connections, by cause.", "class"),
+		panics: r.Counter("http_server_panics_total",
+			"Handler panics recovered."),
+	}
+}
+
+var classLabels = [...]string{
+	classReset:      "reset",
+	classBrokenPipe: "broken_pipe",
+	classTimeout:    "timeout",
+	classOther:      "other",
+}
+
+func parseErrorType(err error) string {
+	switch {
+	case errors.Is(err, request.ErrInvalidRequestLine):
+		return "request_line"
+	case errors.Is(err, request.ErrInvalidMethod):
+		return "method"
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return "version"
+	case errors.Is(err, request.ErrInvalidHeader):
+		return "header"
+	case errors.Is(err, request.ErrInvalidContentLength):
+		return "content_length"
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		return "transfer_encoding"
+	case errors.Is(err, request.ErrIncompleteRequest):
+		return "incomplete"
+	default:
+		return "other"
+	}
+}
+
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH":
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+func requestPath(req *request.Request) string {
+	path, _, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+	return path
+}
+
+func (s *Server) route(req *request.Request) string {
+	if s.config.Route != nil {
+		return s.config.Route(req)
+	}
+	return defaultRoute
+}
+
+// observe records a finished request.
+func (s *Server) observe(w *response.Writer, req *request.Request, received int, start time.Time) {
+	m := s.metrics
+	method := methodLabel(req.RequestLine.Method)
+	route := s.route(req)
+	m.requests.Inc(method, route, strconv.Itoa(int(w.Status())))
+	m.duration.Observe(time.Since(start).Seconds(), method, route)
+	m.received.Add(float64(received))
+	m.sent.Add(float64(w.BytesSent()))
+}
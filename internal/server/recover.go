@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+)
+
+// Panic describes a handler panic the server recovered from.
+type Panic struct {
+	Value   any
+	Stack   []byte
+	Request *request.Request
+}
+
+// recoverPanic keeps a panicking handler from taking the server down. It
+// must be deferred. The client gets a 500 if nothing was sent yet;
+// otherwise the response is aborted, as it can't be completed reliably.
+func (s *Server) recoverPanic(w *response.Writer, req *request.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	p := Panic{Value: v, Stack: debug.Stack(), Request: req}
+	if s.metrics != nil {
+		s.metrics.panics.Inc()
+	}
+	switch {
+	case w.Hijacked():
+	case w.Status() == 0:
+		report(w, response.InternalServerError, "internal server error")
+	default:
+		w.Abort()
+	}
+
+	s.errorLog().Error("handler panic",
+		slog.String("panic", fmt.Sprint(v)),
+		slog.String("method", req.RequestLine.Method),
+		slog.String("target", req.RequestLine.RequestTarget),
+		slog.String("remote_addr", req.RemoteAddr),
+		slog.String("request_id", req.ID),
+		slog.String("stack", string(p.Stack)),
+	)
+	if s.config.OnPanic != nil {
+		s.config.OnPanic(p)
+	}
+}
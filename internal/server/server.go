@@ -1,62 +1,202 @@
 package server
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/ar3ty/httpfromtcp/internal/accesslog"
+	"github.com/ar3ty/httpfromtcp/internal/debug"
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/http2"
+	"github.com/ar3ty/httpfromtcp/internal/metrics"
 	"github.com/ar3ty/httpfromtcp/internal/request"
 	"github.com/ar3ty/httpfromtcp/internal/response"
 )
 
+// report answers with an error response. A failed write only concerns
+// the connection and shows in w.Err.
 func report(w *response.Writer, code response.StatusCode, messagestr string) {
-	err := w.WriteStatusLine(code)
-	if err != nil {
-		log.Fatalf("Error writing in connection: %v", err)
-	}
 	message := []byte(messagestr)
-
-	err = w.WriteHeaders(response.GetDefaultHeaders(len(message)))
-	if err != nil {
-		log.Fatalf("Error writing in connection: %v", err)
+	if err := w.WriteStatusLine(code); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(response.GetDefaultHeaders(len(message))); err != nil {
+		return
 	}
-
 	if len(message) > 0 {
-		_, err = w.WriteBody(message)
-		if err != nil {
-			log.Fatalf("Error writing in connection: %v", err)
-		}
+		w.WriteBody(message)
 	}
 }
 
 type Handler func(w *response.Writer, req *request.Request)
 
+type Config struct {
+	// ServerName is sent in the Server header when not empty.
+	ServerName string
+	// Clock is used for the Date header, time.Now if nil.
+	Clock func() time.Time
+	// DecodeBodies makes the server decode gzip and deflate request
+	// bodies before they reach the handler.
+	DecodeBodies bool
+	// MaxDecodedBodySize limits decoded request bodies, and the bodies
+	// buffered for HTTP/2 requests, 10 MiB if zero.
+	MaxDecodedBodySize int
+	// DisableSendfile turns off zero-copy file responses, for file
+	// systems where sendfile is unreliable.
+	DisableSendfile bool
+	// EnableH2C serves HTTP/2 over cleartext to clients that send the
+	// HTTP/2 preface right away or ask for "Upgrade: h2c".
+	EnableH2C bool
+	// TLSConfig makes the server accept TLS connections only. HTTP/2 is
+	// used with clients that negotiate "h2" through ALPN.
+	TLSConfig *tls.Config
+	// IdleTimeout limits how long a kept-alive connection waits for the
+	// next request, and an HTTP/2 connection with no handler running for
+	// the next frame, 2 minutes if zero.
+	IdleTimeout time.Duration
+	// ErrorLog receives connection errors, slog.Default() if nil.
+	ErrorLog *slog.Logger
+	// AccessLog gets an entry for every request when not nil. Requests are
+	// then given an ID, taken from a valid X-Request-ID header or
+	// generated, which is echoed in the response.
+	AccessLog *accesslog.Logger
+	// OnPanic is called with every handler panic, after it was logged to
+	// ErrorLog, for reporting it elsewhere.
+	OnPanic func(p Panic)
+	// Metrics receives the server's instrumentation when not nil.
+	Metrics *metrics.Registry
+	// MetricsPath, when not empty, is answered by the server itself with
+	// the contents of Metrics in the Prometheus text format. Metrics is
+	// created if nil.
+	MetricsPath string
+	// Route names the route of a request in the request metrics. It should
+	// return one of a few fixed names, not the request path. Requests are
+	// all counted as "other" if nil.
+	Route func(req *request.Request) string
+	// Debug serves the endpoints of the debug package, with goroutine
+	// dumps, profiles, the open connections and this configuration, when
+	// not nil.
+	Debug *debug.Config
+	// ConnState is called when a connection changes state, from the
+	// goroutine serving it. Connections rejected for a limit are not
+	// reported.
+	ConnState func(conn net.Conn, state ConnState)
+	// MaxConns limits how many connections are served at once; zero means
+	// no limit. Connections past it are answered with a 503 and closed.
+	MaxConns int
+	// QueueConns makes connections past MaxConns wait to be accepted
+	// instead, in the listen backlog of the kernel.
+	QueueConns bool
+	// MaxConnsPerIP limits the connections served at once for one client
+	// IP address; connections past it are rejected like for MaxConns.
+	MaxConnsPerIP int
+	// RetryAfter is sent with rejected connections, rounded up to
+	// seconds, 1 second if zero.
+	RetryAfter time.Duration
+}
+
+// DefaultMaxDecodedBodySize is the request body limit when
+// Config.MaxDecodedBodySize is zero.
+const DefaultMaxDecodedBodySize = 10 << 20
+
+const (
+	handshakeTimeout   = 10 * time.Second
+	defaultIdleTimeout = 2 * time.Minute
+)
+
 type Server struct {
-	listener net.Listener
-	handler  Handler
-	closed   atomic.Bool
+	listener  net.Listener
+	handler   Handler
+	config    Config
+	dates     *dateCache
+	closed    atomic.Bool
+	done      chan struct{}
+	closeOnce sync.Once
+
+	connErrors connErrorCounters
+	metrics    *serverMetrics
+	debug      Handler
+
+	// slots holds a value for each connection served under MaxConns.
+	slots chan struct{}
+
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+	perIP map[string]int
 }
 
 func Serve(port int, handler Handler) (*Server, error) {
+	return ServeWithConfig(port, handler, Config{})
+}
+
+func ServeWithConfig(port int, handler Handler, config Config) (*Server, error) {
 	portStr := ":" + strconv.Itoa(port)
 	listener, err := net.Listen("tcp", portStr)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create listener: %v", err)
 	}
+	return ServeListener(listener, handler, config), nil
+}
+
+// ServeListener serves connections accepted from listener, which the
+// server closes on Close.
+func ServeListener(listener net.Listener, handler Handler, config Config) *Server {
+	if config.TLSConfig != nil {
+		tlsConfig := config.TLSConfig.Clone()
+		if tlsConfig.NextProtos == nil {
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		if tlsConfig.MinVersion == 0 {
+			tlsConfig.MinVersion = tls.VersionTLS12
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 	server := &Server{
 		listener: listener,
 		handler:  handler,
+		config:   config,
+		dates:    newDateCache(config.Clock),
+		done:     make(chan struct{}),
+		perIP:    map[string]int{},
+	}
+	if config.MaxConns > 0 {
+		server.slots = make(chan struct{}, config.MaxConns)
+	}
+	if config.MetricsPath != "" && config.Metrics == nil {
+		server.config.Metrics = metrics.NewRegistry()
+	}
+	if server.config.Metrics != nil {
+		server.metrics = newServerMetrics(server.config.Metrics)
+	}
+	if config.Debug != nil {
+		server.debug = debug.Handler(debugSource{server}, *config.Debug)
 	}
 
 	go server.listen()
 
-	return server, nil
+	return server
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
 }
 
 func (s *Server) Close() error {
 	s.closed.Store(true)
+	s.closeOnce.Do(func() { close(s.done) })
 	if s.listener != nil {
 		return s.listener.Close()
 	}
@@ -65,30 +205,362 @@ func (s *Server) Close() error {
 
 func (s *Server) listen() {
 	for {
+		// Queued connections wait to be accepted until a slot frees up.
+		queued := s.slots != nil && s.config.QueueConns
+		if queued && !s.acquire() {
+			return
+		}
 		conn, err := s.listener.Accept()
 		if err != nil {
+			if queued {
+				<-s.slots
+			}
 			if s.closed.Load() {
 				return
 			}
-			log.Printf("Couldn't get connection: %v", err)
+			s.errorLog().Error("accept failed", slog.String("err", err.Error()))
+			continue
+		}
+		if s.metrics != nil {
+			s.metrics.accepted.Inc()
+		}
+		ip := remoteIP(conn)
+		if reason := s.admit(ip, queued); reason != "" {
+			go s.reject(conn, reason)
 			continue
 		}
-		fmt.Printf("Connection accepted from: %s\n", conn.RemoteAddr())
+		go s.handle(conn, ip)
+	}
+}
+
+func (s *Server) newWriter(conn net.Conn) *response.Writer {
+	w := response.NewWriter(conn)
+	s.setDefaults(w)
+	return w
+}
+
+func (s *Server) newFramedWriter(f response.Framer) *response.Writer {
+	w := response.NewFramedWriter(f)
+	s.setDefaults(w)
+	return w
+}
 
-		go s.handle(conn)
+func (s *Server) setDefaults(w *response.Writer) {
+	w.SetDefaultHeader("Date", s.dates.get())
+	if s.config.ServerName != "" {
+		w.SetDefaultHeader("Server", s.config.ServerName)
+	}
+	if s.config.DisableSendfile {
+		w.DisableSendfile()
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+// http2Server serves the HTTP/2 streams of one connection.
+func (s *Server) http2Server(proto string, state *tls.ConnectionState) *http2.Server {
+	return &http2.Server{
+		Handler: func(w *response.Writer, req *request.Request) {
+			req.Proto = proto
+			req.TLS = state
+			s.serve(w, req)
+		},
+		NewWriter:   s.newFramedWriter,
+		MaxBodySize: s.maxDecodedBodySize(),
+		IdleTimeout: s.idleTimeout(),
+	}
+}
 
-	resWriter := response.NewWriter(conn)
+func (s *Server) handle(conn net.Conn, ip string) {
+	if s.metrics != nil {
+		s.metrics.active.Inc()
+	}
+	tc := s.track(conn)
+	// done gives up the connection, when it is closed or as soon as a
+	// handler hijacks it: from then on it is no longer the server's to
+	// count against the limits or report.
+	hijacked := false
+	done := func(state ConnState) {
+		s.untrack(tc, state)
+		if s.metrics != nil {
+			s.metrics.active.Dec()
+		}
+		s.release(ip)
+	}
+	defer func() {
+		if !hijacked {
+			conn.Close()
+			done(StateClosed)
+		}
+	}()
+
+	var state *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		cs := tlsConn.ConnectionState()
+		state = &cs
+		if cs.NegotiatedProtocol == "h2" {
+			s.setProto(tc, "h2")
+			s.setState(tc, StateActive)
+			s.http2Server("h2", state).ServeConn(conn, nil)
+			return
+		}
+	}
+
+	var r io.Reader = conn
+	sniffed := bytes.NewReader(nil)
+	if s.config.EnableH2C && state == nil {
+		prefix, ok := sniffPreface(conn)
+		if ok {
+			s.setProto(tc, "h2c")
+			s.setState(tc, StateActive)
+			s.http2Server("h2c", nil).ServeConn(conn, prefix)
+			return
+		}
+		sniffed.Reset(prefix)
+		r = io.MultiReader(sniffed, conn)
+	}
+
+	reader := request.NewReader(stateReader{r, s, tc})
+
+	// Requests are handled one after another, so pipelined requests are
+	// answered in the order they arrived.
+	for first := true; ; first = false {
+		if !first {
+			if len(reader.Buffered()) == 0 {
+				s.setState(tc, StateIdle)
+			} else {
+				s.setState(tc, StateReading)
+			}
+			conn.SetReadDeadline(time.Now().Add(s.idleTimeout()))
+		}
+		req, err := reader.ReadRequest()
+		conn.SetReadDeadline(time.Time{})
+		var netErr net.Error
+		if errors.Is(err, io.EOF) || !first && errors.As(err, &netErr) && netErr.Timeout() {
+			return
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) {
+			s.connError(err, "read", conn.RemoteAddr().String())
+			return
+		}
 
-	req, err := request.RequestFromReader(conn)
+		hijack := func() (net.Conn, []byte, error) {
+			buffered := append([]byte(nil), reader.Buffered()...)
+			rest, _ := io.ReadAll(sniffed)
+			return conn, append(buffered, rest...), nil
+		}
+		resWriter := s.newWriter(conn)
+		resWriter.SetHijacker(func() (net.Conn, []byte, error) {
+			conn, buffered, err := hijack()
+			if err == nil {
+				hijacked = true
+				done(StateHijacked)
+			}
+			return conn, buffered, err
+		})
+		if err != nil {
+			if s.metrics != nil {
+				s.metrics.parseErrors.Inc(parseErrorType(err))
+			}
+			// Where the request ended is unknown, so nothing after it can
+			// be read.
+			resWriter.SetDefaultHeader("Connection", "close")
+			if errors.Is(err, request.ErrUnsupportedTransferEncoding) {
+				report(resWriter, response.NotImplemented, "transfer encodings are not supported")
+			} else {
+				report(resWriter, response.BadRequest, "couldn't get request")
+			}
+			if err := resWriter.Err(); err != nil {
+				s.connError(err, "write", conn.RemoteAddr().String())
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(rejectTimeout))
+			drain(conn)
+			return
+		}
+		req.RemoteAddr = conn.RemoteAddr().String()
+		req.Proto = "http/1.1"
+		req.TLS = state
+		s.setState(tc, StateActive)
+
+		if first && s.config.EnableH2C && state == nil {
+			if settings, ok := h2cSettings(req); ok {
+				s.setProto(tc, "h2c")
+				// The connection stays the server's after the upgrade, and
+				// the HTTP/2 server closes it when done.
+				resWriter.SetHijacker(hijack)
+				s.upgradeH2C(resWriter, req, settings)
+				return
+			}
+		}
+		connection, _ := req.Headers.Get("Connection")
+		closing := headers.HasToken(connection, "close")
+		if closing {
+			resWriter.SetDefaultHeader("Connection", "close")
+		}
+
+		s.serve(resWriter, req)
+		if resWriter.Hijacked() {
+			return
+		}
+		if closing || !resWriter.KeepAlive() {
+			return
+		}
+	}
+}
+
+func (s *Server) maxDecodedBodySize() int {
+	if s.config.MaxDecodedBodySize == 0 {
+		return DefaultMaxDecodedBodySize
+	}
+	return s.config.MaxDecodedBodySize
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.config.IdleTimeout == 0 {
+		return defaultIdleTimeout
+	}
+	return s.config.IdleTimeout
+}
+
+// serve runs the handler for a parsed request on either protocol.
+func (s *Server) serve(resWriter *response.Writer, req *request.Request) {
+	start := time.Now()
+	resWriter.SetRequestMethod(req.RequestLine.Method)
+	defer func() {
+		if err := resWriter.Err(); err != nil {
+			s.connError(err, "write", req.RemoteAddr)
+		}
+	}()
+	if s.config.AccessLog != nil {
+		req.ID = requestID(req)
+		resWriter.SetDefaultHeader("X-Request-ID", req.ID)
+		defer s.logAccess(resWriter, req, start)
+	}
+	if s.metrics != nil {
+		defer s.observe(resWriter, req, len(req.Body), start)
+	}
+	defer s.recoverPanic(resWriter, req)
+	if s.config.DecodeBodies {
+		err := req.DecodeBody(s.maxDecodedBodySize())
+		if errors.Is(err, request.ErrUnsupportedEncoding) {
+			resWriter.SetDefaultHeader("Accept-Encoding", "gzip, deflate")
+			report(resWriter, response.UnsupportedMediaType, "unsupported content encoding")
+			return
+		}
+		if errors.Is(err, request.ErrBodyTooLarge) {
+			report(resWriter, response.ContentTooLarge, "decoded body is too large")
+			return
+		}
+		if err != nil {
+			report(resWriter, response.BadRequest, "couldn't decode request body")
+			return
+		}
+	}
+
+	switch {
+	case s.config.MetricsPath != "" && requestPath(req) == s.config.MetricsPath:
+		s.config.Metrics.Handler()(resWriter, req)
+	case s.debug != nil && s.config.Debug.Matches(req.RequestLine.RequestTarget):
+		s.debug(resWriter, req)
+	default:
+		s.handler(resWriter, req)
+	}
+	if !resWriter.Hijacked() {
+		resWriter.Finish()
+	}
+}
+
+func (s *Server) logAccess(w *response.Writer, req *request.Request, start time.Time) {
+	proto := "HTTP/1.1"
+	if req.Proto == "h2" || req.Proto == "h2c" {
+		proto = "HTTP/2.0"
+	}
+	userAgent, _ := req.Headers.Get("User-Agent")
+	referer, _ := req.Headers.Get("Referer")
+	s.config.AccessLog.Log(accesslog.Entry{
+		Time:       start,
+		RemoteAddr: req.RemoteAddr,
+		Method:     req.RequestLine.Method,
+		Target:     req.RequestLine.RequestTarget,
+		Proto:      proto,
+		Status:     int(w.Status()),
+		Bytes:      w.BytesSent(),
+		Duration:   time.Since(start),
+		UserAgent:  userAgent,
+		Referer:    referer,
+		RequestID:  req.ID,
+	})
+}
+
+// requestID returns the ID the client sent in X-Request-ID if it is short
+// and printable, and a random one otherwise.
+func requestID(req *request.Request) string {
+	if id, ok := req.Headers.Get("X-Request-ID"); ok && len(id) > 0 && len(id) <= 128 {
+		valid := true
+		for i := 0; i < len(id); i++ {
+			if id[i] <= ' ' || id[i] > '~' {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			return id
+		}
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sniffPreface reads from conn for as long as the bytes match the HTTP/2
+// client preface and reports whether all of it arrived. An HTTP/1.1
+// request differs within the first two bytes.
+func sniffPreface(conn net.Conn) ([]byte, bool) {
+	buf := make([]byte, 0, len(http2.ClientPreface))
+	for len(buf) < cap(buf) {
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if !strings.HasPrefix(http2.ClientPreface, string(buf)) || err != nil {
+			return buf, false
+		}
+	}
+	return buf, true
+}
+
+// h2cSettings returns the decoded HTTP2-Settings of a request asking to
+// upgrade to HTTP/2 over cleartext.
+func h2cSettings(req *request.Request) ([]byte, bool) {
+	upgrade, _ := req.Headers.Get("Upgrade")
+	connection, _ := req.Headers.Get("Connection")
+	encoded, ok := req.Headers.Get("HTTP2-Settings")
+	if !ok || !headers.HasToken(upgrade, "h2c") || !headers.HasToken(connection, "upgrade") || !headers.HasToken(connection, "http2-settings") {
+		return nil, false
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(encoded), "="))
 	if err != nil {
-		report(resWriter, 500, "couldn't get request")
-		return
+		return nil, false
 	}
+	return settings, true
+}
 
-	s.handler(resWriter, req)
+func (s *Server) upgradeH2C(w *response.Writer, req *request.Request, settings []byte) {
+	h := headers.NewHeaders()
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "h2c")
+	if err := w.WriteStatusLine(response.SwitchingProtocols); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		return
+	}
+	s.http2Server("h2c", nil).ServeUpgrade(conn, buffered, req, settings)
 }
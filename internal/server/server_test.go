@@ -0,0 +1,925 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/accesslog"
+	"github.com/ar3ty/httpfromtcp/internal/debug"
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/http2"
+	"github.com/ar3ty/httpfromtcp/internal/metrics"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func okHandler(w *response.Writer, _ *request.Request) {
+	message := []byte("ok")
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(message)))
+	w.WriteBody(message)
+}
+
+func roundTrip(t *testing.T, s *Server, raw string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	// The server closes a kept-alive connection once it has answered
+	// everything the client sent.
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestDateCache(t *testing.T) {
+	now := time.Date(2024, time.March, 5, 7, 8, 9, 0, time.UTC)
+	cache := newDateCache(func() time.Time { return now })
+
+	// Test: IMF-fixdate formatting
+	assert.Equal(t, "Tue, 05 Mar 2024 07:08:09 GMT", cache.get())
+
+	// Test: Same second reuses the cached value
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, "Tue, 05 Mar 2024 07:08:09 GMT", cache.get())
+
+	// Test: Next second refreshes the value
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, "Tue, 05 Mar 2024 07:08:10 GMT", cache.get())
+
+	// Test: Non-UTC clocks are converted to GMT
+	now = time.Date(2024, time.March, 5, 10, 8, 11, 0, time.FixedZone("MSK", 3*60*60))
+	assert.Equal(t, "Tue, 05 Mar 2024 07:08:11 GMT", cache.get())
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	clock := func() time.Time { return time.Date(2024, time.March, 5, 7, 8, 9, 0, time.UTC) }
+
+	// Test: Date and Server are added to responses
+	s, err := ServeWithConfig(0, okHandler, Config{ServerName: "httpfromtcp", Clock: clock})
+	require.NoError(t, err)
+	resp := roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	s.Close()
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, resp, "date: Tue, 05 Mar 2024 07:08:09 GMT\r\n")
+	assert.Contains(t, resp, "server: httpfromtcp\r\n")
+
+	// Test: Server header is omitted when not configured
+	s, err = ServeWithConfig(0, okHandler, Config{Clock: clock})
+	require.NoError(t, err)
+	resp = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	s.Close()
+	assert.Contains(t, resp, "date: Tue, 05 Mar 2024 07:08:09 GMT\r\n")
+	assert.NotContains(t, resp, "server:")
+
+	// Test: Handler values take precedence over defaults
+	s, err = ServeWithConfig(0, func(w *response.Writer, _ *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Set("Server", "custom")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+	}, Config{ServerName: "httpfromtcp", Clock: clock})
+	require.NoError(t, err)
+	resp = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	s.Close()
+	assert.Contains(t, resp, "server: custom\r\n")
+	assert.NotContains(t, resp, "server: httpfromtcp")
+}
+
+func TestDecodeBodies(t *testing.T) {
+	var body []byte
+	s, err := ServeWithConfig(0, func(w *response.Writer, req *request.Request) {
+		body = req.Body
+		okHandler(w, req)
+	}, Config{DecodeBodies: true})
+	require.NoError(t, err)
+	defer s.Close()
+
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	gw.Write([]byte("hello world!\n"))
+	gw.Close()
+
+	// Test: Gzip body reaches the handler decoded
+	resp := roundTrip(t, s, fmt.Sprintf("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n%s", buf.Len(), buf.String()))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.Equal(t, "hello world!\n", string(body))
+
+	// Test: Unsupported coding is rejected with 415
+	resp = roundTrip(t, s, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: br\r\nContent-Length: 3\r\n\r\nabc")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 415 Unsupported Media Type\r\n"))
+	assert.Contains(t, resp, "accept-encoding: gzip, deflate\r\n")
+}
+
+func TestHijack(t *testing.T) {
+	results := make(chan error, 1)
+	s, err := Serve(0, func(w *response.Writer, _ *request.Request) {
+		conn, buffered, err := w.Hijack()
+		if err != nil {
+			results <- err
+			return
+		}
+		defer conn.Close()
+
+		rest := make([]byte, len("EXTRA")-len(buffered))
+		if _, err := io.ReadFull(conn, rest); err != nil {
+			results <- err
+			return
+		}
+		if _, err := conn.Write(append(append([]byte("raw:"), buffered...), rest...)); err != nil {
+			results <- err
+			return
+		}
+		if _, _, err := w.Hijack(); err != response.ErrHijacked {
+			results <- fmt.Errorf("second hijack returned %v", err)
+			return
+		}
+		if err := w.WriteStatusLine(response.OK); err != response.ErrHijacked {
+			results <- fmt.Errorf("write after hijack returned %v", err)
+			return
+		}
+		results <- nil
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Bytes read past the request are handed over with the connection
+	resp := roundTrip(t, s, "GET /upgrade HTTP/1.1\r\nHost: localhost\r\n\r\nEXTRA")
+	require.NoError(t, <-results)
+	assert.Equal(t, "raw:EXTRA", resp)
+
+	// Test: Writer without a hijacker
+	w := response.NewWriter(&bytes.Buffer{})
+	_, _, err = w.Hijack()
+	assert.ErrorIs(t, err, response.ErrNotHijackable)
+}
+
+func TestPipelining(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		message := []byte(req.RequestLine.RequestTarget + " " + string(req.Body))
+		h := response.GetDefaultHeaders(len(message))
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteBody(message)
+	}
+	s, err := ServeWithConfig(0, handler, Config{IdleTimeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	defer s.Close()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := response.NewReader(conn)
+
+	// Test: Three requests in a single write are answered in order
+	_, err = conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"POST /submit HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\ndata" +
+		"GET /last HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	for _, want := range []string{"/slow ", "/submit data", "/last "} {
+		resp, err := reader.ReadResponse("GET")
+		require.NoError(t, err)
+		assert.Equal(t, want, string(resp.Body))
+		assert.NotContains(t, resp.Headers, "connection")
+	}
+
+	// Test: The connection stays open for the next request
+	_, err = conn.Write([]byte("GET /again HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := reader.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, "/again ", string(resp.Body))
+
+	// Test: The body written for HEAD isn't sent ahead of the next response
+	_, err = conn.Write([]byte("HEAD /head HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /after HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = reader.ReadResponse("HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, "6", resp.Headers["content-length"])
+	resp, err = reader.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, 200, int(resp.StatusCode))
+	assert.Equal(t, "/after ", string(resp.Body))
+
+	// Test: Connection: close in the request ends the connection
+	_, err = conn.Write([]byte("GET /bye HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n" +
+		"GET /ignored HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = reader.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, "/bye ", string(resp.Body))
+	assert.Equal(t, "close", resp.Headers["connection"])
+	_, err = reader.ReadResponse("GET")
+	assert.Error(t, err)
+
+	// Test: Idle connections are closed after IdleTimeout
+	idle, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+	idle.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = idle.Write([]byte("GET /first HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	idleReader := response.NewReader(idle)
+	_, err = idleReader.ReadResponse("GET")
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = idleReader.ReadResponse("GET")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// Test: A body short of its Content-Length ends the connection rather
+	// than run into the next response
+	short, err := ServeWithConfig(0, func(w *response.Writer, req *request.Request) {
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "10")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("short"))
+	}, Config{})
+	require.NoError(t, err)
+	defer short.Close()
+	conn = dial(t, short, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	// The close may reset the connection, as the second request is unread.
+	data, _ := io.ReadAll(conn)
+	assert.True(t, strings.HasSuffix(string(data), "\r\n\r\nshort"))
+	assert.Equal(t, 1, strings.Count(string(data), "HTTP/1.1"))
+}
+
+func TestSmuggling(t *testing.T) {
+	var mu sync.Mutex
+	var targets []string
+	s, err := ServeWithConfig(0, func(w *response.Writer, req *request.Request) {
+		mu.Lock()
+		targets = append(targets, req.RequestLine.RequestTarget)
+		mu.Unlock()
+		keepAliveHandler(w, req)
+	}, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+	const smuggled = "GET /admin HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+	// Test: A chunked body is refused and the connection closed, so a
+	// request hidden in it is never handled
+	resp := roundTrip(t, s, "POST /upload HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(smuggled), smuggled))
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 501 Not Implemented\r\n"))
+	assert.Contains(t, resp, "connection: close\r\n")
+	assert.Equal(t, 1, strings.Count(resp, "HTTP/1.1"))
+
+	// Test: Transfer-Encoding with Content-Length is a bad request
+	resp = roundTrip(t, s, "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"+smuggled)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 400 Bad Request\r\n"))
+	assert.Equal(t, 1, strings.Count(resp, "HTTP/1.1"))
+
+	// Test: So are conflicting Content-Length headers
+	resp = roundTrip(t, s, "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\nContent-Length: 41\r\n\r\n"+smuggled)
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 400 Bad Request\r\n"))
+	assert.Equal(t, 1, strings.Count(resp, "HTTP/1.1"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Empty(t, targets)
+}
+
+// lineWriter passes every write on as one line.
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestAccessLog(t *testing.T) {
+	lines := make(lineWriter, 10)
+	config := Config{AccessLog: accesslog.New(lines, accesslog.FormatJSON)}
+	s, err := ServeWithConfig(0, okHandler, config)
+	require.NoError(t, err)
+	defer s.Close()
+
+	entry := func() map[string]any {
+		select {
+		case line := <-lines:
+			var fields map[string]any
+			require.NoError(t, json.Unmarshal([]byte(line), &fields))
+			return fields
+		case <-time.After(5 * time.Second):
+			t.Fatal("no access log entry")
+			return nil
+		}
+	}
+
+	// Test: Entry for a request, with a generated ID echoed to the client
+	resp := roundTrip(t, s, "GET /path?x=1 HTTP/1.1\r\nHost: localhost\r\nUser-Agent: test-agent\r\n\r\n")
+	fields := entry()
+	assert.Equal(t, "GET", fields["method"])
+	assert.Equal(t, "/path?x=1", fields["target"])
+	assert.Equal(t, "HTTP/1.1", fields["proto"])
+	assert.Equal(t, float64(200), fields["status"])
+	assert.Equal(t, float64(2), fields["bytes"])
+	assert.Equal(t, "test-agent", fields["user_agent"])
+	assert.NotEmpty(t, fields["remote_addr"])
+	id, _ := fields["request_id"].(string)
+	assert.Len(t, id, 32)
+	assert.Contains(t, resp, "x-request-id: "+id+"\r\n")
+
+	// Test: A client request ID is kept
+	resp = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Request-ID: upstream-42\r\n\r\n")
+	assert.Equal(t, "upstream-42", entry()["request_id"])
+	assert.Contains(t, resp, "x-request-id: upstream-42\r\n")
+
+	// Test: Requests the server rejects are logged too
+	config.DecodeBodies = true
+	s2, err := ServeWithConfig(0, okHandler, config)
+	require.NoError(t, err)
+	defer s2.Close()
+	roundTrip(t, s2, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Encoding: br\r\nContent-Length: 1\r\n\r\nx")
+	assert.Equal(t, float64(415), entry()["status"])
+}
+
+type failingWriter struct {
+	err error
+}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+func TestConnErrors(t *testing.T) {
+	// Test: Errors are classified by cause
+	reset := &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.ECONNRESET)}
+	assert.Equal(t, classReset, classify(reset))
+	assert.Equal(t, classBrokenPipe, classify(fmt.Errorf("wrapped: %w", syscall.EPIPE)))
+	assert.Equal(t, classTimeout, classify(os.ErrDeadlineExceeded))
+	assert.Equal(t, classReset, classify(http2.ErrStreamReset))
+	assert.Equal(t, classOther, classify(io.ErrShortWrite))
+
+	// Test: report survives a connection that fails every write
+	w := response.NewWriter(failingWriter{syscall.EPIPE})
+	report(w, response.InternalServerError, "couldn't get request")
+	assert.ErrorIs(t, w.Err(), syscall.EPIPE)
+	assert.False(t, w.KeepAlive())
+
+	// Test: A client resetting its connection mid-response is counted and
+	// logged, and the server keeps serving
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+	logged := &lockedBuffer{}
+	logs := slog.New(slog.NewTextHandler(logged, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	s, err := ServeWithConfig(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget != "/big" {
+			okHandler(w, req)
+			return
+		}
+		close(started)
+		<-proceed
+		chunk := bytes.Repeat([]byte("x"), 64*1024)
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(chunk) * 256))
+		for i := 0; i < 256; i++ {
+			if _, err := w.WriteBody(chunk); err != nil {
+				return
+			}
+		}
+	}, Config{ErrorLog: logs})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET /big HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+	close(proceed)
+
+	require.Eventually(t, func() bool {
+		counts := s.ConnErrors()
+		return counts.Reset+counts.BrokenPipe == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	resp := roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logged.String(), "level=DEBUG msg=\"connection error\" op=write")
+	}, time.Second, 10*time.Millisecond)
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+func TestPanicRecovery(t *testing.T) {
+	panics := make(chan Panic, 1)
+	logged := &lockedBuffer{}
+	s, err := ServeWithConfig(0, func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/early":
+			panic("boom")
+		case "/late":
+			h := headers.NewHeaders()
+			h.Set("Content-Length", "10")
+			w.WriteStatusLine(response.OK)
+			w.WriteHeaders(h)
+			w.WriteBody([]byte("part"))
+			panic("boom")
+		default:
+			okHandler(w, req)
+		}
+	}, Config{
+		EnableH2C: true,
+		ErrorLog:  slog.New(slog.NewTextHandler(logged, nil)),
+		OnPanic:   func(p Panic) { panics <- p },
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: A panic before anything was sent is answered with a 500
+	resp := roundTrip(t, s, "GET /early HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 500 Internal Server Error\r\n"))
+	p := <-panics
+	assert.Equal(t, "boom", p.Value)
+	assert.Equal(t, "/early", p.Request.RequestLine.RequestTarget)
+	assert.Contains(t, string(p.Stack), "TestPanicRecovery")
+	assert.Contains(t, logged.String(), `level=ERROR msg="handler panic" panic=boom method=GET target=/early`)
+
+	// Test: The server keeps serving
+	resp = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: A panic midway through the body closes the connection
+	resp = roundTrip(t, s, "GET /late HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(resp, "\r\n\r\npart"))
+	assert.Equal(t, "/late", (<-panics).Request.RequestLine.RequestTarget)
+
+	// Test: Over HTTP/2 the stream is reset
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// HEADERS with END_STREAM|END_HEADERS: GET, http, /late, :authority "x"
+	headersFrame := []byte{0, 0, 12, 1, 5, 0, 0, 0, 1, 0x82, 0x86, 0x44, 0x05, '/', 'l', 'a', 't', 'e', 0x41, 0x01, 'x'}
+	_, err = conn.Write(append(append([]byte(http2.ClientPreface), 0, 0, 0, 4, 0, 0, 0, 0, 0), headersFrame...))
+	require.NoError(t, err)
+	types, body := readH2Frames(t, conn)
+	assert.Equal(t, byte(3), types[len(types)-1])
+	assert.Equal(t, "part", body)
+	<-panics
+}
+
+func TestMetrics(t *testing.T) {
+	s, err := ServeWithConfig(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/boom" {
+			panic("boom")
+		}
+		okHandler(w, req)
+	}, Config{
+		MetricsPath: "/metrics",
+		Route:       requestPath,
+		ErrorLog:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	roundTrip(t, s, "GET /a?x=1 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	roundTrip(t, s, "POST /a HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nbody")
+	roundTrip(t, s, "GET /boom HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	for _, malformed := range []string{
+		"GET /a HTTP/9\r\nHost: localhost\r\n\r\n",
+		"GET /a HTTP/1.1\r\nHost localhost\r\n\r\n",
+	} {
+		// The server may reset the connection, having left bytes unread.
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		conn.Write([]byte(malformed))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		io.ReadAll(conn)
+		conn.Close()
+	}
+
+	// Test: The metrics path is answered by the server
+	// Connections are counted as active until just after they are closed.
+	require.Eventually(t, func() bool {
+		var buf bytes.Buffer
+		s.config.Metrics.WriteTo(&buf)
+		return strings.Contains(buf.String(), "http_server_connections_active 0\n")
+	}, 5*time.Second, 10*time.Millisecond)
+	resp := roundTrip(t, s, "GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, resp, "content-type: text/plain; version=0.0.4; charset=utf-8\r\n")
+
+	// Test: Connections, requests, bytes, parse errors and panics are counted
+	for _, line := range []string{
+		"http_server_connections_accepted_total 6\n",
+		"http_server_connections_active 1\n",
+		`http_server_requests_total{method="GET",route="/a",status="200"} 1` + "\n",
+		`http_server_requests_total{method="POST",route="/a",status="200"} 1` + "\n",
+		`http_server_requests_total{method="GET",route="/boom",status="500"} 1` + "\n",
+		`http_server_request_duration_seconds_count{method="GET",route="/a"} 1` + "\n",
+		"http_server_request_body_bytes_total 4\n",
+		"http_server_response_body_bytes_total 25\n",
+		`http_server_parse_errors_total{type="header"} 1` + "\n",
+		`http_server_parse_errors_total{type="version"} 1` + "\n",
+		"http_server_panics_total 1\n",
+	} {
+		assert.Contains(t, resp, line)
+	}
+
+	// Test: Without Config.Route requests share one route label
+	assert.Equal(t, "other", (&Server{}).route(&request.Request{RequestLine: request.RequestLine{RequestTarget: "/scan/1"}}))
+}
+
+func TestConns(t *testing.T) {
+	release := make(chan struct{})
+	s, err := ServeWithConfig(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/block" {
+			<-release
+		}
+		h := headers.NewHeaders()
+		h.Set("Content-Length", "2")
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("ok"))
+	}, Config{Debug: &debug.Config{}})
+	require.NoError(t, err)
+	defer s.Close()
+	defer close(release)
+
+	states := func() map[string]string {
+		m := map[string]string{}
+		for _, c := range s.Conns() {
+			m[c.RemoteAddr] = c.State.String()
+		}
+		return m
+	}
+
+	// Test: Connections are listed with their state
+	idle := dial(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	_, err = response.NewReader(idle).ReadResponse("GET")
+	require.NoError(t, err)
+	reading := dial(t, s, "GET / HTTP/1.1\r\nHost: loc")
+	active := dial(t, s, "GET /block HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.Eventually(t, func() bool {
+		m := states()
+		return m[idle.LocalAddr().String()] == "idle" &&
+			m[reading.LocalAddr().String()] == "reading" &&
+			m[active.LocalAddr().String()] == "active"
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, c := range s.Conns() {
+		assert.Equal(t, "http/1.1", c.Proto)
+		assert.WithinDuration(t, time.Now(), c.Since, 5*time.Second)
+	}
+
+	// Test: The debug endpoints show them to loopback clients
+	resp := roundTrip(t, s, "GET /debug/conns HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, resp, `"remote_addr": "`+active.LocalAddr().String()+`"`)
+	resp = roundTrip(t, s, "GET /debug/config HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	assert.Contains(t, resp, `"idle_timeout": "2m0s"`)
+
+	// Test: Closed connections are dropped
+	idle.Close()
+	require.Eventually(t, func() bool {
+		_, ok := states()[idle.LocalAddr().String()]
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func keepAliveHandler(w *response.Writer, req *request.Request) {
+	h := headers.NewHeaders()
+	h.Set("Content-Length", "2")
+	w.WriteStatusLine(response.OK)
+	w.WriteHeaders(h)
+	w.WriteBody([]byte("ok"))
+}
+
+func TestConnState(t *testing.T) {
+	var mu sync.Mutex
+	states := map[string][]string{}
+	hijacked := make(chan struct{}, 2)
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/hijack" {
+			conn, _, err := w.Hijack()
+			if err == nil {
+				hijacked <- struct{}{}
+				<-release
+				conn.Close()
+			}
+			return
+		}
+		keepAliveHandler(w, req)
+	}
+	s, err := ServeWithConfig(0, handler, Config{ConnState: func(conn net.Conn, state ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		addr := conn.RemoteAddr().String()
+		states[addr] = append(states[addr], state.String())
+	}})
+	require.NoError(t, err)
+	defer s.Close()
+	statesOf := func(conn net.Conn) []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), states[conn.LocalAddr().String()]...)
+	}
+
+	// Test: A kept-alive connection goes through every state
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	reader := response.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		_, err = reader.ReadResponse("GET")
+		require.NoError(t, err)
+	}
+	conn.Close()
+	want := []string{"new", "reading", "active", "idle", "reading", "active", "idle", "closed"}
+	require.Eventually(t, func() bool { return len(statesOf(conn)) == len(want) }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, want, statesOf(conn))
+
+	// Test: Hijacking ends the tracking while the handler still runs
+	conn = dial(t, s, "GET /hijack HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	<-hijacked
+	assert.Equal(t, []string{"new", "reading", "active", "hijacked"}, statesOf(conn))
+	for _, c := range s.Conns() {
+		assert.NotEqual(t, conn.LocalAddr().String(), c.RemoteAddr)
+	}
+
+	// Test: Hijacked connections don't count against the limits
+	limited, err := ServeWithConfig(0, handler, Config{MaxConns: 1, MaxConnsPerIP: 1})
+	require.NoError(t, err)
+	defer limited.Close()
+	hijackedConn := dial(t, limited, "GET /hijack HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	<-hijacked
+	assert.Empty(t, limited.Conns())
+	resp, err := response.NewReader(dial(t, limited, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")).ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, response.OK, resp.StatusCode)
+	close(release)
+	hijackedConn.Close()
+}
+
+// dial opens a connection to s and sends raw on it.
+func dial(t *testing.T, s *Server, raw string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	return conn
+}
+
+func TestConnLimits(t *testing.T) {
+	const get = "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	release := make(chan struct{}, 10)
+	blocking := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/block" {
+			<-release
+		}
+		okHandler(w, req)
+	}
+	start := func(config Config) *Server {
+		config.ErrorLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+		s, err := ServeWithConfig(0, blocking, config)
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	blocked := func(s *Server, n int) {
+		require.Eventually(t, func() bool { return len(s.Conns()) == n }, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// Test: Connections past MaxConns are rejected with a 503
+	s := start(Config{MaxConns: 1, RetryAfter: 1500 * time.Millisecond, Metrics: metrics.NewRegistry()})
+	first := dial(t, s, "GET /block HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	blocked(s, 1)
+	resp, err := io.ReadAll(dial(t, s, get))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(resp), "HTTP/1.1 503 Service Unavailable\r\n"))
+	assert.Contains(t, string(resp), "retry-after: 2\r\n")
+	assert.Contains(t, string(resp), "connection: close\r\n")
+	assert.True(t, strings.HasSuffix(string(resp), "too many connections"))
+	var buf bytes.Buffer
+	s.config.Metrics.WriteTo(&buf)
+	assert.Contains(t, buf.String(), `http_server_connections_rejected_total{limit="max_conns"} 1`)
+
+	// Test: The slot is free again once the connection is closed
+	release <- struct{}{}
+	first.(*net.TCPConn).CloseWrite()
+	io.ReadAll(first)
+	assert.True(t, strings.HasPrefix(roundTrip(t, s, get), "HTTP/1.1 200 OK\r\n"))
+
+	// Test: With QueueConns connections wait for a slot
+	s = start(Config{MaxConns: 1, QueueConns: true})
+	first = dial(t, s, "GET /block HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	blocked(s, 1)
+	queued := dial(t, s, get)
+	queued.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = queued.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	release <- struct{}{}
+	first.(*net.TCPConn).CloseWrite()
+	queued.(*net.TCPConn).CloseWrite()
+	queued.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err = io.ReadAll(queued)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(resp), "HTTP/1.1 200 OK\r\n"))
+
+	// Test: Connections of one IP past MaxConnsPerIP are rejected
+	s = start(Config{MaxConnsPerIP: 1})
+	dial(t, s, "GET /block HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	blocked(s, 1)
+	resp, err = io.ReadAll(dial(t, s, get))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(resp), "HTTP/1.1 503 Service Unavailable\r\n"))
+	assert.Contains(t, string(resp), "retry-after: 1\r\n")
+	release <- struct{}{}
+}
+
+// readH2Frames reads raw HTTP/2 frames until stream 1 ends or is reset
+// and returns the types seen and the DATA payload of stream 1.
+func readH2Frames(t *testing.T, r io.Reader) ([]byte, string) {
+	t.Helper()
+	var types []byte
+	var body []byte
+	for {
+		head := make([]byte, 9)
+		_, err := io.ReadFull(r, head)
+		require.NoError(t, err)
+		payload := make([]byte, int(head[0])<<16|int(head[1])<<8|int(head[2]))
+		_, err = io.ReadFull(r, payload)
+		require.NoError(t, err)
+		types = append(types, head[3])
+		streamID := binary.BigEndian.Uint32(head[5:])
+		if streamID != 1 {
+			continue
+		}
+		if head[3] == 0 {
+			body = append(body, payload...)
+		}
+		if head[4]&0x1 != 0 || head[3] == 3 {
+			return types, string(body)
+		}
+	}
+}
+
+func TestH2C(t *testing.T) {
+	s, err := ServeWithConfig(0, func(w *response.Writer, req *request.Request) {
+		message := []byte(fmt.Sprintf("%s %s v%s", req.RequestLine.Method, req.RequestLine.RequestTarget, req.RequestLine.HttpVersion))
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(message)))
+		w.WriteBody(message)
+	}, Config{EnableH2C: true})
+	require.NoError(t, err)
+	defer s.Close()
+	emptySettings := []byte{0, 0, 0, 4, 0, 0, 0, 0, 0}
+
+	// Test: Prior knowledge
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// HEADERS with END_STREAM|END_HEADERS: GET, http, /, :authority "x"
+	headersFrame := []byte{0, 0, 6, 1, 5, 0, 0, 0, 1, 0x82, 0x86, 0x84, 0x41, 0x01, 'x'}
+	_, err = conn.Write(append(append([]byte(http2.ClientPreface), emptySettings...), headersFrame...))
+	require.NoError(t, err)
+	types, body := readH2Frames(t, conn)
+	assert.Equal(t, byte(4), types[0])
+	assert.Equal(t, "GET / v2", body)
+	conn.Close()
+
+	// Test: Upgrade from HTTP/1.1 answers the request on stream 1
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("GET /upgraded HTTP/1.1\r\nHost: x\r\nConnection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQCAAAAAAIAAAAA\r\n\r\n"))
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 101, resp.StatusCode)
+	assert.Equal(t, "h2c", resp.Header.Get("Upgrade"))
+	_, err = conn.Write(append([]byte(http2.ClientPreface), emptySettings...))
+	require.NoError(t, err)
+	types, body = readH2Frames(t, reader)
+	assert.Equal(t, byte(4), types[0])
+	assert.Equal(t, "GET /upgraded v1.1", body)
+
+	// Test: Plain HTTP/1.1 still works
+	assert.Contains(t, roundTrip(t, s, "POST /plain HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\n\r\n"), "POST /plain v1.1")
+}
+
+func selfSignedConfig(t *testing.T) (*tls.Config, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, pool
+}
+
+func TestTLS(t *testing.T) {
+	serverConfig, pool := selfSignedConfig(t)
+	s, err := ServeWithConfig(0, func(w *response.Writer, req *request.Request) {
+		message := []byte(fmt.Sprintf("proto=%s tls=%t body=%s", req.Proto, req.TLS != nil, req.Body))
+		w.WriteStatusLine(response.OK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(message)))
+		w.WriteBody(message)
+	}, Config{TLSConfig: serverConfig})
+	require.NoError(t, err)
+	defer s.Close()
+	url := fmt.Sprintf("https://127.0.0.1:%d/", s.Addr().(*net.TCPAddr).Port)
+
+	get := func(forceH2 bool, body string) (*http.Response, string) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool},
+			ForceAttemptHTTP2: forceH2,
+		}}
+		resp, err := client.Post(url, "text/plain", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(data)
+	}
+
+	// Test: Clients negotiating h2 get HTTP/2
+	resp, body := get(true, "over h2")
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, "h2", resp.TLS.NegotiatedProtocol)
+	assert.Equal(t, "proto=h2 tls=true body=over h2", body)
+
+	// Test: Clients offering only http/1.1 stay on HTTP/1.1
+	resp, body = get(false, "over h1")
+	assert.Equal(t, 1, resp.ProtoMajor)
+	assert.Equal(t, "proto=http/1.1 tls=true body=over h1", body)
+
+	// Test: Plaintext requests are rejected by the handshake
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	data, _ := io.ReadAll(conn)
+	assert.NotContains(t, string(data), "proto=")
+}
@@ -0,0 +1,192 @@
+package sse
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+)
+
+const defaultHeartbeatInterval = 15 * time.Second
+
+var (
+	ErrClosed       = errors.New("sse: stream closed")
+	ErrInvalidField = errors.New("sse: event field contains a line break")
+)
+
+type Config struct {
+	// HeartbeatInterval is how often a comment line is sent to keep the
+	// connection open and notice clients that went away. 15s if zero,
+	// disabled if negative.
+	HeartbeatInterval time.Duration
+	// Retry tells clients how long to wait before reconnecting. Not sent if zero.
+	Retry time.Duration
+	// Replay returns the events a reconnecting client missed after the
+	// given Last-Event-ID. They are sent before NewStream returns.
+	Replay func(lastEventID string) []Event
+}
+
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	// Retry overrides the client's reconnection delay when non-zero.
+	Retry time.Duration
+}
+
+// Stream writes a text/event-stream response. Send and Close are safe to
+// call from several goroutines.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+
+	mu   sync.Mutex
+	err  error
+	done chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewStream starts the event stream response on w.
+func NewStream(w *response.Writer, req *request.Request, config Config) (*Stream, error) {
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	lastEventID, _ := req.Headers.Get("Last-Event-ID")
+	s := &Stream{
+		w:           w,
+		lastEventID: strings.TrimSpace(lastEventID),
+		done:        make(chan struct{}),
+		stop:        make(chan struct{}),
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("X-Accel-Buffering", "no")
+	if err := w.WriteStatusLine(response.OK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	if config.Retry > 0 {
+		if err := s.write("retry: " + strconv.FormatInt(config.Retry.Milliseconds(), 10) + "\n\n"); err != nil {
+			return nil, err
+		}
+	}
+	if config.Replay != nil && s.lastEventID != "" {
+		for _, e := range config.Replay(s.lastEventID) {
+			if err := s.Send(e); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if config.HeartbeatInterval > 0 {
+		s.wg.Add(1)
+		go s.heartbeat(config.HeartbeatInterval)
+	}
+	// The server finishes the response once the handler returns, and the
+	// stream must not be written to after that.
+	w.OnFinish(func() { s.Close() })
+	return s, nil
+}
+
+// LastEventID is the ID of the last event a reconnecting client saw.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once the stream can no longer be written to, usually
+// because the client disconnected.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Stream) Send(e Event) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return ErrInvalidField
+	}
+
+	var b strings.Builder
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Comment sends a line clients ignore.
+func (s *Stream) Comment(text string) error {
+	if strings.ContainsAny(text, "\r\n") {
+		return ErrInvalidField
+	}
+	return s.write(": " + text + "\n\n")
+}
+
+// Close stops the heartbeats, and Send fails with ErrClosed afterwards.
+// The stream is closed when the response finishes, so the server ends
+// the chunked body once the handler returns even without a Close.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.err == nil {
+		s.shutdown(ErrClosed)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Stream) heartbeat(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.write(":\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Stream) write(p string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if _, err := s.w.WriteChunkedBody([]byte(p)); err != nil {
+		s.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Stream) shutdown(err error) {
+	s.err = err
+	close(s.stop)
+	close(s.done)
+}
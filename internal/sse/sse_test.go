@@ -0,0 +1,180 @@
+package sse
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/ar3ty/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler server.Handler) string {
+	t.Helper()
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return fmt.Sprintf("http://127.0.0.1:%d/events", s.Addr().(*net.TCPAddr).Port)
+}
+
+func subscribe(t *testing.T, url, lastEventID string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp, bufio.NewReader(resp.Body)
+}
+
+// readBlock reads lines up to the blank line ending an event.
+func readBlock(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	var b strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\n" {
+			return b.String()
+		}
+		b.WriteString(line)
+	}
+}
+
+func TestStream(t *testing.T) {
+	url := startServer(t, func(w *response.Writer, req *request.Request) {
+		s, err := NewStream(w, req, Config{HeartbeatInterval: -1, Retry: 3 * time.Second})
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer s.Close()
+		s.Send(Event{ID: "1", Event: "update", Data: "first"})
+		s.Send(Event{Data: "line one\nline two\r\nline three"})
+		s.Comment("just saying")
+		assert.ErrorIs(t, s.Send(Event{ID: "bad\nid"}), ErrInvalidField)
+		s.Send(Event{ID: "2", Data: "", Retry: 500 * time.Millisecond})
+	})
+
+	resp, body := subscribe(t, url, "")
+
+	// Test: Response headers
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+
+	// Test: Retry hint is sent first
+	assert.Equal(t, "retry: 3000\n", readBlock(t, body))
+
+	// Test: Event with id and type
+	assert.Equal(t, "id: 1\nevent: update\ndata: first\n", readBlock(t, body))
+
+	// Test: Multi-line data is split into data lines
+	assert.Equal(t, "data: line one\ndata: line two\ndata: line three\n", readBlock(t, body))
+
+	// Test: Comment
+	assert.Equal(t, ": just saying\n", readBlock(t, body))
+
+	// Test: Empty data and per-event retry
+	assert.Equal(t, "id: 2\nretry: 500\ndata: \n", readBlock(t, body))
+
+	// Test: Stream ends when the handler returns
+	_, err := body.ReadByte()
+	assert.Error(t, err)
+}
+
+func TestResume(t *testing.T) {
+	history := []Event{{ID: "1", Data: "a"}, {ID: "2", Data: "b"}, {ID: "3", Data: "c"}}
+	seen := make(chan string, 1)
+	url := startServer(t, func(w *response.Writer, req *request.Request) {
+		s, err := NewStream(w, req, Config{
+			HeartbeatInterval: -1,
+			Replay: func(lastEventID string) []Event {
+				for i, e := range history {
+					if e.ID == lastEventID {
+						return history[i+1:]
+					}
+				}
+				return history
+			},
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer s.Close()
+		seen <- s.LastEventID()
+		s.Send(Event{ID: "4", Data: "live"})
+	})
+
+	// Test: Missed events are replayed after Last-Event-ID
+	_, body := subscribe(t, url, "1")
+	assert.Equal(t, "1", <-seen)
+	assert.Equal(t, "id: 2\ndata: b\n", readBlock(t, body))
+	assert.Equal(t, "id: 3\ndata: c\n", readBlock(t, body))
+	assert.Equal(t, "id: 4\ndata: live\n", readBlock(t, body))
+
+	// Test: Fresh clients get no replay
+	_, body = subscribe(t, url, "")
+	assert.Equal(t, "", <-seen)
+	assert.Equal(t, "id: 4\ndata: live\n", readBlock(t, body))
+}
+
+func TestHeartbeatAndDisconnect(t *testing.T) {
+	stopped := make(chan error, 1)
+	url := startServer(t, func(w *response.Writer, req *request.Request) {
+		s, err := NewStream(w, req, Config{HeartbeatInterval: 10 * time.Millisecond})
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer s.Close()
+		select {
+		case <-s.Done():
+			stopped <- s.Send(Event{Data: "too late"})
+		case <-time.After(5 * time.Second):
+			stopped <- nil
+		}
+	})
+
+	// Test: Heartbeat comments arrive while idle
+	resp, body := subscribe(t, url, "")
+	assert.Equal(t, ":\n", readBlock(t, body))
+	assert.Equal(t, ":\n", readBlock(t, body))
+
+	// Test: Stream stops once the client is gone
+	resp.Body.Close()
+	assert.Error(t, <-stopped)
+}
+
+func TestFinishClosesStream(t *testing.T) {
+	streams := make(chan *Stream, 1)
+	url := startServer(t, func(w *response.Writer, req *request.Request) {
+		s, err := NewStream(w, req, Config{HeartbeatInterval: time.Millisecond})
+		if !assert.NoError(t, err) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+		streams <- s
+	})
+
+	// Test: A handler returning without Close still ends the body cleanly
+	resp, body := subscribe(t, url, "")
+	_, err := io.ReadAll(body)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// Test: The stream is closed once the response is finished
+	s := <-streams
+	<-s.Done()
+	assert.ErrorIs(t, s.Send(Event{Data: "too late"}), ErrClosed)
+}
@@ -0,0 +1,381 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	ContinuationMessage = 0
+	TextMessage         = 1
+	BinaryMessage       = 2
+	CloseMessage        = 8
+	PingMessage         = 9
+	PongMessage         = 10
+)
+
+// Close codes from RFC 6455, 7.4.1.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+const (
+	defaultMaxMessageSize = 1 << 20
+	maxControlPayload     = 125
+	closeTimeout          = 5 * time.Second
+)
+
+var (
+	ErrMessageTooLarge = errors.New("websocket: message exceeds size limit")
+	ErrCloseSent       = errors.New("websocket: close frame already sent")
+)
+
+// CloseError is returned by ReadMessage once the peer has sent a close frame.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with %d %s", e.Code, e.Text)
+}
+
+type Conn struct {
+	// Subprotocol is the subprotocol agreed on during the handshake.
+	Subprotocol string
+
+	conn   net.Conn
+	reader *bufio.Reader
+	// client connections mask what they send and expect unmasked frames.
+	client         bool
+	maxMessageSize int64
+	fragmentSize   int
+	pongHandler    func(data []byte)
+
+	writeMu       sync.Mutex
+	closeSent     bool
+	closeReceived bool
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, client bool, config Config) *Conn {
+	if config.MaxMessageSize == 0 {
+		config.MaxMessageSize = defaultMaxMessageSize
+	}
+	return &Conn{
+		conn:           conn,
+		reader:         reader,
+		client:         client,
+		maxMessageSize: config.MaxMessageSize,
+		fragmentSize:   config.FragmentSize,
+	}
+}
+
+// SetPongHandler sets a function called with the payload of every pong.
+func (c *Conn) SetPongHandler(h func(data []byte)) {
+	c.pongHandler = h
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+type frame struct {
+	fin     bool
+	rsv     byte
+	opcode  int
+	masked  bool
+	payload []byte
+}
+
+func (c *Conn) readFrame() (*frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return nil, err
+	}
+	f := &frame{
+		fin:    head[0]&0x80 != 0,
+		rsv:    head[0] & 0x70,
+		opcode: int(head[0] & 0x0f),
+		masked: head[1]&0x80 != 0,
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return nil, c.fail(CloseProtocolError, "invalid payload length")
+		}
+	}
+
+	if f.rsv != 0 {
+		return nil, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	if f.masked == c.client {
+		return nil, c.fail(CloseProtocolError, "wrong frame masking")
+	}
+	if f.opcode >= CloseMessage {
+		if f.opcode > PongMessage {
+			return nil, c.fail(CloseProtocolError, "unknown opcode")
+		}
+		if !f.fin || length > maxControlPayload {
+			return nil, c.fail(CloseProtocolError, "invalid control frame")
+		}
+	} else if f.opcode > BinaryMessage {
+		return nil, c.fail(CloseProtocolError, "unknown opcode")
+	}
+	if int64(length) > c.maxMessageSize {
+		return nil, c.fail(CloseMessageTooBig, "message too big")
+	}
+
+	var key [4]byte
+	if f.masked {
+		if _, err := io.ReadFull(c.reader, key[:]); err != nil {
+			return nil, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, f.payload); err != nil {
+		return nil, err
+	}
+	if f.masked {
+		maskBytes(key, f.payload)
+	}
+	return f, nil
+}
+
+// ReadMessage returns the next text or binary message, reassembling
+// fragments. Pings are answered and a close frame from the peer is
+// acknowledged and reported as a *CloseError.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	messageType := 0
+	var message []byte
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case PingMessage:
+			if err := c.writeFrame(true, PongMessage, f.payload); err != nil && err != ErrCloseSent {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			if c.pongHandler != nil {
+				c.pongHandler(f.payload)
+			}
+			continue
+		case CloseMessage:
+			return 0, nil, c.handleClose(f.payload)
+		case ContinuationMessage:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		default:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "expected continuation frame")
+			}
+			messageType = f.opcode
+		}
+
+		if int64(len(message)+len(f.payload)) > c.maxMessageSize {
+			return 0, nil, c.fail(CloseMessageTooBig, "message too big")
+		}
+		message = append(message, f.payload...)
+		if !f.fin {
+			continue
+		}
+
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(CloseInvalidPayload, "invalid UTF-8")
+		}
+		return messageType, message, nil
+	}
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+	c.closeReceived = true
+	closeErr := &CloseError{Code: CloseNoStatus}
+	if len(payload) == 1 {
+		return c.fail(CloseProtocolError, "invalid close payload")
+	}
+	if len(payload) >= 2 {
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Text = string(payload[2:])
+		if !validCloseCode(closeErr.Code) || !utf8.Valid(payload[2:]) {
+			return c.fail(CloseProtocolError, "invalid close payload")
+		}
+	}
+
+	reply := CloseNormal
+	if closeErr.Code != CloseNoStatus {
+		reply = closeErr.Code
+	}
+	if err := c.WriteClose(reply, ""); err != nil && err != ErrCloseSent {
+		return err
+	}
+	return closeErr
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code >= 1000 && code <= 1011:
+		return code != 1004 && code != 1005 && code != 1006
+	}
+	return false
+}
+
+// fail sends a close frame for a protocol violation and returns the
+// matching error.
+func (c *Conn) fail(code int, reason string) error {
+	c.WriteClose(code, reason)
+	if code == CloseMessageTooBig {
+		return ErrMessageTooLarge
+	}
+	return &CloseError{Code: code, Text: reason}
+}
+
+// WriteMessage sends p as a single message, split into frames of
+// Config.FragmentSize bytes when set.
+func (c *Conn) WriteMessage(messageType int, p []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return c.writeFrame(true, messageType, p)
+	}
+	if c.fragmentSize <= 0 || len(p) <= c.fragmentSize {
+		return c.writeFrame(true, messageType, p)
+	}
+
+	opcode := messageType
+	for len(p) > c.fragmentSize {
+		if err := c.writeFrame(false, opcode, p[:c.fragmentSize]); err != nil {
+			return err
+		}
+		p = p[c.fragmentSize:]
+		opcode = ContinuationMessage
+	}
+	return c.writeFrame(true, opcode, p)
+}
+
+func (c *Conn) Ping(data []byte) error {
+	return c.writeFrame(true, PingMessage, data)
+}
+
+// WriteClose starts the closing handshake with the given status.
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], reason)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	return c.writeFrame(true, CloseMessage, payload)
+}
+
+// Close finishes the closing handshake, waiting briefly for the peer's
+// close frame, and closes the connection. It must not run concurrently
+// with ReadMessage.
+func (c *Conn) Close() error {
+	if err := c.WriteClose(CloseNormal, ""); err != nil && err != ErrCloseSent {
+		c.conn.Close()
+		return err
+	}
+	if !c.closeReceived {
+		c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		for {
+			f, err := c.readFrame()
+			if err != nil || f.opcode == CloseMessage {
+				break
+			}
+		}
+	}
+	return c.conn.Close()
+}
+
+func (c *Conn) writeFrame(fin bool, opcode int, payload []byte) error {
+	if opcode >= CloseMessage && len(payload) > maxControlPayload {
+		return errors.New("websocket: control frame payload too long")
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+
+	buf := make([]byte, 0, 14+len(payload))
+	b0 := byte(opcode)
+	if fin {
+		b0 |= 0x80
+	}
+	buf = append(buf, b0)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch length := len(payload); {
+	case length <= 125:
+		buf = append(buf, maskBit|byte(length))
+	case length <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+
+	if c.client {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf = append(buf, key[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		maskBytes(key, buf[start:])
+	} else {
+		buf = append(buf, payload...)
+	}
+
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func maskBytes(key [4]byte, p []byte) {
+	for i := range p {
+		p[i] ^= key[i%4]
+	}
+}
@@ -0,0 +1,175 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+type Config struct {
+	// MaxMessageSize limits a reassembled message, 1 MiB if zero. Bigger
+	// messages close the connection with 1009.
+	MaxMessageSize int64
+	// FragmentSize splits outgoing data messages into frames of at most
+	// this many bytes. Messages are sent whole if zero.
+	FragmentSize int
+	// Subprotocols lists the subprotocols the server accepts, in order of
+	// preference.
+	Subprotocols []string
+}
+
+// Upgrade validates the client handshake, replies with 101 Switching
+// Protocols and takes over the connection. On a bad handshake an error
+// response is written and ErrBadHandshake returned. A connection that
+// can't be hijacked, like an HTTP/2 stream, is answered with 501 and
+// response.ErrNotHijackable returned.
+func Upgrade(w *response.Writer, req *request.Request, config Config) (*Conn, error) {
+	if code := checkHandshake(req); code != response.OK {
+		h := headers.NewHeaders()
+		if code == response.UpgradeRequired {
+			h.Set("Sec-WebSocket-Version", "13")
+		}
+		if code == response.MethodNotAllowed {
+			h.Set("Allow", "GET")
+		}
+		response.WriteError(w, code, h)
+		return nil, ErrBadHandshake
+	}
+	if !w.Hijackable() {
+		response.WriteError(w, response.NotImplemented, nil)
+		return nil, response.ErrNotHijackable
+	}
+	key, _ := req.Headers.Get("Sec-WebSocket-Key")
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", acceptKey(key))
+	protocol := selectSubprotocol(req, config.Subprotocols)
+	if protocol != "" {
+		h.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	if err := w.WriteStatusLine(response.SwitchingProtocols); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn))
+	c := newConn(conn, reader, false, config)
+	c.Subprotocol = protocol
+	return c, nil
+}
+
+func checkHandshake(req *request.Request) response.StatusCode {
+	if req.RequestLine.Method != "GET" {
+		return response.MethodNotAllowed
+	}
+	upgrade, _ := req.Headers.Get("Upgrade")
+	connection, _ := req.Headers.Get("Connection")
+	if !headers.HasToken(upgrade, "websocket") || !headers.HasToken(connection, "upgrade") {
+		return response.BadRequest
+	}
+	if version, _ := req.Headers.Get("Sec-WebSocket-Version"); strings.TrimSpace(version) != "13" {
+		return response.UpgradeRequired
+	}
+	key, _ := req.Headers.Get("Sec-WebSocket-Key")
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(decoded) != 16 {
+		return response.BadRequest
+	}
+	return response.OK
+}
+
+func selectSubprotocol(req *request.Request, supported []string) string {
+	offered, ok := req.Headers.Get("Sec-WebSocket-Protocol")
+	if !ok {
+		return ""
+	}
+	for _, s := range supported {
+		if headers.HasToken(offered, s) {
+			return s
+		}
+	}
+	return ""
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(strings.TrimSpace(key) + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Dial opens a client connection to a ws:// URL.
+func Dial(rawURL string, config Config) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	handshake := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n",
+		u.RequestURI(), u.Host, key)
+	if len(config.Subprotocols) > 0 {
+		handshake += "Sec-WebSocket-Protocol: " + strings.Join(config.Subprotocols, ", ") + "\r\n"
+	}
+	if _, err := io.WriteString(conn, handshake+"\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "GET"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != int(response.SwitchingProtocols) ||
+		!headers.HasToken(resp.Header.Get("Upgrade"), "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		conn.Close()
+		return nil, fmt.Errorf("%w: status %d", ErrBadHandshake, resp.StatusCode)
+	}
+
+	c := newConn(conn, reader, true, config)
+	c.Subprotocol = resp.Header.Get("Sec-WebSocket-Protocol")
+	return c, nil
+}
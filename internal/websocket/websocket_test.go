@@ -0,0 +1,244 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ar3ty/httpfromtcp/internal/headers"
+	"github.com/ar3ty/httpfromtcp/internal/httptest"
+	"github.com/ar3ty/httpfromtcp/internal/request"
+	"github.com/ar3ty/httpfromtcp/internal/response"
+	"github.com/ar3ty/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startEcho(t *testing.T, config Config) (string, chan error) {
+	t.Helper()
+	done := make(chan error, 16)
+	s, err := server.Serve(0, func(w *response.Writer, req *request.Request) {
+		conn, err := Upgrade(w, req, config)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			if err := conn.WriteMessage(messageType, message); err != nil {
+				done <- err
+				return
+			}
+		}
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port), done
+}
+
+func handshake(t *testing.T, addr, raw string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "GET"})
+	require.NoError(t, err)
+	return conn, reader, resp
+}
+
+func TestHandshake(t *testing.T) {
+	addr, _ := startEcho(t, Config{Subprotocols: []string{"chat"}})
+	valid := "GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"
+
+	// Test: Accept key from RFC 6455, section 1.3
+	conn, _, resp := handshake(t, addr, valid+"Sec-WebSocket-Protocol: superchat, chat\r\n\r\n")
+	assert.Equal(t, 101, resp.StatusCode)
+	assert.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+	assert.Equal(t, "Upgrade", resp.Header.Get("Connection"))
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, "chat", resp.Header.Get("Sec-WebSocket-Protocol"))
+	assert.Empty(t, resp.Header.Get("Content-Length"))
+	conn.Close()
+
+	// Test: Frame sent right behind the handshake is not lost
+	frame := []byte{0x81, 0x85, 0, 0, 0, 0, 'h', 'e', 'l', 'l', 'o'}
+	conn, reader, resp := handshake(t, addr, valid+"\r\n"+string(frame))
+	assert.Equal(t, 101, resp.StatusCode)
+	echo := make([]byte, 7)
+	_, err := reader.Read(echo)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x81, 5, 'h', 'e', 'l', 'l', 'o'}, echo)
+	conn.Close()
+
+	// Test: Unsupported version
+	conn, _, resp = handshake(t, addr, strings.Replace(valid, "Version: 13", "Version: 8", 1)+"\r\n")
+	assert.Equal(t, 426, resp.StatusCode)
+	assert.Equal(t, "13", resp.Header.Get("Sec-WebSocket-Version"))
+	conn.Close()
+
+	// Test: Malformed key
+	conn, _, resp = handshake(t, addr, strings.Replace(valid, "dGhlIHNhbXBsZSBub25jZQ==", "c2hvcnQ=", 1)+"\r\n")
+	assert.Equal(t, 400, resp.StatusCode)
+	conn.Close()
+
+	// Test: Missing Upgrade header
+	conn, _, resp = handshake(t, addr, strings.Replace(valid, "Upgrade: websocket\r\n", "", 1)+"\r\n")
+	assert.Equal(t, 400, resp.StatusCode)
+	conn.Close()
+
+	// Test: Wrong method
+	conn, _, resp = handshake(t, addr, strings.Replace(valid, "GET", "POST", 1)+"\r\n")
+	assert.Equal(t, 405, resp.StatusCode)
+	conn.Close()
+
+	// Test: A writer that can't be hijacked gets an error, not a 101
+	req := httptest.NewRequest("GET", "/ws", headers.Headers{
+		"upgrade":               "websocket",
+		"connection":            "Upgrade",
+		"sec-websocket-key":     "dGhlIHNhbXBsZSBub25jZQ==",
+		"sec-websocket-version": "13",
+	}, nil)
+	rec := httptest.NewRecorder("GET")
+	_, err = Upgrade(rec.Writer, req, Config{})
+	assert.ErrorIs(t, err, response.ErrNotHijackable)
+	recorded, err := rec.Result()
+	require.NoError(t, err)
+	assert.Equal(t, response.NotImplemented, recorded.StatusCode)
+}
+
+func TestEcho(t *testing.T) {
+	addr, done := startEcho(t, Config{MaxMessageSize: 1 << 17})
+
+	conn, err := Dial("ws://"+addr+"/ws", Config{})
+	require.NoError(t, err)
+
+	// Test: Text and binary messages
+	require.NoError(t, conn.WriteMessage(TextMessage, []byte("hello, world")))
+	messageType, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, messageType)
+	assert.Equal(t, "hello, world", string(message))
+
+	require.NoError(t, conn.WriteMessage(BinaryMessage, []byte{0, 1, 2, 0xff}))
+	messageType, message, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, BinaryMessage, messageType)
+	assert.Equal(t, []byte{0, 1, 2, 0xff}, message)
+
+	// Test: 16 and 64 bit payload lengths
+	for _, size := range []int{300, 70000} {
+		payload := bytes.Repeat([]byte("x"), size)
+		require.NoError(t, conn.WriteMessage(BinaryMessage, payload))
+		_, message, err = conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, payload, message)
+	}
+
+	// Test: Ping is answered with a pong carrying the same payload
+	pongs := make(chan string, 1)
+	conn.SetPongHandler(func(data []byte) { pongs <- string(data) })
+	require.NoError(t, conn.Ping([]byte("are you there")))
+	require.NoError(t, conn.WriteMessage(TextMessage, []byte("after ping")))
+	_, message, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "after ping", string(message))
+	assert.Equal(t, "are you there", <-pongs)
+
+	// Test: Close handshake
+	require.NoError(t, conn.Close())
+	var closeErr *CloseError
+	require.ErrorAs(t, <-done, &closeErr)
+	assert.Equal(t, CloseNormal, closeErr.Code)
+}
+
+func TestFragmentation(t *testing.T) {
+	addr, _ := startEcho(t, Config{FragmentSize: 4})
+
+	conn, err := Dial("ws://"+addr+"/ws", Config{FragmentSize: 3})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Test: Fragmented message is reassembled both ways
+	require.NoError(t, conn.WriteMessage(TextMessage, []byte("fragmented message")))
+	messageType, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, messageType)
+	assert.Equal(t, "fragmented message", string(message))
+
+	// Test: Control frames may be interleaved with fragments
+	require.NoError(t, conn.writeFrame(false, TextMessage, []byte("in ")))
+	require.NoError(t, conn.writeFrame(true, PingMessage, nil))
+	require.NoError(t, conn.writeFrame(true, ContinuationMessage, []byte("between")))
+	_, message, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "in between", string(message))
+
+	// Test: UTF-8 sequence split across fragments
+	require.NoError(t, conn.writeFrame(false, TextMessage, []byte{0xe2, 0x82}))
+	require.NoError(t, conn.writeFrame(true, ContinuationMessage, []byte{0xac}))
+	_, message, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "€", string(message))
+}
+
+func TestProtocolErrors(t *testing.T) {
+	addr, done := startEcho(t, Config{MaxMessageSize: 16})
+	var closeErr *CloseError
+
+	tests := []struct {
+		name string
+		send func(c *Conn) error
+		code int
+	}{
+		{"invalid UTF-8", func(c *Conn) error {
+			return c.writeFrame(true, TextMessage, []byte{'o', 'k', 0xff})
+		}, CloseInvalidPayload},
+		{"message too big", func(c *Conn) error {
+			return c.WriteMessage(BinaryMessage, bytes.Repeat([]byte("x"), 17))
+		}, CloseMessageTooBig},
+		{"fragments over the limit", func(c *Conn) error {
+			c.writeFrame(false, BinaryMessage, bytes.Repeat([]byte("x"), 10))
+			return c.writeFrame(true, ContinuationMessage, bytes.Repeat([]byte("x"), 10))
+		}, CloseMessageTooBig},
+		{"unmasked client frame", func(c *Conn) error {
+			c.client = false
+			defer func() { c.client = true }()
+			return c.writeFrame(true, TextMessage, []byte("plain"))
+		}, CloseProtocolError},
+		{"continuation without start", func(c *Conn) error {
+			return c.writeFrame(true, ContinuationMessage, []byte("orphan"))
+		}, CloseProtocolError},
+		{"fragmented control frame", func(c *Conn) error {
+			return c.writeFrame(false, PingMessage, nil)
+		}, CloseProtocolError},
+		{"unknown opcode", func(c *Conn) error {
+			return c.writeFrame(true, 3, nil)
+		}, CloseProtocolError},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := Dial("ws://"+addr+"/ws", Config{})
+			require.NoError(t, err)
+			defer conn.Close()
+
+			require.NoError(t, tc.send(conn))
+			_, _, err = conn.ReadMessage()
+			require.ErrorAs(t, err, &closeErr)
+			assert.Equal(t, tc.code, closeErr.Code)
+			assert.Error(t, <-done)
+		})
+	}
+}